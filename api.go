@@ -1,208 +1,2192 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"fmt"
+	"log"
 	"math"
+	"math/big"
 	"net/http"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/google/uuid"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type Receipt struct {
-	Retailer			string 		`json:"retailer" binding:"required"`
-	PurchaseDate	string 		`json:"purchaseDate" binding:"required"`
-	PurchaseTime	string 		`json:"purchaseTime" binding:"required"`
-	Items					[]Item 		`json:"items" binding:"required,min=1"`
-	Total					string 		`json:"total" binding:"required"`
+	Retailer			string 		`json:"retailer" xml:"retailer" binding:"required"`
+	PurchaseDate	string 		`json:"purchaseDate" xml:"purchaseDate" binding:"required" pattern:"^\\d{4}-\\d{2}-\\d{2}$"`
+	PurchaseTime	string 		`json:"purchaseTime" xml:"purchaseTime" binding:"required" pattern:"^\\d{2}:\\d{2}$"`
+	Items					[]Item 		`json:"items" xml:"items>item" binding:"required,min=1"`
+	Total					Amount 		`json:"total" xml:"total" binding:"required"`
+	Tags					[]string	`json:"tags,omitempty" xml:"-"`
+	Departments		[]Department	`json:"departments,omitempty" xml:"-"`
 }
 
+// Items grouped under a named department. A receipt may send departments instead of
+// items; they are flattened into Items for validation and scoring, and kept as sent
+// for retrieval.
+type Department struct {
+	Name	string	`json:"name" xml:"name" binding:"required"`
+	Items	[]Item	`json:"items" xml:"items>item" binding:"required,min=1"`
+}
+
+// Tags label receipts for filtering and don't affect scoring
+const (
+	maxTags      = 10
+	maxTagLength = 32
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
 type Item struct {
-	ShortDescription	string 	`json:"shortDescription" binding:"required"`
-	Price 						string `json:"price" binding:"required"`
+	ShortDescription	string 	`json:"shortDescription" xml:"shortDescription" binding:"required"`
+	Price 						Amount `json:"price" xml:"price" binding:"required"`
+}
+
+// A money amount such as "6.49". When NUMERIC_AMOUNTS is enabled clients may send
+// a JSON number instead, which is normalized to the same two-decimal string.
+type Amount string
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*a = Amount(s)
+		return nil
+	}
+
+	if !config.NumericAmounts {
+		return errors.New("amounts must be strings")
+	}
+
+	// Keeping the number as written rather than going through float64, then making
+	// sure it is still a plain amount with at most two decimal places
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return err
+	}
+	cents, err := parseCents(number.String())
+	if err != nil {
+		return fmt.Errorf("amount %s must have at most two decimal places", number)
+	}
+	*a = Amount(formatCents(cents))
+	return nil
+}
+
+var receipts Store
+
+// Lightweight usage counters, updated without taking the store lock
+var (
+	receiptsProcessed int64
+	pointsLookups     int64
+)
+
+func main() {
+	config = loadConfig()
+	handler, err := newServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &http.Server{Addr: ":8080", Handler: handler}
+	log.Fatal(server.ListenAndServe())
+}
+
+// Sets up the store, rules and routes for the loaded config
+func newServer() (http.Handler, error) {
+	receiptSchema = newReceiptSchema()
+
+	var err error
+	if ruleConfig, err = loadRuleConfig(config.RuleConfigPath); err != nil {
+		return nil, err
+	}
+
+	if err := startAuditLog(config.AuditLog); err != nil {
+		return nil, err
+	}
+
+	receipts = newReceiptStore(config.MaxReceipts, config.EvictWhenFull)
+	if config.CacheSize > 0 {
+		receipts = newCachedStore(receipts, config.CacheSize)
+	}
+
+	route := gin.Default()
+	if err := route.SetTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	route.Use(responseTime(), checkHeaders(), requestID(), deprecationHeaders(), requestTimeout())
+	if config.ReceiptCountHeader {
+		route.Use(receiptCount())
+	}
+
+	api := route.Group(config.BasePath, apiVersion())
+	api.POST("/receipts/process", limitBody(), receiptBody(), processReceipt)
+	api.PUT("/receipts/:id", limitBody(), receiptBody(), putReceipt)
+	api.GET("/receipts/:id", getReceipt)
+	api.GET("/receipts/:id/points", getReceiptPoints)
+
+	// The server drops the body of HEAD responses, leaving the status and headers
+	api.HEAD("/receipts/:id", getReceipt)
+	api.HEAD("/receipts/:id/points", getReceiptPoints)
+	if config.PointsHistory > 0 {
+		api.GET("/receipts/:id/points/history", getPointsHistory)
+	}
+	if featureEnabled("batch") {
+		api.POST("/receipts/points/batch", limitBody(), getBatchPoints)
+		api.POST("/receipts/validate/batch", limitBody(), validateBatch)
+	}
+	if featureEnabled("preview") {
+		api.POST("/receipts/points", limitBody(), receiptBody(), previewPoints)
+	}
+	if featureEnabled("search") {
+		api.GET("/receipts", listReceipts)
+		api.GET("/receipts/search", searchReceipts)
+	}
+	if featureEnabled("top") {
+		api.GET("/receipts/top", topReceipts)
+	}
+	if featureEnabled("async") {
+		startJobWorkers(config.AsyncWorkers, config.AsyncQueue)
+		api.POST("/receipts/process/async", limitBody(), enqueueReceipts)
+		api.GET("/jobs/:id", getJob)
+	}
+	if featureEnabled("export") {
+		api.GET("/receipts/export.csv", exportReceipts)
+	}
+	if featureEnabled("compare") {
+		api.GET("/receipts/compare", compareReceipts)
+	}
+	if featureEnabled("schema") {
+		api.GET("/schema/receipt.json", getReceiptSchema)
+	}
+
+	// Operational endpoints stay at the root unless configured to follow the base path
+	ops := route.Group("")
+	if config.OpsUnderBase {
+		ops = api
+	}
+	if featureEnabled("stats") {
+		ops.GET("/stats", getStats)
+	}
+	ops.GET("/readyz", getReadiness)
+
+	if config.AdminToken != "" && featureEnabled("admin") {
+		admin := ops.Group("/admin", adminOnly())
+		admin.POST("/reload", reloadRules)
+	}
+
+	if config.H2C {
+		// HTTP/2 without TLS for internal meshes, while still serving HTTP/1.1 clients
+		return h2c.NewHandler(route, &http2.Server{}), nil
+	}
+	return route, nil
+}
+
+// A stored receipt as returned by GET /receipts/:id
+type receiptResponse struct {
+	XMLName xml.Name `json:"-" xml:"receipt"`
+	ID      string   `json:"id" xml:"id"`
+	Receipt
+
+	// Tags and departments for XML, nil when there are none so they are left out as
+	// they are in JSON. omitempty has no effect on a "tags>tag" path.
+	XMLTags        *xmlTags        `json:"-" xml:"tags,omitempty"`
+	XMLDepartments *xmlDepartments `json:"-" xml:"departments,omitempty"`
+
+	OriginalRetailer string    `json:"originalRetailer,omitempty" xml:"originalRetailer,omitempty"`
+	ItemsSum         *itemsSum `json:"itemsSum,omitempty" xml:"itemsSum,omitempty"`
+}
+
+type xmlTags struct {
+	Tags []string `xml:"tag"`
+}
+
+type xmlDepartments struct {
+	Departments []Department `xml:"department"`
+}
+
+// The server's sum of the item prices, for reconciling against the total
+type itemsSum struct {
+	Cents     int64  `json:"cents" xml:"cents"`
+	Formatted string `json:"formatted" xml:"formatted"`
+}
+
+func getReceipt(c *gin.Context) {
+	receiptId := c.Param("id")
+
+	stored, err := receipts.Get(c.Request.Context(), receiptId)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+
+	// The body as it was sent, byte for byte
+	if c.Query("raw") == "true" {
+		if stored.Raw == nil {
+			respondError(c, http.StatusNotFound, "The original body of this receipt was not kept.")
+			return
+		}
+		c.Data(http.StatusOK, "application/json", stored.Raw)
+		return
+	}
+
+	response := receiptResponse{ID: receiptId, Receipt: stored.Receipt, OriginalRetailer: stored.OriginalRetailer}
+	if c.Query("sum") == "true" {
+		// Stored receipts passed validation, so their prices parse
+		sum, _ := sumItemPrices(stored.Receipt.Items)
+		cents := int64(math.Round(sum * 100))
+		response.ItemsSum = &itemsSum{Cents: cents, Formatted: formatCents(cents)}
+	}
+
+	// XML for legacy integrations that ask for it, JSON otherwise
+	switch c.NegotiateFormat(binding.MIMEJSON, binding.MIMEXML, binding.MIMEXML2) {
+	case binding.MIMEJSON:
+		c.JSON(http.StatusOK, response)
+	case binding.MIMEXML, binding.MIMEXML2:
+		if len(response.Tags) > 0 {
+			response.XMLTags = &xmlTags{Tags: response.Tags}
+		}
+		if len(response.Departments) > 0 {
+			response.XMLDepartments = &xmlDepartments{Departments: response.Departments}
+		}
+		c.XML(http.StatusOK, response)
+	default:
+		respondError(c, http.StatusNotAcceptable, "Receipts are available as application/json or application/xml.")
+	}
+}
+
+func getReceiptPoints(c *gin.Context) {
+	receiptId := c.Param("id")
+
+	// Refused before anything is recorded or counted
+	debug, asJWT := c.Query("debug") == "true", c.Query("format") == "jwt"
+	if debug && !isAdmin(c) {
+		respondError(c, http.StatusUnauthorized, "Debug traces require a valid admin token.")
+		return
+	}
+	if asJWT && config.JWTSecret == "" {
+		respondError(c, http.StatusBadRequest, "JWT output is not enabled.")
+		return
+	}
+
+	stored, err := receipts.Get(c.Request.Context(), receiptId)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+
+	// HEAD answers with the same status and headers but leaves no trace: nothing is
+	// recorded and it isn't counted as a lookup
+	head := c.Request.Method == http.MethodHead
+
+	// A single rule's contribution, for clients interested in one aspect of the receipt
+	if name := c.Query("rule"); name != "" {
+		score, found := scoreRule(name, scoring{id: receiptId, receipt: stored.Receipt, createdAt: stored.CreatedAt})
+		if !found {
+			respondError(c, http.StatusBadRequest, fmt.Sprintf("There is no rule named %q.", name))
+			return
+		}
+		if !head {
+			atomic.AddInt64(&pointsLookups, 1)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"rule": score.Rule, config.PointsKey: score.Points, "description": score.Description})
+		return
+	}
+
+	// Points as earned when the receipt was processed, unless asked to score it under the current rules
+	totalPoints, breakdown, version := stored.Points, stored.Breakdown, stored.ConfigVersion
+	if c.Query("recompute") == "true" {
+		totalPoints, breakdown, version = scoreReceiptVersion(scoring{id: receiptId, receipt: stored.Receipt, createdAt: stored.CreatedAt})
+
+		if config.PointsHistory > 0 && !head {
+			record := pointsRecord{At: clock.Now(), ConfigVersion: version, Points: totalPoints}
+			if err := receipts.RecordPoints(c.Request.Context(), receiptId, record, config.PointsHistory); err != nil {
+				storeError(c, err)
+				return
+			}
+		}
+	}
+	if !head {
+		atomic.AddInt64(&pointsLookups, 1)
+	}
+	c.Header("X-Rule-Config-Version", version)
+
+	rc := currentRuleConfig()
+	response := gin.H{config.PointsKey: totalPoints}
+	if rc.PointsHalfLifeDays > 0 {
+		response["effectivePoints"] = rc.decayedPoints(totalPoints, stored.CreatedAt, clock.Now())
+	}
+	if tier, ok := rc.tierFor(totalPoints); ok {
+		response["tier"] = tier
+	}
+	if c.Query("breakdown") == "true" {
+		response["breakdown"] = breakdown
+	}
+
+	// Rewards rate for display, null for a zero total as there is no rate to give
+	if c.Query("rate") == "true" {
+		response["rate"] = nil
+		if total, _ := parseAmount(string(stored.Receipt.Total)); total != 0 {
+			perDollar := float64(totalPoints) / total
+			response["rate"] = gin.H{
+				"pointsPerDollar": math.Round(perDollar*10000) / 10000,
+				"percent":         fmt.Sprintf("%.2f%%", perDollar*100),
+			}
+		}
+	}
+
+	// Verbose trace under the active rules, for admins tuning the rule config
+	if debug {
+		tracedPoints, trace := traceReceipt(scoring{id: receiptId, receipt: stored.Receipt, createdAt: stored.CreatedAt})
+		response["debug"] = gin.H{"storedPoints": stored.Points, "recomputedPoints": tracedPoints, "trace": trace}
+	}
+
+	// Tamper-evident copy of the points for passing between services
+	if asJWT {
+		token, err := signJWT(pointsClaims{Subject: receiptId, Points: totalPoints, IssuedAt: clock.Now().Unix()}, []byte(config.JWTSecret))
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, "Failed to sign the points token.")
+			return
+		}
+		response["token"] = token
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// How the receipt's points changed as the rules evolved, oldest first. Entries are
+// added when the receipt is processed and whenever a recompute gives a new result.
+func getPointsHistory(c *gin.Context) {
+	receiptId := c.Param("id")
+
+	stored, err := receipts.Get(c.Request.Context(), receiptId)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+
+	history := stored.History
+	if history == nil {
+		history = []pointsRecord{}
+	}
+	c.JSON(http.StatusOK, gin.H{"id": receiptId, "history": history})
+}
+
+// One rule's contribution to each of two compared receipts
+type ruleDifference struct {
+	Rule       string `json:"rule"`
+	A          int    `json:"a"`
+	B          int    `json:"b"`
+	Difference int    `json:"difference"`
+}
+
+func compareReceipts(c *gin.Context) {
+	ids := map[string]string{"a": c.Query("a"), "b": c.Query("b")}
+	scored := make(map[string]storedReceipt, 2)
+	for _, param := range []string{"a", "b"} {
+		if ids[param] == "" {
+			respondError(c, http.StatusBadRequest, "Both receipt IDs a and b are required.")
+			return
+		}
+
+		stored, err := receipts.Get(c.Request.Context(), ids[param])
+		if errors.Is(err, errReceiptNotFound) {
+			respondError(c, http.StatusNotFound, fmt.Sprintf("No receipt found for %s (%s).", param, ids[param]))
+			return
+		} else if err != nil {
+			storeError(c, err)
+			return
+		}
+
+		if c.Query("recompute") == "true" {
+			stored.Points, stored.Breakdown = scoreReceipt(scoring{id: ids[param], receipt: stored.Receipt, createdAt: stored.CreatedAt})
+		}
+		scored[param] = stored
+	}
+	atomic.AddInt64(&pointsLookups, 2)
+
+	a, b := scored["a"], scored["b"]
+	response := gin.H{
+		"a":          gin.H{"id": ids["a"], config.PointsKey: a.Points},
+		"b":          gin.H{"id": ids["b"], config.PointsKey: b.Points},
+		"difference": a.Points - b.Points,
+	}
+	if c.Query("breakdown") == "true" {
+		response["breakdown"] = compareBreakdowns(a.Breakdown, b.Breakdown)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Lines up two breakdowns by rule, in the order rules first appear. A rule missing
+// from one side contributed nothing there.
+func compareBreakdowns(a, b []ruleScore) []ruleDifference {
+	differences := []ruleDifference{}
+	index := make(map[string]int)
+	for side, breakdown := range [][]ruleScore{a, b} {
+		for _, score := range breakdown {
+			i, seen := index[score.Rule]
+			if !seen {
+				i = len(differences)
+				index[score.Rule] = i
+				differences = append(differences, ruleDifference{Rule: score.Rule})
+			}
+			if side == 0 {
+				differences[i].A += score.Points
+			} else {
+				differences[i].B += score.Points
+			}
+		}
+	}
+	for i := range differences {
+		differences[i].Difference = differences[i].A - differences[i].B
+	}
+	return differences
+}
+
+func getBatchPoints(c *gin.Context) {
+	var ids []string
+	if err := c.ShouldBindJSON(&ids); err != nil {
+		respondError(c, http.StatusBadRequest, "The request must be a JSON array of receipt IDs.")
+		return
+	}
+
+	if len(ids) > config.MaxBatchIDs {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("At most %d receipt IDs can be looked up at once.", config.MaxBatchIDs))
+		return
+	}
+
+	if c.Query("stream") == "true" {
+		streamBatchPoints(c, ids)
+		return
+	}
+
+	found, err := receipts.GetMany(c.Request.Context(), ids)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+
+	points := make(map[string]int, len(found))
+	notFound := []string{}
+	for _, id := range ids {
+		if stored, exists := found[id]; exists {
+			points[id] = stored.Points
+		} else if !slices.Contains(notFound, id) {
+			notFound = append(notFound, id)
+		}
+	}
+	atomic.AddInt64(&pointsLookups, int64(len(points)))
+
+	c.JSON(http.StatusOK, gin.H{config.PointsKey: points, "notFound": notFound})
+}
+
+// Lines written between flushes when streaming batch results
+const streamFlushEvery = 50
+
+// Writes one NDJSON line per distinct ID as each is looked up, so clients see
+// progress on large batches instead of waiting for the whole response
+func streamBatchPoints(c *gin.Context, ids []string) {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	seen := make(map[string]struct{}, len(ids))
+	written := 0
+	for _, id := range ids {
+		if _, done := seen[id]; done {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		stored, err := receipts.Get(c.Request.Context(), id)
+		switch {
+		case err == nil:
+			atomic.AddInt64(&pointsLookups, 1)
+			encoder.Encode(gin.H{"id": id, config.PointsKey: stored.Points})
+		case errors.Is(err, errReceiptNotFound):
+			encoder.Encode(gin.H{"id": id, "notFound": true})
+		default:
+			// The status has already been sent, so the failure can only be reported in-band
+			encoder.Encode(gin.H{"id": id, "error": err.Error()})
+			c.Writer.Flush()
+			return
+		}
+
+		written++
+		if written%streamFlushEvery == 0 {
+			c.Writer.Flush()
+		}
+	}
+	c.Writer.Flush()
+}
+
+// Writes every stored receipt as a CSV row. The rows come from a snapshot taken up
+// front, so the file is consistent and receipts keep being processed while it
+// streams, at the cost of holding a copy of every stored receipt in memory until the
+// export finishes.
+func exportReceipts(c *gin.Context) {
+	entries, err := receipts.Snapshot(c.Request.Context())
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="receipts.csv"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "retailer", "purchaseDate", "purchaseTime", "total", config.PointsKey})
+	for i, entry := range entries {
+		// Too late to change the status, so a cancelled export just ends early
+		if c.Request.Context().Err() != nil {
+			break
+		}
+
+		r := entry.Receipt.Receipt
+		w.Write([]string{csvCell(entry.ID), csvCell(r.Retailer), csvCell(r.PurchaseDate), csvCell(r.PurchaseTime), csvCell(string(r.Total)), strconv.Itoa(entry.Receipt.Points)})
+		if (i+1)%streamFlushEvery == 0 {
+			w.Flush()
+			c.Writer.Flush()
+		}
+	}
+	w.Flush()
+	c.Writer.Flush()
+}
+
+// Quotes a value sent by a client that a spreadsheet would otherwise run as a formula
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// A receipt being scored, along with where it sits in the stored history and the
+// rule config it is scored under
+type scoring struct {
+	id        string
+	receipt   Receipt
+	createdAt time.Time
+	rc        RuleConfig
+}
+
+// A scoring rule, with an explanation of its contribution for display. Optional
+// rules report whether they are enabled, and are left out of the breakdown when not.
+type rule struct {
+	name     string
+	enabled  func(rc RuleConfig) bool
+	points   func(s scoring) int
+	describe func(s scoring, points int) string
+
+	// For debug traces: the rule config values and receipt values the rule looks at
+	settings func(rc RuleConfig) gin.H
+	inputs   func(s scoring) gin.H
+}
+
+// Runs the rule, recovering if it panics so one faulty rule, such as a custom rule
+// tripping over an unusual receipt, doesn't fail the whole request. A failed rule
+// contributes no points.
+func (r rule) score(s scoring) (points int, description string) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("rule %q panicked scoring receipt %s: %v", r.name, s.id, p)
+			points, description = 0, "No points because the rule failed on this receipt"
+		}
+	}()
+
+	points = r.points(s)
+	return points, r.describe(s, points)
+}
+
+// One rule's contribution to a receipt's total
+type ruleScore struct {
+	Rule        string `json:"rule"`
+	Points      int    `json:"points"`
+	Description string `json:"description"`
+}
+
+// Evaluated in order by calculatePoints
+var rules = []rule{
+	{
+		name:   "retailer",
+		points: func(s scoring) int { return s.rc.calculatePointsForRetailerName(s.receipt.Retailer) },
+		describe: func(s scoring, points int) string {
+			if mode := s.rc.RetailerScoring.Mode; mode == "capped" || mode == "log" {
+				if length := s.rc.RetailerScoring.Length; points >= length {
+					return fmt.Sprintf("%s because the retailer name %q has at least %s, scaled down (%s) beyond %d", plural(points, "point"), s.receipt.Retailer, plural(length, "alphanumeric character"), mode, length)
+				}
+			}
+			return fmt.Sprintf("%s because the retailer name %q has %s", plural(points, "point"), s.receipt.Retailer, plural(points, "alphanumeric character"))
+		},
+		settings: func(rc RuleConfig) gin.H {
+			return gin.H{"unicodeRetailerNames": rc.UnicodeRetailerNames, "retailerScoring": rc.RetailerScoring}
+		},
+		inputs: func(s scoring) gin.H { return gin.H{"retailer": s.receipt.Retailer} },
+	},
+	{
+		name:     "total",
+		points:   func(s scoring) int { return s.rc.calcuatePointsForTotal(string(s.receipt.Total)) },
+		describe: describeTotalPoints,
+		settings: func(rc RuleConfig) gin.H {
+			return gin.H{
+				"roundDollarToleranceCents": rc.RoundDollarToleranceCents,
+				"totalBonus":                rc.TotalBonus,
+				"totalDigitSumMultiplier":   rc.TotalDigitSumMultiplier,
+			}
+		},
+		inputs: func(s scoring) gin.H { return gin.H{"total": s.receipt.Total} },
+	},
+	{
+		name:     "items",
+		points:   func(s scoring) int { return s.rc.calculatePointsForItems(s.receipt.Items) },
+		describe: describeItemPoints,
+		settings: func(rc RuleConfig) gin.H {
+			return gin.H{
+				"roundUpItemPairs":       rc.RoundUpItemPairs,
+				"itemDescriptionDivisor": rc.ItemDescriptionDivisor,
+				"itemPriceMultiplier":    rc.ItemPriceMultiplier,
+				"itemPriceRounding":      rc.ItemPriceRounding,
+				"catalog":                rc.Catalog,
+				"bigBasket":              rc.BigBasket,
+				"distinctItemPoints":     rc.DistinctItemPoints,
+				"priceSpread":            rc.PriceSpread,
+				"priceEnding":            rc.PriceEnding,
+			}
+		},
+		inputs: func(s scoring) gin.H { return gin.H{"items": s.receipt.Items} },
+	},
+	{
+		name:   "purchaseDate",
+		points: func(s scoring) int { return s.rc.calculatePointsForPurchaseDate(s.receipt.PurchaseDate) },
+		describe: func(s scoring, points int) string {
+			date, _ := time.Parse("2006-01-02", s.receipt.PurchaseDate)
+			holiday := s.rc.Holidays.Points > 0 && s.rc.Holidays.includes(s.receipt.PurchaseDate)
+			switch {
+			case holiday && date.Day()%2 == 1:
+				return fmt.Sprintf("%s because the purchase day %d is odd and %s is a holiday", plural(points, "point"), date.Day(), s.receipt.PurchaseDate)
+			case holiday:
+				return fmt.Sprintf("%s because %s is a holiday", plural(points, "point"), s.receipt.PurchaseDate)
+			case points > 0:
+				return fmt.Sprintf("%s because the purchase day %d is odd", plural(points, "point"), date.Day())
+			}
+			return fmt.Sprintf("No points because the purchase day %d is even", date.Day())
+		},
+		settings: func(rc RuleConfig) gin.H { return gin.H{"holidays": rc.Holidays} },
+		inputs:   func(s scoring) gin.H { return gin.H{"purchaseDate": s.receipt.PurchaseDate} },
+	},
+	{
+		name:   "purchaseTime",
+		points: func(s scoring) int { return s.rc.calculatePointsForPurchaseTime(s.receipt.PurchaseTime) },
+		describe: func(s scoring, points int) string {
+			window := s.rc.TimeWindow
+			inWindow := window.Points > 0 && inTimeWindow(s.receipt.PurchaseTime, window.Start, window.End)
+			switch {
+			case inWindow && points > window.Points:
+				return fmt.Sprintf("%s because the purchase time %s is between 14:00 and 16:59 and between %s and %s", plural(points, "point"), s.receipt.PurchaseTime, window.Start, window.End)
+			case inWindow:
+				return fmt.Sprintf("%s because the purchase time %s is between %s and %s", plural(points, "point"), s.receipt.PurchaseTime, window.Start, window.End)
+			case points > 0:
+				return fmt.Sprintf("%s because the purchase time %s is between 14:00 and 16:59", plural(points, "point"), s.receipt.PurchaseTime)
+			}
+			return fmt.Sprintf("No points because the purchase time %s is not between 14:00 and 16:59", s.receipt.PurchaseTime)
+		},
+		settings: func(rc RuleConfig) gin.H { return gin.H{"timeWindow": rc.TimeWindow} },
+		inputs:   func(s scoring) gin.H { return gin.H{"purchaseTime": s.receipt.PurchaseTime} },
+	},
+	{
+		name:    "firstOfDay",
+		enabled: func(rc RuleConfig) bool { return rc.FirstOfDayPoints > 0 },
+		points:  calculatePointsForFirstOfDay,
+		describe: func(s scoring, points int) string {
+			if points > 0 {
+				return fmt.Sprintf("%s because this is the first receipt stored for %q on %s", plural(points, "point"), s.receipt.Retailer, s.receipt.PurchaseDate)
+			}
+			return fmt.Sprintf("No points because an earlier receipt for %q on %s is already stored", s.receipt.Retailer, s.receipt.PurchaseDate)
+		},
+		settings: func(rc RuleConfig) gin.H { return gin.H{"firstOfDayPoints": rc.FirstOfDayPoints} },
+		inputs: func(s scoring) gin.H {
+			return gin.H{"retailer": s.receipt.Retailer, "purchaseDate": s.receipt.PurchaseDate, "createdAt": s.createdAt}
+		},
+	},
+	{
+		name:    "streak",
+		enabled: func(rc RuleConfig) bool { return rc.StreakPoints > 0 },
+		points:  calculatePointsForStreak,
+		describe: func(s scoring, points int) string {
+			if points > 0 {
+				return fmt.Sprintf("%s because this extends a streak of daily receipts for %q", plural(points, "point"), s.receipt.Retailer)
+			}
+			return fmt.Sprintf("No points because this does not extend a streak of daily receipts for %q", s.receipt.Retailer)
+		},
+		settings: func(rc RuleConfig) gin.H { return gin.H{"streakPoints": rc.StreakPoints} },
+		inputs: func(s scoring) gin.H {
+			return gin.H{"retailer": s.receipt.Retailer, "purchaseDate": s.receipt.PurchaseDate, "createdAt": s.createdAt}
+		},
+	},
+	{
+		name:    "completeness",
+		enabled: func(rc RuleConfig) bool { return rc.Completeness.Points > 0 && len(rc.Completeness.Fields) > 0 },
+		points: func(s scoring) int {
+			return len(s.rc.populatedFields(s.receipt)) * s.rc.Completeness.Points
+		},
+		describe: func(s scoring, points int) string {
+			if populated := s.rc.populatedFields(s.receipt); len(populated) > 0 {
+				return fmt.Sprintf("%s for including %s", plural(points, "point"), strings.Join(populated, ", "))
+			}
+			return fmt.Sprintf("No points because none of %s are included", strings.Join(s.rc.Completeness.Fields, ", "))
+		},
+		settings: func(rc RuleConfig) gin.H { return gin.H{"completeness": rc.Completeness} },
+		inputs: func(s scoring) gin.H {
+			return gin.H{"tags": s.receipt.Tags, "departments": len(s.receipt.Departments)}
+		},
+	},
+	{
+		name:    "promptSubmission",
+		enabled: func(rc RuleConfig) bool { return rc.PromptSubmission.WithinHours > 0 && rc.PromptSubmission.Points > 0 },
+		points: func(s scoring) int {
+			window := time.Duration(s.rc.PromptSubmission.WithinHours) * time.Hour
+			if delay, ok := submissionDelay(s); ok && delay >= 0 && delay <= window {
+				return s.rc.PromptSubmission.Points
+			}
+			return 0
+		},
+		describe: func(s scoring, points int) string {
+			within := plural(s.rc.PromptSubmission.WithinHours, "hour")
+			delay, ok := submissionDelay(s)
+			switch {
+			case points > 0:
+				return fmt.Sprintf("%s because the receipt was processed within %s of the purchase", plural(points, "point"), within)
+			case ok && delay < 0:
+				return "No points because the purchase time is later than when the receipt was processed"
+			}
+			return fmt.Sprintf("No points because the receipt was not processed within %s of the purchase", within)
+		},
+		settings: func(rc RuleConfig) gin.H { return gin.H{"promptSubmission": rc.PromptSubmission} },
+		inputs: func(s scoring) gin.H {
+			return gin.H{"purchaseDate": s.receipt.PurchaseDate, "purchaseTime": s.receipt.PurchaseTime, "createdAt": s.createdAt}
+		},
+	},
+}
+
+// How long after the purchase the receipt was processed. Negative when the purchase
+// appears to be later, and false when the date or time doesn't parse.
+func submissionDelay(s scoring) (time.Duration, bool) {
+	purchased, err := time.ParseInLocation("2006-01-02 15:04", s.receipt.PurchaseDate+" "+s.receipt.PurchaseTime, s.createdAt.Location())
+	if err != nil {
+		return 0, false
+	}
+	return s.createdAt.Sub(purchased), true
+}
+
+// Optional receipt fields the completeness bonus can count, by JSON name
+var completenessFields = map[string]func(Receipt) bool{
+	"tags":        func(r Receipt) bool { return len(r.Tags) > 0 },
+	"departments": func(r Receipt) bool { return len(r.Departments) > 0 },
+}
+
+// The configured completeness fields the receipt fills in, in config order
+func (rc RuleConfig) populatedFields(receipt Receipt) []string {
+	var populated []string
+	for _, field := range rc.Completeness.Fields {
+		if completenessFields[field](receipt) {
+			populated = append(populated, field)
+		}
+	}
+	return populated
+}
+
+// Adds a custom rule, scored after the built-in ones, for building a binary with
+// bespoke rules without forking. The rule registry is not guarded, so rules must be
+// registered before serving starts, typically from an init function in a file added
+// to this package. Panics if the name is empty or already taken.
+func RegisterRule(name string, fn func(Receipt) int) {
+	if name == "" || fn == nil {
+		panic("RegisterRule: a rule needs a name and a calculator")
+	}
+	for _, r := range rules {
+		if r.name == name {
+			panic(fmt.Sprintf("RegisterRule: a rule named %q is already registered", name))
+		}
+	}
+
+	rules = append(rules, rule{
+		name:   name,
+		points: func(s scoring) int { return fn(s.receipt) },
+		describe: func(s scoring, points int) string {
+			return fmt.Sprintf("%s from the custom rule %q", plural(points, "point"), name)
+		},
+	})
+}
+
+// Calculating with custom calculator, allowing the rules to be updated more easily
+func calculatePoints(s scoring) int {
+	totalPoints, _ := scoreReceipt(s)
+	return totalPoints
+}
+
+// Runs every rule, then applies whole-receipt adjustments. Adjustments are recorded in
+// the breakdown too, so its entries always add up to the total.
+func scoreReceipt(s scoring) (int, []ruleScore) {
+	s.rc = currentRuleConfig()
+	return scoreUnderConfig(s)
+}
+
+// Like scoreReceipt, also returning the version of the rule config that scored it
+func scoreReceiptVersion(s scoring) (int, []ruleScore, string) {
+	s.rc = currentRuleConfig()
+	points, breakdown := scoreUnderConfig(s)
+	return points, breakdown, s.rc.version
+}
+
+// Scores under rc in place of the active config, for previews. The config only travels
+// with this receipt, so other scoring never sees it.
+func scoreWithConfig(rc RuleConfig, s scoring) (int, []ruleScore, string) {
+	s.rc = rc
+	if canonical, aliased := rc.RetailerAliases[aliasKey(s.receipt.Retailer)]; aliased {
+		s.receipt.Retailer = canonical
+	}
+	points, breakdown := scoreUnderConfig(s)
+	return points, breakdown, rc.version
+}
+
+// The registered rules followed by the expression rules
+func (rc RuleConfig) allRules() []rule {
+	if len(rc.ExpressionRules) == 0 {
+		return rules
+	}
+
+	all := slices.Clip(rules)
+	for _, er := range rc.ExpressionRules {
+		all = append(all, rule{
+			name:   er.Name,
+			points: func(s scoring) int { return er.compiled.points(s.receipt) },
+			describe: func(s scoring, points int) string {
+				return fmt.Sprintf("%s from the expression %s", plural(points, "point"), er.Expression)
+			},
+			settings: func(RuleConfig) gin.H { return gin.H{"expression": er.Expression} },
+			inputs:   func(s scoring) gin.H { return exprInputs(s.receipt) },
+		})
+	}
+	return all
+}
+
+// The rules in evaluation order: those named in the config's ruleOrder first, then the
+// rest in registry order
+func (rc RuleConfig) orderedRules() []rule {
+	rules := rc.allRules()
+	if len(rc.RuleOrder) == 0 {
+		return rules
+	}
+
+	ordered := make([]rule, 0, len(rules))
+	for _, name := range rc.RuleOrder {
+		if i := slices.IndexFunc(rules, func(r rule) bool { return r.name == name }); i >= 0 {
+			ordered = append(ordered, rules[i])
+		}
+	}
+	for _, r := range rules {
+		if !slices.Contains(rc.RuleOrder, r.name) {
+			ordered = append(ordered, r)
+		}
+	}
+	return ordered
+}
+
+// Runs just the named rule under the current rules, as it would appear in a breakdown
+// before any maximum, divisor or minimum is applied. A disabled rule earns nothing.
+func scoreRule(name string, s scoring) (ruleScore, bool) {
+	s.rc = currentRuleConfig()
+	rules := s.rc.orderedRules()
+	i := slices.IndexFunc(rules, func(r rule) bool { return r.name == name })
+	if i < 0 {
+		return ruleScore{}, false
+	}
+
+	r := rules[i]
+	if r.enabled != nil && !r.enabled(s.rc) {
+		return ruleScore{Rule: name, Description: "No points because the rule is disabled"}, true
+	}
+	points, description := r.score(s)
+	return ruleScore{Rule: name, Points: points, Description: description}, true
+}
+
+// Scores the receipt under s.rc
+func scoreUnderConfig(s scoring) (int, []ruleScore) {
+	totalPoints := 0
+	breakdown := make([]ruleScore, 0, len(rules))
+
+	maxPoints := s.rc.MaxPoints
+	for _, r := range s.rc.orderedRules() {
+		if r.enabled != nil && !r.enabled(s.rc) {
+			continue
+		}
+		points, description := r.score(s)
+
+		// Stopping at the cap, so rules ordered later don't count
+		if s.rc.ShortCircuit && maxPoints > 0 && totalPoints+points >= maxPoints {
+			if capped := maxPoints - totalPoints; capped < points {
+				description += fmt.Sprintf(", of which %d count before reaching the maximum of %s", capped, plural(maxPoints, "point"))
+				points = capped
+			}
+			totalPoints += points
+			breakdown = append(breakdown, ruleScore{Rule: r.name, Points: points, Description: description})
+			break
+		}
+
+		totalPoints += points
+		breakdown = append(breakdown, ruleScore{Rule: r.name, Points: points, Description: description})
+	}
+
+	if maxPoints > 0 && totalPoints > maxPoints {
+		breakdown = append(breakdown, ruleScore{
+			Rule:        "maxPoints",
+			Points:      maxPoints - totalPoints,
+			Description: fmt.Sprintf("%s to stay within the maximum of %s", plural(maxPoints-totalPoints, "point"), plural(maxPoints, "point")),
+		})
+		totalPoints = maxPoints
+	}
+
+	// Scaling to the consumer's unit and rounding the result: 95 points with a divisor of 10
+	// is 9 with no rounding, 10 when rounding up or to the nearest point
+	if divisor := s.rc.PointsDivisor; divisor > 1 {
+		scaled := roundPoints(float64(totalPoints)/float64(divisor), s.rc.PointsRounding)
+		breakdown = append(breakdown, ruleScore{
+			Rule:        "pointsDivisor",
+			Points:      scaled - totalPoints,
+			Description: fmt.Sprintf("%s from expressing %s in units of %d", plural(scaled-totalPoints, "point"), plural(totalPoints, "point"), divisor),
+		})
+		totalPoints = scaled
+	}
+
+	// Guaranteed baseline, in the same units as the final points
+	if floor := s.rc.MinPoints; totalPoints < floor {
+		breakdown = append(breakdown, ruleScore{
+			Rule:        "minPoints",
+			Points:      floor - totalPoints,
+			Description: fmt.Sprintf("%s to reach the minimum of %s", plural(floor-totalPoints, "point"), plural(floor, "point")),
+		})
+		totalPoints = floor
+	}
+
+	// Eligibility for any points at all, overriding everything above
+	if minItems := s.rc.MinItemsForPoints; len(s.receipt.Items) < minItems && totalPoints != 0 {
+		breakdown = append(breakdown, ruleScore{
+			Rule:        "minItemsForPoints",
+			Points:      -totalPoints,
+			Description: fmt.Sprintf("%s because receipts need at least %s to earn points", plural(-totalPoints, "point"), plural(minItems, "item")),
+		})
+		totalPoints = 0
+	}
+
+	return totalPoints, breakdown
+}
+
+// One step of a debug trace
+type ruleTrace struct {
+	Rule     string `json:"rule"`
+	Enabled  bool   `json:"enabled"`
+	Settings gin.H  `json:"settings,omitempty"`
+	Inputs   gin.H  `json:"inputs,omitempty"`
+	Points   int    `json:"points"`
+}
+
+// Scores the receipt under the active rules, recording what each rule looked at.
+// Disabled rules are listed too, and whole-receipt adjustments come last.
+func traceReceipt(s scoring) (int, []ruleTrace) {
+	s.rc = currentRuleConfig()
+
+	// Scored once, with each rule's points read back from the breakdown. Rules left
+	// out by a short circuit have none.
+	totalPoints, breakdown := scoreUnderConfig(s)
+	scored := make(map[string]int, len(breakdown))
+	for _, score := range breakdown {
+		scored[score.Rule] = score.Points
+	}
+
+	trace := make([]ruleTrace, 0, len(rules)+4)
+	for _, r := range s.rc.orderedRules() {
+		step := ruleTrace{Rule: r.name, Enabled: r.enabled == nil || r.enabled(s.rc), Points: scored[r.name]}
+		if r.settings != nil {
+			step.Settings = r.settings(s.rc)
+		}
+		if r.inputs != nil {
+			step.Inputs = r.inputs(s)
+		}
+		trace = append(trace, step)
+	}
+
+	for _, score := range breakdown {
+		switch score.Rule {
+		case "pointsDivisor":
+			trace = append(trace, ruleTrace{Rule: score.Rule, Enabled: true, Points: score.Points, Settings: gin.H{"pointsDivisor": s.rc.PointsDivisor, "pointsRounding": s.rc.PointsRounding}})
+		case "maxPoints":
+			trace = append(trace, ruleTrace{Rule: score.Rule, Enabled: true, Points: score.Points, Settings: gin.H{"maxPoints": s.rc.MaxPoints}})
+		case "minPoints":
+			trace = append(trace, ruleTrace{Rule: score.Rule, Enabled: true, Points: score.Points, Settings: gin.H{"minPoints": s.rc.MinPoints}})
+		case "minItemsForPoints":
+			trace = append(trace, ruleTrace{Rule: score.Rule, Enabled: true, Points: score.Points, Settings: gin.H{"minItemsForPoints": s.rc.MinItemsForPoints}})
+		}
+	}
+
+	return totalPoints, trace
+}
+
+func describeTotalPoints(s scoring, points int) string {
+	r, rc := s.receipt, s.rc
+
+	if points == 0 {
+		return fmt.Sprintf("No points because the total %s is neither a round dollar amount nor a multiple of 0.25", r.Total)
+	}
+
+	total, _ := parseAmount(string(r.Total))
+
+	var reasons []string
+	if rc.isRoundDollar(string(r.Total)) {
+		reasons = append(reasons, "is a round dollar amount")
+	}
+	if almostEqual(math.Mod(total, 0.25), 0) {
+		reasons = append(reasons, "is a multiple of 0.25")
+	}
+	if cents, err := parseCents(string(r.Total)); err == nil && rc.totalBonusApplies(cents/100) {
+		reasons = append(reasons, "has a whole-dollar part that is "+rc.TotalBonus.Mode)
+	}
+	if cents, err := parseCents(string(r.Total)); err == nil && rc.TotalDigitSumMultiplier > 0 && cents != 0 {
+		reasons = append(reasons, fmt.Sprintf("has digits summing to %d", digitSum(cents)))
+	}
+
+	return fmt.Sprintf("%s because the total %s %s", plural(points, "point"), r.Total, strings.Join(reasons, " and "))
+}
+
+func describeItemPoints(s scoring, points int) string {
+	r, rc := s.receipt, s.rc
+
+	pairs := rc.itemPairs(len(r.Items)) * 5
+	basket := rc.bigBasketPoints(len(r.Items))
+	spread := rc.priceSpreadPoints(r.Items)
+	ending := rc.priceEndingPoints(r.Items)
+
+	description := fmt.Sprintf("%s for %s: %d for every two items", plural(points, "point"), plural(len(r.Items), "item"), pairs)
+	if basket > 0 {
+		description += fmt.Sprintf(", %d for a basket of at least %d items", basket, rc.BigBasket.MinItems)
+	}
+	if spread > 0 {
+		description += fmt.Sprintf(", %d for a %s price spread", spread, rc.PriceSpread.Mode)
+	}
+	if ending > 0 {
+		description += fmt.Sprintf(", %d for prices ending in %s", ending, rc.PriceEnding.Ending)
+	}
+	if rest := points - pairs - basket - spread - ending; rest > 0 {
+		description += fmt.Sprintf(" and %d for item descriptions", rest)
+		if sampled := len(itemSample(r.Items)); sampled < len(r.Items) {
+			description += fmt.Sprintf(", estimated from %d of the items", sampled)
+		}
+	}
+	return description
+}
+
+func plural(n int, noun string) string {
+	if n == 1 || n == -1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func (rc RuleConfig) calculatePointsForRetailerName(s string) int {
+	points := 0
+
+	// Rule 1
+	for _, c := range s {
+		if rc.UnicodeRetailerNames {
+			if unicode.IsLetter(c) || unicode.IsDigit(c) {
+				points += 1
+			}
+		} else if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			points += 1
+		}
+	}
+
+	// Optionally diminishing returns for long names
+	length := rc.RetailerScoring.Length
+	if points > length {
+		switch rc.RetailerScoring.Mode {
+		case "capped":
+			points = length
+		case "log":
+			// One more point each time the excess doubles
+			points = length + int(math.Log2(float64(points-length+1)))
+		}
+	}
+
+	return points
+}
+
+func (rc RuleConfig) calcuatePointsForTotal(t string) int {
+	points := 0
+
+	total, _ := parseAmount(t)
+
+	// Rule 2
+	if rc.isRoundDollar(t) {
+		points += 50
+	}
+
+	// Rule 3
+	if almostEqual(math.Mod(total, 0.25), 0) {
+		points += 25
+	}
+
+	// Optional bonus on the whole-dollar part of the total
+	if cents, err := parseCents(t); err == nil && rc.totalBonusApplies(cents / 100) {
+		points += rc.TotalBonus.Points
+	}
+
+	// Optional points for the digit sum of the total in cents
+	if cents, err := parseCents(t); err == nil {
+		points += digitSum(cents) * rc.TotalDigitSumMultiplier
+	}
+
+	return points
+}
+
+// Optionally counting totals within a few cents of a whole dollar as round
+func (rc RuleConfig) isRoundDollar(t string) bool {
+	tolerance := rc.RoundDollarToleranceCents
+	if tolerance == 0 {
+		total, _ := parseAmount(t)
+		return almostEqual(total, float64(int(total)))
+	}
+
+	cents, err := parseCents(t)
+	if err != nil {
+		return false
+	}
+	remainder := cents % 100
+	return remainder <= tolerance || 100-remainder <= tolerance
+}
+
+func (rc RuleConfig) totalBonusApplies(dollars int64) bool {
+	switch rc.TotalBonus.Mode {
+	case "prime":
+		return isPrime(dollars)
+	case "even":
+		return dollars%2 == 0
+	}
+	return false
+}
+
+func (rc RuleConfig) calculatePointsForItems(items []Item) int {
+	points := 0
+
+	// Rule 4
+	points += rc.itemPairs(len(items)) * 5
+
+	// Rule 5, estimated from a sample of the items when there are more than the budget
+	sample := itemSample(items)
+	descriptionPoints := 0
+	for _, item := range sample {
+		description := strings.TrimSpace(item.ShortDescription)
+		if len(description) % rc.ItemDescriptionDivisor == 0 {
+			price, _ := parseCents(string(item.Price))
+			descriptionPoints += rc.itemPricePoints(price, rc.Catalog.percent(description))
+		}
+	}
+	if len(sample) < len(items) {
+		descriptionPoints = descriptionPoints * len(items) / len(sample)
+	}
+	points += descriptionPoints
+
+	// Optional bonus for larger baskets
+	points += rc.bigBasketPoints(len(items))
+
+	// Optional bonus for the spread of item prices
+	points += rc.priceSpreadPoints(items)
+
+	// Optional bonus for each price ending in the configured digits
+	points += rc.priceEndingPoints(items)
+
+	// Optional bonus for every distinct item description
+	if rc.DistinctItemPoints > 0 {
+		distinct := make(map[string]struct{})
+		for _, item := range items {
+			distinct[strings.TrimSpace(item.ShortDescription)] = struct{}{}
+		}
+		points += len(distinct) * rc.DistinctItemPoints
+	}
+
+	return points
+}
+
+// Evenly spaced items, at most ITEM_BUDGET of them, for approximating per-item rules
+// on very large receipts
+func itemSample(items []Item) []Item {
+	budget := config.ItemBudget
+	if budget == 0 || len(items) <= budget {
+		return items
+	}
+
+	sample := make([]Item, budget)
+	for i := range sample {
+		sample[i] = items[i*len(items)/budget]
+	}
+	return sample
+}
+
+// Rule 5's share of an item's price, worked out exactly on cents and scaled by the
+// item's category multiplier in percent. The price multiplier has at most four decimal
+// places, so as basis points it is a whole number. The product can outgrow int64 for
+// large prices, so it is worked out as a big.Int.
+func (rc RuleConfig) itemPricePoints(cents, categoryPercent int64) int {
+	basisPoints := int64(math.Round(rc.ItemPriceMultiplier * 10000))
+	n := new(big.Int).Mul(big.NewInt(cents), big.NewInt(basisPoints))
+	n.Mul(n, big.NewInt(categoryPercent))
+	return int(divideRounded(n, 100*10000*100, rc.ItemPriceRounding))
+}
+
+// Integer division by a positive d with the fraction rounded like roundPoints would.
+// Quotients beyond int64 are clamped to its range.
+func divideRounded(n *big.Int, d int64, mode string) int64 {
+	// Floor division, leaving a remainder in [0, d)
+	q, r := new(big.Int).DivMod(n, big.NewInt(d), new(big.Int))
+
+	switch mode {
+	case "up":
+		if r.Sign() > 0 {
+			q.Add(q, big.NewInt(1))
+		}
+	case "nearest":
+		if 2*r.Int64() >= d {
+			q.Add(q, big.NewInt(1))
+		}
+	case "none":
+		// Towards zero
+		if n.Sign() < 0 && r.Sign() > 0 {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+
+	switch {
+	case q.IsInt64():
+		return q.Int64()
+	case q.Sign() > 0:
+		return math.MaxInt64
+	default:
+		return math.MinInt64
+	}
+}
+
+// Consults the store, so unlike the other rules this depends on what was processed
+// before. Receipts processed concurrently may both count as the first.
+func calculatePointsForFirstOfDay(s scoring) int {
+	if receipts.HasEarlier(s.receipt.Retailer, s.receipt.PurchaseDate, s.createdAt, s.id) {
+		return 0
+	}
+	return s.rc.FirstOfDayPoints
+}
+
+// Awarded once per purchase date, to the first receipt stored for it, when a receipt
+// for the day before was stored earlier. Like firstOfDay, this consults the store.
+func calculatePointsForStreak(s scoring) int {
+	date, err := time.Parse("2006-01-02", s.receipt.PurchaseDate)
+	if err != nil {
+		return 0
+	}
+	previous := date.AddDate(0, 0, -1).Format("2006-01-02")
+
+	if !receipts.HasEarlier(s.receipt.Retailer, previous, s.createdAt, s.id) ||
+		receipts.HasEarlier(s.receipt.Retailer, s.receipt.PurchaseDate, s.createdAt, s.id) {
+		return 0
+	}
+	return s.rc.StreakPoints
+}
+
+// Pairs among count items, counting a lone last item as a pair when configured
+func (rc RuleConfig) itemPairs(count int) int {
+	if rc.RoundUpItemPairs {
+		return (count + 1) / 2
+	}
+	return count / 2
+}
+
+func (rc RuleConfig) bigBasketPoints(count int) int {
+	if rc.BigBasket.MinItems > 0 && count >= rc.BigBasket.MinItems {
+		return rc.BigBasket.Points
+	}
+	return 0
+}
+
+func (rc RuleConfig) priceSpreadPoints(items []Item) int {
+	if rc.PriceSpread.Mode == "" || len(items) < 2 {
+		return 0
+	}
+
+	spread := priceSpread(items)
+	if rc.PriceSpread.Mode == "wide" && spread > rc.PriceSpread.ThresholdCents ||
+		rc.PriceSpread.Mode == "narrow" && spread <= rc.PriceSpread.ThresholdCents {
+		return rc.PriceSpread.Points
+	}
+	return 0
+}
+
+func (rc RuleConfig) priceEndingPoints(items []Item) int {
+	if rc.PriceEnding.Ending == "" {
+		return 0
+	}
+
+	points := 0
+	for _, item := range items {
+		if price, err := parseCents(string(item.Price)); err == nil && rc.PriceEnding.matches(price) {
+			points += rc.PriceEnding.Points
+		}
+	}
+	return points
+}
+
+// Difference in cents between the most and least expensive item
+func priceSpread(items []Item) int64 {
+	var lowest, highest int64
+	for i, item := range items {
+		price, _ := parseCents(string(item.Price))
+		if i == 0 || price < lowest {
+			lowest = price
+		}
+		if i == 0 || price > highest {
+			highest = price
+		}
+	}
+	return highest - lowest
+}
+
+func (rc RuleConfig) calculatePointsForPurchaseDate(d string) int {
+	points := 0
+
+	date, _ := time.Parse("2006-01-02", d)
+
+	// Rule 7
+	if date.Day() % 2 == 1 {
+		points += 6
+	}
+
+	// Optional bonus for seasonal promotions
+	if rc.Holidays.includes(d) {
+		points += rc.Holidays.Points
+	}
+
+	return points
+}
+
+func (rc RuleConfig) calculatePointsForPurchaseTime(t string) int {
+	points := 0
+
+	time, _ := time.Parse("15:04", t)
+
+	// Rule 8
+	if time.Hour() >= 14 && time.Hour() <= 16 {
+		points += 10
+	}
+
+	// Optional bonus for a configured window, which may wrap past midnight
+	if window := rc.TimeWindow; window.Points > 0 && inTimeWindow(t, window.Start, window.End) {
+		points += window.Points
+	}
+
+	return points
+}
+
+// Reports whether t falls in [start, end), all as "15:04". A window ending before it
+// starts wraps around midnight, so 22:00-02:00 covers 23:30 and 01:00.
+func inTimeWindow(t, start, end string) bool {
+	minutes := func(s string) int {
+		parsed, _ := time.Parse("15:04", s)
+		return parsed.Hour()*60 + parsed.Minute()
+	}
+
+	at, from, to := minutes(t), minutes(start), minutes(end)
+	if from <= to {
+		return at >= from && at < to
+	}
+	return at >= from || at < to
+}
+
+// Why a receipt was rejected, and the status to answer with
+type receiptProblem struct {
+	status      int
+	description string
+	errors      []string
+}
+
+// Parses and validates a receipt body, without scoring or storing it
+func checkReceipt(body []byte) (Receipt, *receiptProblem) {
+	var receipt Receipt
+
+	body, err := flattenDepartments(body)
+	if err != nil {
+		return receipt, &receiptProblem{http.StatusBadRequest, "The receipt is invalid.", []string{err.Error()}}
+	}
+	if config.DeriveTotal {
+		body = deriveTotal(body)
+	}
+
+	if problems := receiptSchema.validate(body); len(problems) > 0 {
+		return receipt, &receiptProblem{http.StatusBadRequest, "The receipt is invalid.", problems}
+	}
+
+	if err := binding.JSON.BindBody(body, &receipt); err != nil {
+		return receipt, &receiptProblem{http.StatusBadRequest, "The receipt is invalid.", nil}
+	}
+
+	// Malformed values are a bad request, while a well-formed receipt breaking a
+	// business rule is unprocessable
+	if err := validateReceipt(receipt); err != nil {
+		status := http.StatusBadRequest
+		if errors.As(err, new(semanticError)) {
+			status = http.StatusUnprocessableEntity
+		}
+		return receipt, &receiptProblem{status, "The receipt is invalid.", []string{err.Error()}}
+	}
+
+	if config.ItemBudget > 0 && !config.ApproxItems && len(receipt.Items) > config.ItemBudget {
+		return receipt, &receiptProblem{http.StatusRequestEntityTooLarge, fmt.Sprintf("Receipts with more than %d items can't be scored.", config.ItemBudget), nil}
+	}
+
+	return receipt, nil
 }
 
-var (
-	receipts = make(map[string]Receipt)
-	mapMutex	sync.Mutex
-)
+// Fills in items from departments when a receipt groups its items, so the flattened
+// list goes through the same schema and item rules as a flat receipt. Bodies that
+// aren't a JSON object are returned unchanged for the schema to report.
+func flattenDepartments(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil || fields["departments"] == nil {
+		return body, nil
+	}
+	if fields["items"] != nil {
+		return nil, errors.New("a receipt may have items or departments, not both")
+	}
 
-func main() {
-	route := gin.Default()
+	var departments []struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if json.Unmarshal(fields["departments"], &departments) != nil {
+		return body, nil
+	}
+
+	items := []json.RawMessage{}
+	for _, department := range departments {
+		items = append(items, department.Items...)
+	}
+	fields["items"], _ = json.Marshal(items)
+	return json.Marshal(fields)
+}
+
+// Fills in a missing total with the sum of the item prices. A total that is sent is
+// left alone, so a wrong one is still rejected, as are bodies whose prices don't parse.
+func deriveTotal(body []byte) []byte {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return body
+	}
+	if _, sent := fields["total"]; sent {
+		return body
+	}
+
+	var items []struct {
+		Price Amount `json:"price"`
+	}
+	if json.Unmarshal(fields["items"], &items) != nil || len(items) == 0 {
+		return body
+	}
+
+	var sum int64
+	for _, item := range items {
+		cents, err := parseCents(string(item.Price))
+		if err != nil {
+			return body
+		}
+		sum += cents
+	}
+
+	fields["total"], _ = json.Marshal(formatCents(sum))
+	derived, _ := json.Marshal(fields)
+	return derived
+}
 
-	route.POST("/receipts/process", processReceipt)
-	route.GET("/receipts/:id/points", getReceiptPoints)
+// Validates and scores the receipt read by receiptBody, to be stored under id. When
+// the receipt is rejected the client has already been answered, and false is returned.
+func prepareReceipt(c *gin.Context, id string) (storedReceipt, bool) {
+	receipt, problem := checkReceipt(c.MustGet(receiptBodyKey).([]byte))
+	if problem != nil {
+		respondError(c, problem.status, problem.description, problem.errors...)
+		return storedReceipt{}, false
+	}
 
-	route.Run(":8080")
+	stored := newStoredReceipt(id, receipt)
+	if wait := cooldownRemaining(id, stored); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondError(c, http.StatusTooManyRequests, fmt.Sprintf("A receipt from %s was processed too recently; try again in %s.", stored.Receipt.Retailer, wait.Round(time.Second)))
+		return storedReceipt{}, false
+	}
+	stored.Raw = rawCopy(c.MustGet(receiptBodyKey).([]byte))
+	return stored, true
 }
 
-func getReceiptPoints(c *gin.Context) {
-	receiptId := c.Param("id")
+// How much longer the receipt's retailer is cooling down from its last stored receipt.
+// This is checked before storing, so receipts arriving together may both get through.
+func cooldownRemaining(id string, stored storedReceipt) time.Duration {
+	cooldown := time.Duration(currentRuleConfig().RetailerCooldownSeconds) * time.Second
+	if cooldown == 0 {
+		return 0
+	}
+
+	last, found := receipts.LastCreated(stored.Receipt.Retailer, id)
+	if !found {
+		return 0
+	}
+	return max(last.Add(cooldown).Sub(stored.CreatedAt), 0)
+}
 
-	mapMutex.Lock()
-	receipt, exists := receipts[receiptId]
-	mapMutex.Unlock()
+// A copy of the body to keep with the receipt, or nil when raw bodies aren't kept or
+// this one is larger than STORE_RAW_BYTES
+func rawCopy(body []byte) []byte {
+	if len(body) > config.MaxRawBytes {
+		return nil
+	}
+	return bytes.Clone(body)
+}
 
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"description": "No receipt found for that ID."})
-		return
+// Scores a valid receipt as of now, ready to be stored under id
+func newStoredReceipt(id string, receipt Receipt) storedReceipt {
+	// Scored and stored under the canonical retailer name, keeping the name as sent
+	var originalRetailer string
+	if canonical, aliased := retailerAlias(receipt.Retailer); aliased && canonical != receipt.Retailer {
+		originalRetailer, receipt.Retailer = receipt.Retailer, canonical
 	}
 
-	totalPoints := calculatePoints(receipt)
+	createdAt := clock.Now()
+	points, breakdown, version := scoreReceiptVersion(scoring{id: id, receipt: receipt, createdAt: createdAt})
 
-	c.JSON(http.StatusOK, gin.H{"points": totalPoints})
+	var history []pointsRecord
+	if config.PointsHistory > 0 {
+		history = []pointsRecord{{At: createdAt, ConfigVersion: version, Points: points}}
+	}
+
+	return storedReceipt{Receipt: receipt, OriginalRetailer: originalRetailer, Points: points, Breakdown: breakdown, CreatedAt: createdAt, ConfigVersion: version, ContentHash: contentHash(receipt), History: history}
 }
 
-// Calculating with custom calculator, allowing the rules to be updated more easily
-func calculatePoints(receipt Receipt) int {
-	totalPoints := 0
+func processReceipt(c *gin.Context) {
+	receiptId := uuid.New().String()
 
-	totalPoints += calculatePointsForRetailerName(receipt.Retailer)
+	stored, ok := prepareReceipt(c, receiptId)
+	if !ok {
+		return
+	}
 
-	totalPoints += calcuatePointsForTotal(receipt.Total)
+	// "If-None-Match: *" asks to create the receipt only if the same content isn't
+	// already stored, answering with the existing receipt's ID otherwise
+	var (
+		existing, evicted string
+		err               error
+	)
+	if c.GetHeader("If-None-Match") == "*" {
+		existing, evicted, err = receipts.PutIfNew(c.Request.Context(), receiptId, stored)
+	} else {
+		evicted, err = receipts.Put(c.Request.Context(), receiptId, stored)
+	}
+	if err != nil {
+		storeError(c, err)
+		return
+	}
 
-	totalPoints += calculatePointsForItems(receipt.Items)
+	if existing != "" {
+		c.Header("Location", config.BasePath+"/receipts/"+existing)
+		c.JSON(http.StatusOK, acceptedResponse(existing, stored.Receipt))
+		return
+	}
 
-	totalPoints += calculatePointsForPurchaseDate(receipt.PurchaseDate)
+	audit(c, "process", receiptId)
+	if evicted != "" {
+		audit(c, "evict", evicted)
+	}
 
-	totalPoints += calculatePointsForPurchaseTime(receipt.PurchaseTime)
+	atomic.AddInt64(&receiptsProcessed, 1)
 
-	return totalPoints
+	c.Header("Location", config.BasePath+"/receipts/"+receiptId)
+	c.JSON(config.CreatedStatus, acceptedResponse(receiptId, stored.Receipt))
 }
 
-func calculatePointsForRetailerName(s string) int {
-	points := 0
+// The ID of a stored receipt, with any warnings from the soft checks. Warnings flag
+// unusual receipts without rejecting them.
+func acceptedResponse(id string, receipt Receipt) gin.H {
+	response := gin.H{"id": id}
+	if warnings := currentRuleConfig().Warnings.check(receipt); len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+	return response
+}
 
-	// Rule 1
-	for _, c := range s {
-		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
-			points += 1
+// Scores a receipt without storing it. Admins may send a rule config in the X-Rule-Config
+// header to score it under that config instead of the active one, for this call only.
+func previewPoints(c *gin.Context) {
+	receipt, problem := checkReceipt(c.MustGet(receiptBodyKey).([]byte))
+	if problem != nil {
+		respondError(c, problem.status, problem.description, problem.errors...)
+		return
+	}
+	s := scoring{id: uuid.New().String(), receipt: receipt, createdAt: clock.Now()}
+
+	var points int
+	var breakdown []ruleScore
+	var version string
+	if override := c.GetHeader("X-Rule-Config"); override != "" {
+		if !isAdmin(c) {
+			respondError(c, http.StatusUnauthorized, "Rule config overrides require a valid admin token.")
+			return
+		}
+		rc, err := parseRuleConfig([]byte(override), "X-Rule-Config")
+		if err != nil {
+			respondError(c, http.StatusUnprocessableEntity, "The rule config override is invalid.", err.Error())
+			return
+		}
+		points, breakdown, version = scoreWithConfig(rc, s)
+	} else {
+		if canonical, aliased := retailerAlias(s.receipt.Retailer); aliased {
+			s.receipt.Retailer = canonical
 		}
+		points, breakdown, version = scoreReceiptVersion(s)
 	}
 
-	return points
+	c.Header("X-Rule-Config-Version", version)
+	c.JSON(http.StatusOK, gin.H{config.PointsKey: points, "breakdown": breakdown})
 }
 
-func calcuatePointsForTotal(t string) int {
-	points := 0
+// Stores a receipt under an ID chosen by the client, so retries with the same ID
+// can't create duplicates. An existing receipt is only replaced with ALLOW_OVERWRITE.
+func putReceipt(c *gin.Context) {
+	receiptId := c.Param("id")
+	if parsed, err := uuid.Parse(receiptId); err != nil || parsed.String() != receiptId {
+		respondError(c, http.StatusBadRequest, "The receipt ID must be a lowercase UUID such as 7fb1377b-b223-49d9-a31a-5a02701dd310.")
+		return
+	}
 
-	total, _ := strconv.ParseFloat(t, 64)
+	stored, ok := prepareReceipt(c, receiptId)
+	if !ok {
+		return
+	}
 
-	// Rule 2
-	if almostEqual(total, float64(int(total))) {
-		points += 50
+	status, action := config.CreatedStatus, "process"
+	evicted, err := receipts.Create(c.Request.Context(), receiptId, stored)
+	if errors.Is(err, errReceiptExists) && config.AllowOverwrite {
+		status, action = http.StatusOK, "overwrite"
+		evicted, err = receipts.Put(c.Request.Context(), receiptId, stored)
+	}
+	if err != nil {
+		storeError(c, err)
+		return
 	}
 
-	// Rule 3
-	if almostEqual(math.Mod(total, 0.25), 0) {
-		points += 25
+	audit(c, action, receiptId)
+	if evicted != "" {
+		audit(c, "evict", evicted)
 	}
 
-	return points
+	atomic.AddInt64(&receiptsProcessed, 1)
+
+	c.Header("Location", config.BasePath+"/receipts/"+receiptId)
+	c.JSON(status, acceptedResponse(receiptId, stored.Receipt))
 }
 
-func calculatePointsForItems(items []Item) int {
-	points := 0
+// Outcome of validating one receipt in a batch
+type validationResult struct {
+	Index       int      `json:"index"`
+	Valid       bool     `json:"valid"`
+	Description string   `json:"description,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
 
-	// Rule 4
-	points += (len(items) / 2) * 5
+// Checks one receipt of a batch the way receiptBody and processing would
+func checkBatchReceipt(body []byte) (Receipt, *receiptProblem) {
+	switch err := checkReceiptShape(body); {
+	case errors.Is(err, errTooManyItems):
+		return Receipt{}, &receiptProblem{http.StatusUnprocessableEntity, fmt.Sprintf("A receipt may have at most %d items.", config.MaxItems), nil}
+	case errors.As(err, new(duplicateKeyError)):
+		return Receipt{}, &receiptProblem{http.StatusBadRequest, "The receipt is invalid.", []string{err.Error()}}
+	case err != nil:
+		return Receipt{}, &receiptProblem{http.StatusBadRequest, "The receipt is invalid.", nil}
+	}
+	return checkReceipt(body)
+}
 
-	// Rule 5
-	for _, item := range items {
-		description := strings.TrimSpace(item.ShortDescription)
-		if len(description) % 3 == 0 {
-			price, _ := strconv.ParseFloat(item.Price, 64)
-			points += int(math.Ceil(price * 0.2))
+// Checks each receipt in a JSON array the same way processing would, storing nothing
+func validateBatch(c *gin.Context) {
+	var bodies []json.RawMessage
+	if err := c.ShouldBindJSON(&bodies); err != nil {
+		respondError(c, http.StatusBadRequest, "The request must be a JSON array of receipts.")
+		return
+	}
+
+	if len(bodies) > config.MaxValidateBatch {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("At most %d receipts can be validated at once.", config.MaxValidateBatch))
+		return
+	}
+
+	results := make([]validationResult, len(bodies))
+	valid := 0
+	for i, body := range bodies {
+		receipt, problem := checkBatchReceipt(body)
+		if problem != nil {
+			results[i] = validationResult{Index: i, Description: problem.description, Errors: problem.errors}
+		} else {
+			results[i] = validationResult{Index: i, Valid: true, Warnings: currentRuleConfig().Warnings.check(receipt)}
+			valid++
 		}
 	}
 
-	return points
+	// Mixed outcomes get their own status, so clients can branch on it without reading every result
+	status := http.StatusOK
+	if valid == 0 && len(bodies) > 0 {
+		status = http.StatusBadRequest
+	} else if valid < len(bodies) {
+		status = http.StatusMultiStatus
+	}
+
+	c.JSON(status, gin.H{"results": results, "valid": valid, "invalid": len(bodies) - valid})
 }
 
-func calculatePointsForPurchaseDate(d string) int {
-	points := 0
+func searchReceipts(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		respondError(c, http.StatusBadRequest, "A search query is required.")
+		return
+	}
 
-	date, _ := time.Parse("2006-01-02", d)
+	offset, limit, ok := pageParams(c)
+	if !ok {
+		respondError(c, http.StatusBadRequest, "Invalid pagination parameters.")
+		return
+	}
 
-	// Rule 7
-	if date.Day() % 2 == 1 {
-		points += 6
+	ids, err := receipts.Search(c.Request.Context(), query)
+	if err != nil {
+		storeError(c, err)
+		return
 	}
 
-	return points
+	if tag := c.Query("tag"); tag != "" {
+		tagged, err := receipts.List(c.Request.Context(), tag)
+		if err != nil {
+			storeError(c, err)
+			return
+		}
+		inTag := make(map[string]struct{}, len(tagged))
+		for _, id := range tagged {
+			inTag[id] = struct{}{}
+		}
+		ids = slices.DeleteFunc(ids, func(id string) bool {
+			_, ok := inTag[id]
+			return !ok
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ids": page(ids, offset, limit), "total": len(ids)})
 }
 
-func calculatePointsForPurchaseTime(t string) int {
-	points := 0
+// IDs of stored receipts, oldest first, optionally only those with a tag
+func listReceipts(c *gin.Context) {
+	offset, limit, ok := pageParams(c)
+	if !ok {
+		respondError(c, http.StatusBadRequest, "Invalid pagination parameters.")
+		return
+	}
 
-	time, _ := time.Parse("15:04", t)
+	ids, err := receipts.List(c.Request.Context(), c.Query("tag"))
+	if err != nil {
+		storeError(c, err)
+		return
+	}
 
-	// Rule 8
-	if time.Hour() >= 14 && time.Hour() <= 16 {
-		points += 10
+	c.JSON(http.StatusOK, gin.H{"ids": page(ids, offset, limit), "total": len(ids)})
+}
+
+// Most receipts a leaderboard request may ask for
+const maxTopReceipts = 100
+
+// Leaderboard of the receipts with the most points as stored, highest first
+func topReceipts(c *gin.Context) {
+	n, err := strconv.Atoi(c.DefaultQuery("n", "10"))
+	if err != nil || n < 1 || n > maxTopReceipts {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("n must be between 1 and %d.", maxTopReceipts))
+		return
 	}
 
-	return points
+	ranked, err := receipts.Top(c.Request.Context(), n)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+
+	top := make([]gin.H, len(ranked))
+	for i, r := range ranked {
+		top[i] = gin.H{"id": r.ID, "retailer": r.Retailer, config.PointsKey: r.Points}
+	}
+	c.JSON(http.StatusOK, gin.H{"receipts": top})
 }
 
-func processReceipt(c *gin.Context) {
-	var receipt Receipt
+func getReceiptSchema(c *gin.Context) {
+	c.JSON(http.StatusOK, servedReceiptSchema())
+}
+
+func getStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"receiptsProcessed": atomic.LoadInt64(&receiptsProcessed),
+		"pointsLookups":     atomic.LoadInt64(&pointsLookups),
+		"storedReceipts":    receipts.Len(),
+	})
+}
 
-	if err := c.ShouldBindJSON(&receipt); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
+// Not ready while RULE_CONFIG on disk fails to load, so a bad config shows up at
+// deploy time rather than being refused at the next reload, or while the receipt
+// store can't be read
+func getReadiness(c *gin.Context) {
+	if _, err := loadRuleConfig(config.RuleConfigPath); err != nil {
+		respondError(c, http.StatusServiceUnavailable, "The rule config is invalid.", err.Error())
+		return
+	}
+	if _, err := receipts.Get(c.Request.Context(), ""); err != nil && !errors.Is(err, errReceiptNotFound) {
+		respondError(c, http.StatusServiceUnavailable, "The receipt store is unavailable.", err.Error())
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
 
-	if err := validateReceipt(receipt); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"description": "The receipt is invalid."})
+// Points already stored keep the rules they were earned under, and recomputing always
+// uses the active rules, so nothing cached needs invalidating after a reload
+func reloadRules(c *gin.Context) {
+	if err := reloadRuleConfig(); err != nil {
+		respondError(c, http.StatusUnprocessableEntity, "The rule config was not reloaded.", err.Error())
 		return
 	}
+	audit(c, "reloadRules", "")
 
-	receiptId := uuid.New().String()
+	c.JSON(http.StatusOK, gin.H{"status": "reloaded"})
+}
+
+// Answering for a failed store call
+func storeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errReceiptNotFound):
+		respondError(c, http.StatusNotFound, "No receipt found for that ID.")
+	case errors.Is(err, errReceiptExists):
+		respondError(c, http.StatusConflict, "A receipt with that ID already exists.")
+	case errors.Is(err, errStoreFull):
+		respondError(c, http.StatusInsufficientStorage, "The receipt store is full.")
+	case errors.Is(err, context.DeadlineExceeded):
+		respondError(c, http.StatusGatewayTimeout, "The request timed out.")
+	default:
+		respondError(c, http.StatusServiceUnavailable, "The receipt store is unavailable.")
+	}
+}
 
-	mapMutex.Lock()
-	receipts[receiptId] = receipt
-	mapMutex.Unlock()
+// Reading offset and limit query parameters, defaulting to the first 50 results
+func pageParams(c *gin.Context) (offset, limit int, ok bool) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		return 0, 0, false
+	}
+
+	limit, err = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		return 0, 0, false
+	}
+
+	return offset, limit, true
+}
+
+func page[T any](results []T, offset, limit int) []T {
+	if offset >= len(results) {
+		return []T{}
+	}
+	return results[offset:min(offset+limit, len(results))]
+}
 
-	c.JSON(http.StatusOK, gin.H{"id": receiptId})
+// Hash of the receipt as bound, so formatting and field order in the request don't matter
+func contentHash(receipt Receipt) string {
+	data, _ := json.Marshal(receipt)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
+// A syntactically valid receipt that breaks a business rule, such as a total that
+// does not match its items
+type semanticError struct{ error }
+
 // Check date format, total and price format, and if price adds up to total
 func validateReceipt(receipt Receipt) error {
 	if _, err := time.Parse("2006-01-02", receipt.PurchaseDate); err != nil {
-		return err
+		return fmt.Errorf("purchaseDate %q is not a valid date", receipt.PurchaseDate)
 	}
 
 	if _, err := time.Parse("15:04", receipt.PurchaseTime); err != nil {
-		return err
+		return fmt.Errorf("purchaseTime %q is not a valid time", receipt.PurchaseTime)
+	}
+
+	total, err := parseAmount(string(receipt.Total))
+	if err != nil {
+		return fmt.Errorf("total %q is not a valid amount", receipt.Total)
+	}
+
+	if len(receipt.Tags) > maxTags {
+		return fmt.Errorf("a receipt may have at most %d tags", maxTags)
+	}
+	for i, tag := range receipt.Tags {
+		if len(tag) > maxTagLength || !tagPattern.MatchString(tag) {
+			return fmt.Errorf("tags[%d] %q must be at most %d lowercase letters, digits, '-' or '_'", i, tag, maxTagLength)
+		}
 	}
 
-	total, err := strconv.ParseFloat(receipt.Total, 64)
+	sum, err := sumItemPrices(receipt.Items)
 	if err != nil {
 		return err
 	}
 
+	rc := currentRuleConfig()
+
+	if rc.TotalMatch == "exact" {
+		if err := matchTotalExactly(receipt); err != nil {
+			return err
+		}
+	} else if !(math.Abs(total-sum) <= float64(rc.TotalToleranceCents)/100+1e-9) {
+		return semanticError{fmt.Errorf("total %s does not match the sum of item prices %.2f, a difference of %.2f", receipt.Total, sum, total-sum)}
+	}
+
+	if rc.MaxTotalCents > 0 && exceedsCents(receipt.Total, rc.MaxTotalCents) {
+		return semanticError{fmt.Errorf("total %s is above the maximum of %s", receipt.Total, formatCents(rc.MaxTotalCents))}
+	}
+	if rc.MaxItemPriceCents > 0 {
+		for i, item := range receipt.Items {
+			if exceedsCents(item.Price, rc.MaxItemPriceCents) {
+				return semanticError{fmt.Errorf("items[%d].price %s is above the maximum of %s", i, item.Price, formatCents(rc.MaxItemPriceCents))}
+			}
+		}
+	}
+
+	if rc.RejectDuplicateItems {
+		if duplicates := duplicateItems(receipt.Items); len(duplicates) > 0 {
+			return semanticError{fmt.Errorf("duplicate items are not allowed: %s", strings.Join(duplicates, ", "))}
+		}
+	}
+
+	if !rc.retailerAllowed(receipt.Retailer) {
+		return semanticError{fmt.Errorf("retailer %q is not accepted", receipt.Retailer)}
+	}
+
+	if profile, found := rc.retailerProfile(receipt.Retailer); found {
+		if err := profile.check(receipt); err != nil {
+			return semanticError{fmt.Errorf("%s (%s receipt format)", err, receipt.Retailer)}
+		}
+	}
+
+	return nil
+}
+
+func sumItemPrices(items []Item) (float64, error) {
 	var sum float64
-	for _, item := range receipt.Items {
-		price, err := strconv.ParseFloat(item.Price, 64)
+	for i, item := range items {
+		price, err := parseAmount(string(item.Price))
 		if err != nil {
-			return err
+			return 0, fmt.Errorf("items[%d].price %q is not a valid amount", i, item.Price)
 		}
 		sum += price
 	}
+	return sum, nil
+}
+
+// Compares the amounts as written in decimal, so no float rounding can hide a mismatch
+func matchTotalExactly(receipt Receipt) error {
+	total, decimals, ok := decimalAmount(receipt.Total)
+	if !ok {
+		return fmt.Errorf("total %q is not a valid amount", receipt.Total)
+	}
 
-	if !almostEqual(total, sum) {
-		return errors.New("")
+	sum := new(big.Rat)
+	for i, item := range receipt.Items {
+		price, places, ok := decimalAmount(item.Price)
+		if !ok {
+			return fmt.Errorf("items[%d].price %q is not a valid amount", i, item.Price)
+		}
+		sum.Add(sum, price)
+		decimals = max(decimals, places)
 	}
 
+	if total.Cmp(sum) != 0 {
+		return semanticError{fmt.Errorf("total %s does not exactly match the sum of item prices %s", receipt.Total, sum.FloatString(decimals))}
+	}
 	return nil
 }
 
+// Reports whether a valid amount is more than limit cents, for totals and item prices
+// alike. Amounts with more than two decimal places, or too large for int64 cents,
+// don't parse as cents and are compared exactly instead.
+func exceedsCents(amount Amount, limit int64) bool {
+	if cents, err := parseCents(string(amount)); err == nil {
+		return cents > limit
+	}
+	value, _, ok := decimalAmount(amount)
+	return ok && value.Cmp(big.NewRat(limit, 100)) > 0
+}
+
+// The exact value of an amount, and its number of decimal places (at least two)
+func decimalAmount(amount Amount) (*big.Rat, int, bool) {
+	s := stripThousands(string(amount))
+	value, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, 0, false
+	}
+	_, frac, _ := strings.Cut(s, ".")
+	return value, max(len(frac), 2), true
+}
+
+// Listing each description and price pair that appears more than once
+func duplicateItems(items []Item) []string {
+	type key struct{ description, price string }
+
+	seen := make(map[key]int)
+	var duplicates []string
+	for _, item := range items {
+		k := key{strings.TrimSpace(item.ShortDescription), string(item.Price)}
+		seen[k]++
+		if seen[k] == 2 {
+			duplicates = append(duplicates, fmt.Sprintf("%q at %s", k.description, k.price))
+		}
+	}
+	return duplicates
+}
+
 // Dealing with float64 comparison
 func almostEqual(a, b float64) bool {
 	return math.Abs(a - b) <= 1e-9
-}
\ No newline at end of file
+}
+
+// ParseFloat also accepts NaN and infinities, which no amount can be
+func parseAmount(s string) (float64, error) {
+	f, err := strconv.ParseFloat(stripThousands(s), 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return f, err
+}
+
+// Parsing an amount like "35.35" into exact cents, avoiding float rounding
+func parseCents(s string) (int64, error) {
+	whole, frac, _ := strings.Cut(stripThousands(s), ".")
+
+	negative := strings.HasPrefix(whole, "-")
+	whole = strings.TrimPrefix(whole, "-")
+
+	if (whole == "" && frac == "") || len(frac) > 2 || !isDigits(whole) || !isDigits(frac) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	for len(frac) < 2 {
+		frac += "0"
+	}
+
+	// Amounts too large for int64 cents are an error rather than wrapping around
+	var cents int64
+	for _, c := range whole + frac {
+		digit := int64(c - '0')
+		if cents > (math.MaxInt64-digit)/10 {
+			return 0, fmt.Errorf("amount %q is too large", s)
+		}
+		cents = cents*10 + digit
+	}
+
+	if negative {
+		cents = -cents
+	}
+	return cents, nil
+}
+
+// Removing the configured thousands separator, e.g. "1,234.50" becomes "1234.50".
+// Badly grouped amounts like "1,23.00", ",500.00" or "12345,678.00" are returned
+// untouched so that parsing fails.
+func stripThousands(s string) string {
+	sep := config.ThousandsSeparator
+	if sep == "" {
+		return s
+	}
+
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	groups := strings.Split(whole, sep)
+	if len(groups) == 1 {
+		return s
+	}
+	if leading := strings.TrimLeft(groups[0], "+-"); len(leading) < 1 || len(leading) > 3 {
+		return s
+	}
+	for _, group := range groups[1:] {
+		if len(group) != 3 {
+			return s
+		}
+	}
+
+	s = strings.Join(groups, "")
+	if hasFrac {
+		s += "." + frac
+	}
+	return s
+}
+
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func digitSum(n int64) int {
+	if n < 0 {
+		n = -n
+	}
+	sum := 0
+	for ; n > 0; n /= 10 {
+		sum += int(n % 10)
+	}
+	return sum
+}
+
+// Exact for every int64, without trial division's cost on huge totals
+func isPrime(n int64) bool {
+	return n >= 2 && big.NewInt(n).ProbablyPrime(20)
+}
@@ -0,0 +1,2367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	os.Exit(m.Run())
+}
+
+// The example receipt from the README, worth 28 points under the default rules
+const targetReceipt = `{
+	"retailer": "Target",
+	"purchaseDate": "2022-01-01",
+	"purchaseTime": "13:01",
+	"items": [
+		{"shortDescription": "Mountain Dew 12PK", "price": "6.49"},
+		{"shortDescription": "Emils Cheese Pizza", "price": "12.25"},
+		{"shortDescription": "Knorr Creamy Chicken", "price": "1.26"},
+		{"shortDescription": "Doritos Nacho Cheese", "price": "3.35"},
+		{"shortDescription": "   Klarbrunn 12-PK 12 FL OZ  ", "price": "12.00"}
+	],
+	"total": "35.35"
+}`
+
+// A one-item receipt for the retailer, with the given date, time and total
+func simpleReceipt(retailer, date, time, total string) string {
+	return `{"retailer": "` + retailer + `", "purchaseDate": "` + date + `", "purchaseTime": "` + time +
+		`", "items": [{"shortDescription": "Gatorade", "price": "` + total + `"}], "total": "` + total + `"}`
+}
+
+// Sets up a server the way main does, under the given environment, with an empty
+// store, the real clock and counters starting from zero
+func newTestServer(t *testing.T, env map[string]string) http.Handler {
+	t.Helper()
+
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	config = loadConfig()
+	clock = realClock{}
+	auditLog = nil
+	atomic.StoreInt64(&receiptsProcessed, 0)
+	atomic.StoreInt64(&pointsLookups, 0)
+
+	handler, err := newServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+// Sends a request with the given headers, as name and value pairs
+func send(handler http.Handler, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// Processes the receipt, failing the test unless it is stored, and returns its ID
+func process(t *testing.T, handler http.Handler, body string) string {
+	t.Helper()
+
+	w := send(handler, http.MethodPost, "/receipts/process", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("processing the receipt: status %d, body %s", w.Code, w.Body)
+	}
+	var response struct{ ID string }
+	decode(t, w, &response)
+	return response.ID
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+}
+
+func TestStoreFull(t *testing.T) {
+	tests := []struct {
+		mode       string
+		wantStatus int
+		wantFirst  int // status of GET for the first receipt afterwards
+	}{
+		{mode: "reject", wantStatus: http.StatusInsufficientStorage, wantFirst: http.StatusOK},
+		{mode: "evict", wantStatus: http.StatusCreated, wantFirst: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			h := newTestServer(t, map[string]string{"MAX_RECEIPTS": "2", "STORE_FULL_MODE": tt.mode})
+
+			first := process(t, h, simpleReceipt("Target", "2022-01-01", "13:01", "1.00"))
+			process(t, h, simpleReceipt("Target", "2022-01-02", "13:01", "2.00"))
+
+			w := send(h, http.MethodPost, "/receipts/process", simpleReceipt("Target", "2022-01-03", "13:01", "3.00"))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("third receipt: status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := send(h, http.MethodGet, "/receipts/"+first, "").Code; got != tt.wantFirst {
+				t.Errorf("GET first receipt: status %d, want %d", got, tt.wantFirst)
+			}
+			if got := receipts.Len(); got != 2 {
+				t.Errorf("store holds %d receipts, want 2", got)
+			}
+		})
+	}
+}
+
+func TestParseCents(t *testing.T) {
+	tests := []struct {
+		amount  string
+		want    int64
+		wantErr bool
+	}{
+		{amount: "35.35", want: 3535},
+		{amount: "7", want: 700},
+		{amount: "7.5", want: 750},
+		{amount: ".25", want: 25},
+		{amount: "-1.20", want: -120},
+		{amount: "92233720368547758.07", want: 9223372036854775807},
+		{amount: "92233720368547758.08", wantErr: true},
+		{amount: "184467440737095516.16", wantErr: true},
+		{amount: "1.234", wantErr: true},
+		{amount: "1.2.3", wantErr: true},
+		{amount: "abc", wantErr: true},
+		{amount: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseCents(tt.amount)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCents(%q): error %v, want error %v", tt.amount, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCents(%q) = %d, want %d", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestStatsCountConcurrentRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		processes int
+		lookups   int // for each processed receipt
+	}{
+		{name: "nothing", processes: 0, lookups: 0},
+		{name: "processing only", processes: 50, lookups: 0},
+		{name: "lookups", processes: 20, lookups: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, nil)
+
+			var wg sync.WaitGroup
+			for i := range tt.processes {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w := send(h, http.MethodPost, "/receipts/process", simpleReceipt("Target", "2022-01-01", "13:01", strconv.Itoa(i+1)+".00"))
+					var response struct{ ID string }
+					if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+						t.Error(err)
+						return
+					}
+					for range tt.lookups {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							send(h, http.MethodGet, "/receipts/"+response.ID+"/points", "")
+						}()
+					}
+				}()
+			}
+			wg.Wait()
+
+			var stats struct {
+				ReceiptsProcessed int
+				PointsLookups     int
+				StoredReceipts    int
+			}
+			decode(t, send(h, http.MethodGet, "/stats", ""), &stats)
+			if stats.ReceiptsProcessed != tt.processes || stats.StoredReceipts != tt.processes {
+				t.Errorf("processed %d and stored %d receipts, want %d", stats.ReceiptsProcessed, stats.StoredReceipts, tt.processes)
+			}
+			if want := tt.processes * tt.lookups; stats.PointsLookups != want {
+				t.Errorf("counted %d points lookups, want %d", stats.PointsLookups, want)
+			}
+		})
+	}
+}
+
+func TestPointsKey(t *testing.T) {
+	h := newTestServer(t, map[string]string{"POINTS_KEY": "score"})
+	id := process(t, h, targetReceipt)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		points func(response map[string]any) any
+	}{
+		{
+			name: "points", method: http.MethodGet, path: "/receipts/" + id + "/points",
+			points: func(r map[string]any) any { return r["score"] },
+		},
+		{
+			name: "single rule", method: http.MethodGet, path: "/receipts/" + id + "/points?rule=retailer",
+			points: func(r map[string]any) any { return r["score"] },
+		},
+		{
+			name: "preview", method: http.MethodPost, path: "/receipts/points", body: targetReceipt,
+			points: func(r map[string]any) any { return r["score"] },
+		},
+		{
+			name: "batch", method: http.MethodPost, path: "/receipts/points/batch", body: `["` + id + `"]`,
+			points: func(r map[string]any) any { return r["score"].(map[string]any)[id] },
+		},
+		{
+			name: "compare", method: http.MethodGet, path: "/receipts/compare?a=" + id + "&b=" + id,
+			points: func(r map[string]any) any { return r["a"].(map[string]any)["score"] },
+		},
+		{
+			name: "top", method: http.MethodGet, path: "/receipts/top",
+			points: func(r map[string]any) any { return r["receipts"].([]any)[0].(map[string]any)["score"] },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, tt.method, tt.path, tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var response map[string]any
+			decode(t, w, &response)
+			if _, ok := response["points"]; ok {
+				t.Errorf("response still uses the points key: %s", w.Body)
+			}
+			if got := tt.points(response); got == nil {
+				t.Errorf("no points under the configured key: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		processAt string
+		statsAt   string
+		missing   []string // paths that should not be served
+	}{
+		{
+			name:      "none",
+			processAt: "/receipts/process",
+			statsAt:   "/stats",
+		},
+		{
+			name:      "prefix",
+			env:       map[string]string{"BASE_PATH": "/api/v1/"},
+			processAt: "/api/v1/receipts/process",
+			statsAt:   "/stats",
+			missing:   []string{"/receipts/process", "/api/v1/stats"},
+		},
+		{
+			name:      "ops under the prefix",
+			env:       map[string]string{"BASE_PATH": "api/v1", "OPS_UNDER_BASE_PATH": "true"},
+			processAt: "/api/v1/receipts/process",
+			statsAt:   "/api/v1/stats",
+			missing:   []string{"/receipts/process", "/stats"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, tt.env)
+
+			if w := send(h, http.MethodPost, tt.processAt, targetReceipt); w.Code != http.StatusCreated {
+				t.Errorf("POST %s: status %d", tt.processAt, w.Code)
+			}
+			if w := send(h, http.MethodGet, tt.statsAt, ""); w.Code != http.StatusOK {
+				t.Errorf("GET %s: status %d", tt.statsAt, w.Code)
+			}
+			for _, path := range tt.missing {
+				if w := send(h, http.MethodPost, path, targetReceipt); w.Code != http.StatusNotFound {
+					t.Errorf("POST %s: status %d, want 404", path, w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestThousandsSeparator(t *testing.T) {
+	tests := []struct {
+		name      string
+		separator string
+		total     string
+		status    int
+	}{
+		{name: "disabled", separator: "", total: "1,234.50", status: http.StatusBadRequest},
+		{name: "enabled", separator: ",", total: "1,234.50", status: http.StatusCreated},
+		{name: "enabled without separator", separator: ",", total: "1234.50", status: http.StatusCreated},
+		{name: "misplaced separator", separator: ",", total: "12,34.50", status: http.StatusBadRequest},
+		{name: "empty leading group", separator: ",", total: ",500.00", status: http.StatusBadRequest},
+		{name: "long leading group", separator: ",", total: "12345,678.00", status: http.StatusBadRequest},
+		{name: "several groups", separator: ",", total: "12,345,678.00", status: http.StatusCreated},
+		{name: "other separator", separator: " ", total: "1 234.50", status: http.StatusCreated},
+		{name: "unexpected separator", separator: " ", total: "1,234.50", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, map[string]string{"THOUSANDS_SEPARATOR": tt.separator})
+
+			w := send(h, http.MethodPost, "/receipts/process", simpleReceipt("Target", "2022-01-01", "13:01", tt.total))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{name: "nothing trusted", remoteAddr: "192.0.2.1:1234", forwarded: "203.0.113.7", want: "192.0.2.1"},
+		{name: "trusted proxy", trusted: "192.0.2.1", remoteAddr: "192.0.2.1:1234", forwarded: "203.0.113.7", want: "203.0.113.7"},
+		{name: "trusted range", trusted: "10.0.0.0/8, 192.0.2.0/24", remoteAddr: "192.0.2.9:1234", forwarded: "203.0.113.7", want: "203.0.113.7"},
+		{name: "spoofed by an untrusted client", trusted: "10.0.0.0/8", remoteAddr: "192.0.2.1:1234", forwarded: "203.0.113.7", want: "192.0.2.1"},
+		{name: "spoofed through a trusted proxy", trusted: "192.0.2.1", remoteAddr: "192.0.2.1:1234", forwarded: "203.0.113.7, 198.51.100.2", want: "198.51.100.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			h := newTestServer(t, map[string]string{"AUDIT_LOG": path, "TRUSTED_PROXIES": tt.trusted})
+
+			req := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(targetReceipt))
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if entries := readAuditLog(t, path, 1); len(entries) != 1 || entries[0].ClientIP != tt.want {
+				t.Errorf("audited %+v, want client IP %s", entries, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchReceipts(t *testing.T) {
+	h := newTestServer(t, nil)
+	clock = &tickingClock{now: storeEpoch}
+	var milk []string
+	for i := range 3 {
+		milk = append(milk, process(t, h, simpleReceipt("Target", "2022-01-0"+strconv.Itoa(i+1), "13:01", "1.00")))
+	}
+	process(t, h, targetReceipt)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   string
+	}{
+		{name: "matches", query: "?q=gatorade", status: http.StatusOK, want: `{"ids":["` + strings.Join(milk, `","`) + `"],"total":3}`},
+		{name: "page", query: "?q=GATORADE&offset=1&limit=1", status: http.StatusOK, want: `{"ids":["` + milk[1] + `"],"total":3}`},
+		{name: "past the end", query: "?q=gatorade&offset=5", status: http.StatusOK, want: `{"ids":[],"total":3}`},
+		{name: "nothing matches", query: "?q=caviar", status: http.StatusOK, want: `{"ids":[],"total":0}`},
+		{name: "no query", query: "?q=%20", status: http.StatusBadRequest},
+		{name: "bad limit", query: "?q=gatorade&limit=0", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, http.MethodGet, "/receipts/search"+tt.query, "")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.want != "" && w.Body.String() != tt.want {
+				t.Errorf("got %s, want %s", w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReceiptTotalMismatch(t *testing.T) {
+	activateRuleConfig(t, newRuleConfig(t, `{}`))
+
+	tests := []struct {
+		name  string
+		total string
+		want  string // empty when the total matches
+	}{
+		{name: "matches", total: "35.35"},
+		{name: "too high", total: "40.00", want: "total 40.00 does not match the sum of item prices 35.35, a difference of 4.65"},
+		{name: "too low", total: "35.34", want: "total 35.34 does not match the sum of item prices 35.35, a difference of -0.01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := parseReceipt(t, targetReceipt)
+			receipt.Total = Amount(tt.total)
+
+			err := validateReceipt(receipt)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+			if !errors.As(err, new(semanticError)) {
+				t.Errorf("%v is not a semantic error", err)
+			}
+		})
+	}
+}
+
+func TestStoredAndRecomputedPoints(t *testing.T) {
+	h := newTestServer(t, nil)
+	id := process(t, h, targetReceipt)
+
+	// Changing the rules after the receipt was processed
+	activateRuleConfig(t, newRuleConfig(t, `{"distinctItemPoints": 2}`))
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{query: "", want: 28},
+		{query: "?recompute=false", want: 28},
+		{query: "?recompute=true", want: 38},
+	}
+
+	for _, tt := range tests {
+		w := send(h, http.MethodGet, "/receipts/"+id+"/points"+tt.query, "")
+		var response struct{ Points int }
+		decode(t, w, &response)
+		if response.Points != tt.want {
+			t.Errorf("GET points%s: got %d, want %d", tt.query, response.Points, tt.want)
+		}
+	}
+}
+
+func TestBatchPoints(t *testing.T) {
+	h := newTestServer(t, map[string]string{"MAX_BATCH_IDS": "3"})
+	target := process(t, h, targetReceipt)
+	other := process(t, h, simpleReceipt("Walgreens", "2022-01-02", "08:13", "2.65"))
+
+	type response struct {
+		Points   map[string]int
+		NotFound []string
+	}
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   response
+	}{
+		{
+			name: "found", body: `["` + target + `", "` + other + `"]`, status: http.StatusOK,
+			want: response{Points: map[string]int{target: 28, other: 9}, NotFound: []string{}},
+		},
+		{
+			name: "missing listed once", body: `["missing", "` + target + `", "missing"]`, status: http.StatusOK,
+			want: response{Points: map[string]int{target: 28}, NotFound: []string{"missing"}},
+		},
+		{name: "empty", body: `[]`, status: http.StatusOK, want: response{Points: map[string]int{}, NotFound: []string{}}},
+		{name: "too many", body: `["a", "b", "c", "d"]`, status: http.StatusBadRequest},
+		{name: "not an array", body: `{"ids": []}`, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, http.MethodPost, "/receipts/points/batch", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got response
+			decode(t, w, &got)
+			if !maps.Equal(got.Points, tt.want.Points) || !slices.Equal(got.NotFound, tt.want.NotFound) || got.NotFound == nil {
+				t.Errorf("got %s, want %+v", w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstOfDayPoints(t *testing.T) {
+	h := newTestServer(t, nil)
+	clock = &tickingClock{now: storeEpoch}
+	activateRuleConfig(t, newRuleConfig(t, `{"firstOfDayPoints": 7}`))
+
+	// A prior receipt for Target on New Year's Day
+	seeded := process(t, h, simpleReceipt("Target", "2022-01-01", "13:01", "1.00"))
+
+	tests := []struct {
+		name    string
+		receipt string
+		want    int
+	}{
+		{name: "same retailer and date", receipt: simpleReceipt("target", "2022-01-01", "18:00", "2.00"), want: 0},
+		{name: "next day", receipt: simpleReceipt("Target", "2022-01-02", "13:01", "1.00"), want: 7},
+		{name: "other retailer", receipt: simpleReceipt("Walgreens", "2022-01-01", "13:01", "1.00"), want: 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, http.MethodPost, "/receipts/points?breakdown=true", tt.receipt)
+			var response struct{ Breakdown []ruleScore }
+			decode(t, w, &response)
+			i := slices.IndexFunc(response.Breakdown, func(s ruleScore) bool { return s.Rule == "firstOfDay" })
+			if i < 0 || response.Breakdown[i].Points != tt.want {
+				t.Errorf("got breakdown %+v, want %d points for firstOfDay", response.Breakdown, tt.want)
+			}
+		})
+	}
+
+	// Recomputing the seeded receipt doesn't count it against itself
+	w := send(h, http.MethodGet, "/receipts/"+seeded+"/points?recompute=true&breakdown=true", "")
+	var response struct{ Breakdown []ruleScore }
+	decode(t, w, &response)
+	if !slices.Contains(response.Breakdown, ruleScore{"firstOfDay", 7, `7 points because this is the first receipt stored for "Target" on 2022-01-01`}) {
+		t.Errorf("recomputed breakdown %+v has no firstOfDay bonus", response.Breakdown)
+	}
+}
+
+func TestCreatedLocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		path   string
+		status int
+		prefix string
+	}{
+		{name: "default", path: "/receipts/process", status: http.StatusCreated, prefix: "/receipts/"},
+		{name: "transition", env: map[string]string{"CREATED_STATUS": "200"}, path: "/receipts/process", status: http.StatusOK, prefix: "/receipts/"},
+		{name: "base path", env: map[string]string{"BASE_PATH": "/api/v1"}, path: "/api/v1/receipts/process", status: http.StatusCreated, prefix: "/api/v1/receipts/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, tt.env)
+
+			w := send(h, http.MethodPost, tt.path, targetReceipt)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			var response struct{ ID string }
+			decode(t, w, &response)
+			location := w.Header().Get("Location")
+			if location != tt.prefix+response.ID {
+				t.Fatalf("Location %q, want %q", location, tt.prefix+response.ID)
+			}
+			if w := send(h, http.MethodGet, location, ""); w.Code != http.StatusOK {
+				t.Errorf("GET %s: status %d", location, w.Code)
+			}
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	// Speaks HTTP/2 over a plain TCP connection, with no upgrade from HTTP/1.1
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}}
+
+	tests := []struct {
+		name   string
+		h2c    string
+		client *http.Client
+		proto  string // empty when the request should fail
+	}{
+		{name: "h2c client", h2c: "true", client: h2cClient, proto: "HTTP/2.0"},
+		{name: "HTTP/1.1 client", h2c: "true", client: http.DefaultClient, proto: "HTTP/1.1"},
+		{name: "disabled", h2c: "false", client: h2cClient},
+		{name: "disabled with HTTP/1.1", h2c: "false", client: http.DefaultClient, proto: "HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(newTestServer(t, map[string]string{"H2C": tt.h2c}))
+			defer server.Close()
+
+			resp, err := tt.client.Get(server.URL + "/readyz")
+			if tt.proto == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("got %s %d, want the request to fail", resp.Proto, resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK || resp.Proto != tt.proto {
+				t.Errorf("got %s %d, want %s 200", resp.Proto, resp.StatusCode, tt.proto)
+			}
+		})
+	}
+}
+
+func TestDuplicateItems(t *testing.T) {
+	receiptWith := func(items string, total string) string {
+		return `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "items": [` + items + `], "total": "` + total + `"}`
+	}
+	const (
+		gum       = `{"shortDescription": "Gum", "price": "1.00"}`
+		paddedGum = `{"shortDescription": " Gum ", "price": "1.00"}`
+		cheapGum  = `{"shortDescription": "Gum", "price": "0.50"}`
+		milk      = `{"shortDescription": "Milk", "price": "2.00"}`
+	)
+
+	tests := []struct {
+		name   string
+		strict bool
+		body   string
+		status int
+		errors []string
+	}{
+		{name: "lenient", body: receiptWith(gum+","+gum, "2.00"), status: http.StatusCreated},
+		{name: "strict without duplicates", strict: true, body: receiptWith(gum+","+cheapGum+","+milk, "3.50"), status: http.StatusCreated},
+		{
+			name: "strict", strict: true, body: receiptWith(gum+","+milk+","+paddedGum+","+milk+","+gum, "7.00"),
+			status: http.StatusUnprocessableEntity, errors: []string{`duplicate items are not allowed: "Gum" at 1.00, "Milk" at 2.00`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, nil)
+			activateRuleConfig(t, newRuleConfig(t, fmt.Sprintf(`{"rejectDuplicateItems": %v}`, tt.strict)))
+
+			w := send(h, http.MethodPost, "/receipts/process", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var response struct{ Errors []string }
+			decode(t, w, &response)
+			if !slices.Equal(response.Errors, tt.errors) {
+				t.Errorf("errors %q, want %q", response.Errors, tt.errors)
+			}
+		})
+	}
+}
+
+func TestAmountUnmarshal(t *testing.T) {
+	tests := []struct {
+		json    string
+		numeric bool
+		want    Amount
+		wantErr bool
+	}{
+		{json: `"6.49"`, want: "6.49"},
+		{json: `"6.49"`, numeric: true, want: "6.49"},
+		{json: `6.49`, wantErr: true},
+		{json: `6.49`, numeric: true, want: "6.49"},
+		{json: `6.5`, numeric: true, want: "6.50"},
+		{json: `6`, numeric: true, want: "6.00"},
+		{json: `0.1`, numeric: true, want: "0.10"},
+		{json: `6.499`, numeric: true, wantErr: true},
+		{json: `1e2`, numeric: true, wantErr: true},
+		{json: `-3.25`, numeric: true, want: "-3.25"},
+		{json: `true`, numeric: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		config.NumericAmounts = tt.numeric
+
+		var got Amount
+		err := json.Unmarshal([]byte(tt.json), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s with numeric amounts %v: error %v, want error %v", tt.json, tt.numeric, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s with numeric amounts %v: got %q, want %q", tt.json, tt.numeric, got, tt.want)
+		}
+	}
+}
+
+func TestNumericAmounts(t *testing.T) {
+	body := `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01",
+		"items": [{"shortDescription": "Gum", "price": 1.5}, {"shortDescription": "Milk", "price": "2.25"}], "total": 3.75}`
+
+	tests := []struct {
+		numeric string
+		status  int
+	}{
+		{numeric: "false", status: http.StatusBadRequest},
+		{numeric: "true", status: http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		h := newTestServer(t, map[string]string{"NUMERIC_AMOUNTS": tt.numeric})
+		w := send(h, http.MethodPost, "/receipts/process", body)
+		if w.Code != tt.status {
+			t.Fatalf("NUMERIC_AMOUNTS=%s: status %d, want %d: %s", tt.numeric, w.Code, tt.status, w.Body)
+		}
+		if w.Code != http.StatusCreated {
+			continue
+		}
+
+		// Stored in the canonical string form
+		var created struct{ ID string }
+		decode(t, w, &created)
+		var stored Receipt
+		decode(t, send(h, http.MethodGet, "/receipts/"+created.ID, ""), &stored)
+		if stored.Total != "3.75" || stored.Items[0].Price != "1.50" {
+			t.Errorf("stored total %q and price %q, want 3.75 and 1.50", stored.Total, stored.Items[0].Price)
+		}
+	}
+}
+
+// A store that can't be reached
+type unavailableStore struct{ Store }
+
+func (unavailableStore) Get(context.Context, string) (storedReceipt, error) {
+	return storedReceipt{}, errors.New("connection refused")
+}
+
+func TestReadiness(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, map[string]string{"RULE_CONFIG": path, "ADMIN_TOKEN": "secret"})
+
+	steps := []struct {
+		name    string
+		config  string
+		status  int
+		problem string
+	}{
+		{name: "valid", config: `{}`, status: http.StatusOK},
+		{name: "negative points", config: `{"minPoints": -1}`, status: http.StatusServiceUnavailable, problem: "minPoints must not be negative"},
+		{name: "zero divisor", config: `{"pointsDivisor": 0}`, status: http.StatusServiceUnavailable, problem: "pointsDivisor must be at least 1, got 0"},
+		{name: "unknown rounding", config: `{"pointsRounding": "sideways"}`, status: http.StatusServiceUnavailable, problem: `pointsRounding must be "none", "down", "up" or "nearest", got "sideways"`},
+		{name: "unknown rule", config: `{"ruleOrder": ["bogus"]}`, status: http.StatusServiceUnavailable, problem: `ruleOrder: unknown rule "bogus"`},
+		{name: "unparseable", config: `{"pointsDivisor": `, status: http.StatusServiceUnavailable, problem: "parsing " + path},
+		{name: "fixed", config: `{"itemPriceMultiplier": 0}`, status: http.StatusOK},
+	}
+
+	for _, step := range steps {
+		if err := os.WriteFile(path, []byte(step.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		w := send(h, http.MethodGet, "/readyz", "")
+		if w.Code != step.status {
+			t.Errorf("%s: status %d, want %d: %s", step.name, w.Code, step.status, w.Body)
+			continue
+		}
+		var response struct{ Errors []string }
+		decode(t, w, &response)
+		if step.problem != "" && (len(response.Errors) != 1 || !strings.Contains(response.Errors[0], step.problem)) {
+			t.Errorf("%s: errors %q, want %q", step.name, response.Errors, step.problem)
+		}
+
+		// Readiness agrees with whether the file can be reloaded
+		reload := http.StatusOK
+		if step.status != http.StatusOK {
+			reload = http.StatusUnprocessableEntity
+		}
+		if w := send(h, http.MethodPost, "/admin/reload", "", "Authorization", "Bearer secret"); w.Code != reload {
+			t.Errorf("%s: reload status %d, want %d", step.name, w.Code, reload)
+		}
+	}
+
+	receipts = unavailableStore{receipts}
+	if w := send(h, http.MethodGet, "/readyz", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unavailable store: status %d, want 503", w.Code)
+	}
+}
+
+func TestStreamBatchPoints(t *testing.T) {
+	h := newTestServer(t, nil)
+	target := process(t, h, targetReceipt)
+
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{name: "found", body: `["` + target + `"]`, want: []string{`{"id":"` + target + `","points":28}`}},
+		{
+			name: "missing listed once", body: `["missing", "` + target + `", "missing"]`,
+			want: []string{`{"id":"missing","notFound":true}`, `{"id":"` + target + `","points":28}`},
+		},
+		{name: "empty", body: `[]`, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, http.MethodPost, "/receipts/points/batch?stream=true", tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/x-ndjson" {
+				t.Errorf("Content-Type %q", got)
+			}
+			if got := strings.Fields(w.Body.String()); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// A store whose lookups of one ID block until release is closed
+type gatedStore struct {
+	Store
+	gated   string
+	release chan struct{}
+}
+
+func (s gatedStore) Get(ctx context.Context, id string) (storedReceipt, error) {
+	if id == s.gated {
+		<-s.release
+	}
+	return s.Store.Get(ctx, id)
+}
+
+func TestStreamBatchPointsIsIncremental(t *testing.T) {
+	h := newTestServer(t, nil)
+	target := process(t, h, targetReceipt)
+	release := make(chan struct{})
+	receipts = gatedStore{Store: receipts, gated: target, release: release}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	// A full flush's worth of lines ahead of the receipt whose lookup blocks
+	ids := make([]string, streamFlushEvery, streamFlushEvery+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("missing-%d", i)
+	}
+	ids = append(ids, target)
+	body, _ := json.Marshal(ids)
+
+	resp, err := http.Post(server.URL+"/receipts/points/batch?stream=true", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		close(release)
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := bufio.NewScanner(resp.Body)
+	for i := range streamFlushEvery {
+		if !lines.Scan() {
+			close(release)
+			t.Fatalf("stream ended after %d lines while the last lookup was pending: %v", i, lines.Err())
+		}
+	}
+	close(release)
+
+	if !lines.Scan() || lines.Text() != `{"id":"`+target+`","points":28}` {
+		t.Errorf("last line %q", lines.Text())
+	}
+	if lines.Scan() {
+		t.Errorf("unexpected line %q", lines.Text())
+	}
+}
+
+func TestCompareReceipts(t *testing.T) {
+	h := newTestServer(t, nil)
+	target := process(t, h, targetReceipt)
+	other := process(t, h, simpleReceipt("Walgreens", "2022-01-02", "08:13", "2.65"))
+
+	type side struct {
+		ID     string
+		Points int
+	}
+	type response struct {
+		A, B        side
+		Difference  int
+		Breakdown   []ruleDifference
+		Description string
+	}
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   response
+	}{
+		{
+			name: "a earned more", query: "?a=" + target + "&b=" + other, status: http.StatusOK,
+			want: response{A: side{target, 28}, B: side{other, 9}, Difference: 19},
+		},
+		{
+			name: "b earned more", query: "?a=" + other + "&b=" + target, status: http.StatusOK,
+			want: response{A: side{other, 9}, B: side{target, 28}, Difference: -19},
+		},
+		{
+			name: "a missing", query: "?a=nope&b=" + target, status: http.StatusNotFound,
+			want: response{Description: "No receipt found for a (nope)."},
+		},
+		{
+			name: "b missing", query: "?a=" + target + "&b=nope", status: http.StatusNotFound,
+			want: response{Description: "No receipt found for b (nope)."},
+		},
+		{
+			name: "b absent", query: "?a=" + target, status: http.StatusBadRequest,
+			want: response{Description: "Both receipt IDs a and b are required."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, http.MethodGet, "/receipts/compare"+tt.query, "")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var got response
+			decode(t, w, &got)
+			if got.A != tt.want.A || got.B != tt.want.B || got.Difference != tt.want.Difference || got.Description != tt.want.Description {
+				t.Errorf("got %s, want %+v", w.Body, tt.want)
+			}
+			if got.Breakdown != nil {
+				t.Errorf("breakdown without asking for it: %s", w.Body)
+			}
+		})
+	}
+
+	t.Run("breakdown", func(t *testing.T) {
+		var got response
+		decode(t, send(h, http.MethodGet, "/receipts/compare?a="+target+"&b="+other+"&breakdown=true", ""), &got)
+
+		sum := 0
+		for _, d := range got.Breakdown {
+			if d.Difference != d.A-d.B {
+				t.Errorf("%s: difference %d, want %d", d.Rule, d.Difference, d.A-d.B)
+			}
+			sum += d.Difference
+		}
+		if sum != got.Difference {
+			t.Errorf("rule differences sum to %d, want %d", sum, got.Difference)
+		}
+		if i := slices.IndexFunc(got.Breakdown, func(d ruleDifference) bool { return d.Rule == "retailer" }); i < 0 || got.Breakdown[i] != (ruleDifference{Rule: "retailer", A: 6, B: 9, Difference: -3}) {
+			t.Errorf("breakdown %+v", got.Breakdown)
+		}
+	})
+}
+
+func TestProcessReceiptStatus(t *testing.T) {
+	h := newTestServer(t, nil)
+	activateRuleConfig(t, newRuleConfig(t, `{"maxTotalCents": 5000}`))
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "valid", body: simpleReceipt("Target", "2022-01-01", "13:01", "6.49"), status: http.StatusCreated},
+		{name: "malformed JSON", body: `{"retailer": "Target",`, status: http.StatusBadRequest},
+		{name: "missing retailer", body: `{"purchaseDate": "2022-01-01", "purchaseTime": "13:01", "total": "6.49", "items": [{"shortDescription": "Gum", "price": "6.49"}]}`, status: http.StatusBadRequest},
+		{name: "invalid date", body: simpleReceipt("Target", "2022-02-30", "13:01", "6.49"), status: http.StatusBadRequest},
+		{name: "invalid time", body: simpleReceipt("Target", "2022-01-01", "25:01", "6.49"), status: http.StatusBadRequest},
+		{name: "total mismatch", body: strings.Replace(targetReceipt, `"35.35"`, `"40.00"`, 1), status: http.StatusUnprocessableEntity},
+		{name: "total above the maximum", body: simpleReceipt("Target", "2022-01-01", "13:01", "60.00"), status: http.StatusUnprocessableEntity},
+		{name: "NaN total", body: strings.Replace(targetReceipt, `"35.35"`, `"NaN"`, 1), status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := send(h, http.MethodPost, "/receipts/process", tt.body); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestReloadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, map[string]string{"RULE_CONFIG": path, "ADMIN_TOKEN": "secret"})
+
+	steps := []struct {
+		name   string
+		config string
+		token  string
+		status int
+		points int // for a receipt processed after the reload
+	}{
+		{name: "unchanged", config: `{}`, token: "secret", status: http.StatusOK, points: 28},
+		{name: "changed", config: `{"itemPriceMultiplier": 0}`, token: "secret", status: http.StatusOK, points: 22},
+		{name: "without the token", config: `{}`, status: http.StatusUnauthorized, points: 22},
+		{name: "invalid", config: `{"pointsDivisor": 0}`, token: "secret", status: http.StatusUnprocessableEntity, points: 22},
+		{name: "unparseable", config: `{"pointsDivisor": `, token: "secret", status: http.StatusUnprocessableEntity, points: 22},
+		{name: "changed back", config: `{}`, token: "secret", status: http.StatusOK, points: 28},
+	}
+
+	for _, step := range steps {
+		if err := os.WriteFile(path, []byte(step.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		w := send(h, http.MethodPost, "/admin/reload", "", "Authorization", "Bearer "+step.token)
+		if w.Code != step.status {
+			t.Errorf("%s: reload status %d, want %d: %s", step.name, w.Code, step.status, w.Body)
+		}
+
+		var points struct{ Points int }
+		decode(t, send(h, http.MethodGet, "/receipts/"+process(t, h, targetReceipt)+"/points", ""), &points)
+		if points.Points != step.points {
+			t.Errorf("%s: receipt earned %d points, want %d", step.name, points.Points, step.points)
+		}
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	h := newTestServer(t, map[string]string{"MAX_RECEIPTS": "4", "STORE_FULL_MODE": "evict"})
+	walgreens := simpleReceipt("Walgreens", "2022-01-02", "08:13", "2.65")
+	kroger := simpleReceipt("Kroger", "2022-01-03", "09:00", "4.00")
+
+	steps := []struct {
+		name     string
+		body     string
+		header   []string
+		existing int // index of the created receipt answered with, or -1 for a new one
+	}{
+		{name: "first copy", body: targetReceipt, existing: -1},
+		{name: "conditional copy", body: targetReceipt, header: []string{"If-None-Match", "*"}, existing: 0},
+		{name: "unconditional copy", body: targetReceipt, existing: -1},
+		{name: "oldest copy answers", body: targetReceipt, header: []string{"If-None-Match", "*"}, existing: 0},
+		{name: "new content", body: walgreens, header: []string{"If-None-Match", "*"}, existing: -1},
+		{name: "conditional repeat", body: walgreens, header: []string{"If-None-Match", "*"}, existing: 2},
+		{name: "other header value", body: walgreens, header: []string{"If-None-Match", `"abc"`}, existing: -1},
+		{name: "evicting the first copy", body: kroger, existing: -1},
+		{name: "remaining copy answers", body: targetReceipt, header: []string{"If-None-Match", "*"}, existing: 1},
+	}
+
+	var created []string
+	for _, step := range steps {
+		w := send(h, http.MethodPost, "/receipts/process", step.body, step.header...)
+		var response struct{ ID string }
+		decode(t, w, &response)
+
+		if step.existing < 0 {
+			if w.Code != http.StatusCreated || slices.Contains(created, response.ID) {
+				t.Fatalf("%s: status %d with ID %s, want a new receipt", step.name, w.Code, response.ID)
+			}
+			created = append(created, response.ID)
+			continue
+		}
+
+		want := created[step.existing]
+		if w.Code != http.StatusOK || response.ID != want {
+			t.Errorf("%s: status %d with ID %s, want 200 with %s", step.name, w.Code, response.ID, want)
+		}
+		if got := w.Header().Get("Location"); got != "/receipts/"+want {
+			t.Errorf("%s: Location %q", step.name, got)
+		}
+	}
+}
+
+func TestRetailerAliases(t *testing.T) {
+	h := newTestServer(t, nil)
+	aliases := newRuleConfig(t, `{"retailerAliases": {"Wal-Mart": "Walmart", "Wally World": "Walmart"}}`)
+
+	tests := []struct {
+		name     string
+		rc       RuleConfig
+		retailer string
+		want     string
+		original string
+	}{
+		{name: "no aliases", rc: defaultRuleConfig(), retailer: "Wal-Mart", want: "Wal-Mart"},
+		{name: "alias", rc: aliases, retailer: "Wal-Mart", want: "Walmart", original: "Wal-Mart"},
+		{name: "alias spelled differently", rc: aliases, retailer: "WAL MART", want: "Walmart", original: "WAL MART"},
+		{name: "another alias", rc: aliases, retailer: "wally world", want: "Walmart", original: "wally world"},
+		{name: "canonical spelled differently", rc: aliases, retailer: "WALMART", want: "Walmart", original: "WALMART"},
+		{name: "canonical", rc: aliases, retailer: "Walmart", want: "Walmart"},
+		{name: "unaliased", rc: aliases, retailer: "Target", want: "Target"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			activateRuleConfig(t, tt.rc)
+			id := process(t, h, simpleReceipt(tt.retailer, "2022-01-01", "13:01", "1.00"))
+
+			var got struct{ Retailer, OriginalRetailer string }
+			decode(t, send(h, http.MethodGet, "/receipts/"+id, ""), &got)
+			if got.Retailer != tt.want || got.OriginalRetailer != tt.original {
+				t.Errorf("stored %q sent as %q, want %q sent as %q", got.Retailer, got.OriginalRetailer, tt.want, tt.original)
+			}
+		})
+	}
+}
+
+func TestItemsSum(t *testing.T) {
+	h := newTestServer(t, nil)
+	target := process(t, h, targetReceipt)
+	twoItems := process(t, h, `{"retailer": "Walgreens", "purchaseDate": "2022-01-02", "purchaseTime": "08:13", "total": "2.65",
+		"items": [{"shortDescription": "Pepsi - 12-oz", "price": "1.25"}, {"shortDescription": "Dasani", "price": "1.40"}]}`)
+
+	tests := []struct {
+		name  string
+		query string
+		want  *itemsSum
+	}{
+		{name: "left out by default", query: target},
+		{name: "not asked for", query: target + "?sum=false"},
+		{name: "many items", query: target + "?sum=true", want: &itemsSum{Cents: 3535, Formatted: "35.35"}},
+		{name: "two items", query: twoItems + "?sum=true", want: &itemsSum{Cents: 265, Formatted: "2.65"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct{ ItemsSum *itemsSum }
+			decode(t, send(h, http.MethodGet, "/receipts/"+tt.query, ""), &got)
+			if (got.ItemsSum == nil) != (tt.want == nil) || got.ItemsSum != nil && *got.ItemsSum != *tt.want {
+				t.Errorf("got %+v, want %+v", got.ItemsSum, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportReceipts(t *testing.T) {
+	h := newTestServer(t, nil)
+	clock = &tickingClock{now: storeEpoch}
+	target := process(t, h, targetReceipt)
+	comma := process(t, h, simpleReceipt("Smith, Jones & Co", "2022-01-02", "08:13", "2.65"))
+	quoted := process(t, h, simpleReceipt(`The \"Corner\" Shop`, "2022-01-03", "15:00", "1.00"))
+	formula := process(t, h, simpleReceipt(`=HYPERLINK(\"http://example.com\")`, "2022-01-04", "09:00", "1.00"))
+
+	w := send(h, http.MethodGet, "/receipts/export.csv", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type %q", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="receipts.csv"` {
+		t.Errorf("Content-Disposition %q", got)
+	}
+
+	for _, field := range []string{`"Smith, Jones & Co"`, `"The ""Corner"" Shop"`} {
+		if !strings.Contains(w.Body.String(), ","+field+",") {
+			t.Errorf("retailer not escaped as %s:\n%s", field, w.Body)
+		}
+	}
+
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"id", "retailer", "purchaseDate", "purchaseTime", "total", "points"},
+		{target, "Target", "2022-01-01", "13:01", "35.35", "28"},
+		{comma, "Smith, Jones & Co", "2022-01-02", "08:13", "2.65", "12"},
+		{quoted, `The "Corner" Shop`, "2022-01-03", "15:00", "1.00", "104"},
+		{formula, `'=HYPERLINK("http://example.com")`, "2022-01-04", "09:00", "1.00", "98"},
+	}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("got rows %q, want %q", rows, want)
+	}
+}
+
+func TestDisabledFeatures(t *testing.T) {
+	tests := []struct {
+		feature string
+		method  string
+		path    string
+		body    string
+	}{
+		{feature: "batch", method: http.MethodPost, path: "/receipts/points/batch", body: `[]`},
+		{feature: "batch", method: http.MethodPost, path: "/receipts/validate/batch", body: `[]`},
+		{feature: "preview", method: http.MethodPost, path: "/receipts/points", body: targetReceipt},
+		{feature: "search", method: http.MethodGet, path: "/receipts"},
+		{feature: "search", method: http.MethodGet, path: "/receipts/search?q=milk"},
+		{feature: "top", method: http.MethodGet, path: "/receipts/top"},
+		{feature: "async", method: http.MethodPost, path: "/receipts/process/async", body: `[]`},
+		{feature: "export", method: http.MethodGet, path: "/receipts/export.csv"},
+		{feature: "compare", method: http.MethodGet, path: "/receipts/compare"},
+		{feature: "schema", method: http.MethodGet, path: "/schema/receipt.json"},
+		{feature: "stats", method: http.MethodGet, path: "/stats"},
+		{feature: "admin", method: http.MethodPost, path: "/admin/reload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.feature+" "+tt.path, func(t *testing.T) {
+			for _, disabled := range []string{"", tt.feature, "export," + tt.feature} {
+				h := newTestServer(t, map[string]string{"DISABLED_FEATURES": disabled, "ADMIN_TOKEN": "secret"})
+				w := send(h, tt.method, tt.path, tt.body, "Authorization", "Bearer secret")
+				if disabled == "" && (w.Code == http.StatusNotFound || w.Code >= 500) {
+					t.Errorf("enabled: status %d: %s", w.Code, w.Body)
+				}
+				if disabled != "" && w.Code != http.StatusNotFound {
+					t.Errorf("disabled with %q: status %d, want 404", disabled, w.Code)
+				}
+			}
+		})
+	}
+
+	// Only the named features are switched off
+	h := newTestServer(t, map[string]string{"DISABLED_FEATURES": "export"})
+	if w := send(h, http.MethodGet, "/stats", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /stats with export disabled: status %d", w.Code)
+	}
+}
+
+func TestPutReceipt(t *testing.T) {
+	const id = "7fb1377b-b223-49d9-a31a-5a02701dd310"
+	walgreens := simpleReceipt("Walgreens", "2022-01-02", "08:13", "2.65")
+
+	type put struct {
+		id, body string
+		status   int
+	}
+	tests := []struct {
+		name      string
+		overwrite string
+		steps     []put
+		points    int // of the receipt stored at id afterwards, 0 when none is
+	}{
+		{
+			name:   "create",
+			steps:  []put{{id, targetReceipt, http.StatusCreated}},
+			points: 28,
+		},
+		{
+			name:   "conflict",
+			steps:  []put{{id, targetReceipt, http.StatusCreated}, {id, walgreens, http.StatusConflict}},
+			points: 28,
+		},
+		{
+			name: "overwrite allowed", overwrite: "true",
+			steps:  []put{{id, targetReceipt, http.StatusCreated}, {id, walgreens, http.StatusOK}},
+			points: 9,
+		},
+		{
+			name:  "not a UUID",
+			steps: []put{{"my-receipt", targetReceipt, http.StatusBadRequest}},
+		},
+		{
+			name:  "uppercase UUID",
+			steps: []put{{strings.ToUpper(id), targetReceipt, http.StatusBadRequest}},
+		},
+		{
+			name:  "braced UUID",
+			steps: []put{{"{" + id + "}", targetReceipt, http.StatusBadRequest}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, map[string]string{"ALLOW_OVERWRITE": tt.overwrite})
+			for i, step := range tt.steps {
+				w := send(h, http.MethodPut, "/receipts/"+step.id, step.body)
+				if w.Code != step.status {
+					t.Fatalf("PUT %d: status %d, want %d: %s", i+1, w.Code, step.status, w.Body)
+				}
+				if step.status < 300 {
+					if got := w.Header().Get("Location"); got != "/receipts/"+id {
+						t.Errorf("PUT %d: Location %q", i+1, got)
+					}
+				}
+			}
+
+			w := send(h, http.MethodGet, "/receipts/"+id+"/points", "")
+			if tt.points == 0 {
+				if w.Code != http.StatusNotFound {
+					t.Errorf("status %d for a receipt that shouldn't exist", w.Code)
+				}
+				return
+			}
+			var got struct{ Points int }
+			decode(t, w, &got)
+			if got.Points != tt.points {
+				t.Errorf("stored receipt has %d points, want %d", got.Points, tt.points)
+			}
+		})
+	}
+}
+
+// A one-item receipt carrying the given tags, as a raw JSON list
+func taggedReceipt(total, tags string) string {
+	return `{"tags": ` + tags + `,` + strings.TrimPrefix(simpleReceipt("Target", "2022-01-01", "13:01", total), "{")
+}
+
+func TestReceiptTags(t *testing.T) {
+	h := newTestServer(t, nil)
+	clock = &tickingClock{now: storeEpoch}
+	groceries := process(t, h, taggedReceipt("1.00", `["groceries"]`))
+	both := process(t, h, taggedReceipt("2.00", `["groceries", "work-trip"]`))
+	untagged := process(t, h, simpleReceipt("Target", "2022-01-01", "13:01", "3.00"))
+	work := process(t, h, taggedReceipt("4.00", `["work-trip"]`))
+
+	filters := []struct {
+		path string
+		want []string
+	}{
+		{path: "/receipts", want: []string{groceries, both, untagged, work}},
+		{path: "/receipts?tag=groceries", want: []string{groceries, both}},
+		{path: "/receipts?tag=work-trip", want: []string{both, work}},
+		{path: "/receipts?tag=Groceries", want: []string{}},
+		{path: "/receipts?tag=unused", want: []string{}},
+		{path: "/receipts/search?q=gatorade&tag=work-trip", want: []string{both, work}},
+		{path: "/receipts/search?q=gatorade&tag=unused", want: []string{}},
+	}
+	for _, tt := range filters {
+		var got struct{ IDs []string }
+		decode(t, send(h, http.MethodGet, tt.path, ""), &got)
+		if !slices.Equal(got.IDs, tt.want) {
+			t.Errorf("GET %s: got %q, want %q", tt.path, got.IDs, tt.want)
+		}
+	}
+
+	// Tags don't change scoring
+	var tagged, plain struct{ Points int }
+	decode(t, send(h, http.MethodGet, "/receipts/"+groceries+"/points", ""), &tagged)
+	decode(t, send(h, http.MethodPost, "/receipts/points", simpleReceipt("Target", "2022-01-01", "13:01", "1.00")), &plain)
+	if tagged.Points != plain.Points {
+		t.Errorf("tagged receipt earned %d points, untagged %d", tagged.Points, plain.Points)
+	}
+
+	validation := []struct {
+		name   string
+		tags   string
+		status int
+	}{
+		{name: "lowercase with digits and separators", tags: `["q3_2022", "a-b"]`, status: http.StatusCreated},
+		{name: "none", tags: `[]`, status: http.StatusCreated},
+		{name: "at the maximum count", tags: `["a","b","c","d","e","f","g","h","i","j"]`, status: http.StatusCreated},
+		{name: "too many", tags: `["a","b","c","d","e","f","g","h","i","j","k"]`, status: http.StatusBadRequest},
+		{name: "uppercase", tags: `["Groceries"]`, status: http.StatusBadRequest},
+		{name: "space", tags: `["work trip"]`, status: http.StatusBadRequest},
+		{name: "leading separator", tags: `["-work"]`, status: http.StatusBadRequest},
+		{name: "empty", tags: `[""]`, status: http.StatusBadRequest},
+		{name: "at the maximum length", tags: `["` + strings.Repeat("a", 32) + `"]`, status: http.StatusCreated},
+		{name: "too long", tags: `["` + strings.Repeat("a", 33) + `"]`, status: http.StatusBadRequest},
+	}
+	for _, tt := range validation {
+		if w := send(h, http.MethodPost, "/receipts/process", taggedReceipt("1.00", tt.tags)); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestPointsDebugTrace(t *testing.T) {
+	h := newTestServer(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	id := process(t, h, targetReceipt)
+
+	type step struct {
+		Rule     string
+		Enabled  bool
+		Settings map[string]any
+		Points   int
+	}
+	tests := []struct {
+		name       string
+		config     string
+		recomputed int
+		want       []step // checked against the trace entry for the same rule
+	}{
+		{
+			name: "defaults", config: `{}`, recomputed: 28,
+			want: []step{
+				{Rule: "items", Enabled: true, Settings: map[string]any{"itemPriceMultiplier": 0.2, "itemDescriptionDivisor": 3.0}, Points: 16},
+				{Rule: "promptSubmission", Settings: map[string]any{"promptSubmission": map[string]any{"withinHours": 0.0, "points": 0.0}}},
+			},
+		},
+		{
+			name: "tuned item price multiplier", config: `{"itemPriceMultiplier": 0.5}`, recomputed: 35,
+			want: []step{{Rule: "items", Enabled: true, Settings: map[string]any{"itemPriceMultiplier": 0.5}, Points: 23}},
+		},
+		{
+			name: "enabled rule earning nothing", config: `{"promptSubmission": {"withinHours": 24, "points": 5}}`, recomputed: 28,
+			want: []step{{Rule: "promptSubmission", Enabled: true, Settings: map[string]any{"promptSubmission": map[string]any{"withinHours": 24.0, "points": 5.0}}}},
+		},
+		{
+			name: "cap", config: `{"maxPoints": 20}`, recomputed: 20,
+			want: []step{{Rule: "maxPoints", Enabled: true, Settings: map[string]any{"maxPoints": 20.0}, Points: -8}},
+		},
+		{
+			name: "short circuit", config: `{"maxPoints": 10, "shortCircuit": true}`, recomputed: 10,
+			want: []step{
+				{Rule: "retailer", Enabled: true, Points: 6},
+				{Rule: "items", Enabled: true, Points: 4},
+				{Rule: "purchaseDate", Enabled: true, Points: 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			activateRuleConfig(t, newRuleConfig(t, tt.config))
+
+			var got struct {
+				Debug struct {
+					StoredPoints, RecomputedPoints int
+					Trace                          []step
+				}
+			}
+			decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points?debug=true", "", "Authorization", "Bearer secret"), &got)
+			if got.Debug.StoredPoints != 28 || got.Debug.RecomputedPoints != tt.recomputed {
+				t.Errorf("stored %d, recomputed %d; want 28, %d", got.Debug.StoredPoints, got.Debug.RecomputedPoints, tt.recomputed)
+			}
+
+			for _, want := range tt.want {
+				i := slices.IndexFunc(got.Debug.Trace, func(s step) bool { return s.Rule == want.Rule })
+				if i < 0 {
+					t.Errorf("no trace for %s", want.Rule)
+					continue
+				}
+				traced := got.Debug.Trace[i]
+				if traced.Enabled != want.Enabled || traced.Points != want.Points {
+					t.Errorf("%s: enabled %v with %d points, want %v with %d", want.Rule, traced.Enabled, traced.Points, want.Enabled, want.Points)
+				}
+				for key, value := range want.Settings {
+					if !reflect.DeepEqual(traced.Settings[key], value) {
+						t.Errorf("%s: setting %s is %v, want %v", want.Rule, key, traced.Settings[key], value)
+					}
+				}
+			}
+		})
+	}
+
+	for _, header := range [][]string{nil, {"Authorization", "Bearer wrong"}} {
+		if w := send(h, http.MethodGet, "/receipts/"+id+"/points?debug=true", "", header...); w.Code != http.StatusUnauthorized {
+			t.Errorf("debug trace with %q: status %d, want 401", header, w.Code)
+		}
+	}
+}
+
+func TestRejectedPointsRequestsLeaveNoTrace(t *testing.T) {
+	h := newTestServer(t, map[string]string{"ADMIN_TOKEN": "secret", "POINTS_HISTORY": "3", "JWT_SECRET": ""})
+	id := process(t, h, targetReceipt)
+
+	// Recomputing under these rules would record new points
+	activateRuleConfig(t, newRuleConfig(t, `{"itemPriceMultiplier": 0.5}`))
+	lookups := atomic.LoadInt64(&pointsLookups)
+
+	tests := []struct {
+		name   string
+		query  string
+		header []string
+		status int
+	}{
+		{name: "debug without a token", query: "?recompute=true&debug=true", status: http.StatusUnauthorized},
+		{name: "debug with a wrong token", query: "?recompute=true&debug=true", header: []string{"Authorization", "Bearer wrong"}, status: http.StatusUnauthorized},
+		{name: "JWT not enabled", query: "?recompute=true&format=jwt", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := send(h, http.MethodGet, "/receipts/"+id+"/points"+tt.query, "", tt.header...); w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			var history struct{ History []pointsRecord }
+			decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points/history", ""), &history)
+			if len(history.History) != 1 {
+				t.Errorf("history %+v after a rejected request", history.History)
+			}
+			if got := atomic.LoadInt64(&pointsLookups); got != lookups {
+				t.Errorf("%d lookups after a rejected request, was %d", got, lookups)
+			}
+		})
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	h := newTestServer(t, map[string]string{"MAX_VALIDATE_BATCH": "3", "MAX_ITEMS": "5"})
+	mismatched := strings.Replace(targetReceipt, `"35.35"`, `"40.00"`, 1)
+
+	type response struct {
+		Results        []validationResult
+		Valid, Invalid int
+	}
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   response
+	}{
+		{
+			name: "all valid", body: `[` + targetReceipt + `]`, status: http.StatusOK,
+			want: response{Results: []validationResult{{Index: 0, Valid: true}}, Valid: 1},
+		},
+		{
+			name: "mixed", body: `[` + targetReceipt + `, ` + mismatched + `, ` + itemsBody(6) + `]`, status: http.StatusMultiStatus,
+			want: response{
+				Results: []validationResult{
+					{Index: 0, Valid: true},
+					{Index: 1, Description: "The receipt is invalid.", Errors: []string{"total 40.00 does not match the sum of item prices 35.35, a difference of 4.65"}},
+					{Index: 2, Description: "A receipt may have at most 5 items."},
+				},
+				Valid: 1, Invalid: 2,
+			},
+		},
+		{
+			name: "all invalid", body: `[{"retailer": ""}]`, status: http.StatusBadRequest,
+			want: response{Results: []validationResult{{Index: 0, Description: "The receipt is invalid."}}, Invalid: 1},
+		},
+		{name: "empty", body: `[]`, status: http.StatusOK, want: response{Results: []validationResult{}}},
+		{name: "too many", body: `[{}, {}, {}, {}]`, status: http.StatusBadRequest},
+		{name: "not an array", body: targetReceipt, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, http.MethodPost, "/receipts/validate/batch", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.want.Results == nil {
+				return
+			}
+
+			var got response
+			decode(t, w, &got)
+			// Schema errors are too many to spell out, so they are left unchecked
+			for i := range got.Results {
+				if i < len(tt.want.Results) && tt.want.Results[i].Errors == nil {
+					got.Results[i].Errors = nil
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if got := receipts.Len(); got != 0 {
+		t.Errorf("validation stored %d receipts", got)
+	}
+}
+
+func TestValidateBatchStatus(t *testing.T) {
+	h := newTestServer(t, nil)
+	activateRuleConfig(t, newRuleConfig(t, `{"warnings": {"totalAboveCents": 1000}}`))
+	valid := simpleReceipt("Target", "2022-01-01", "13:01", "1.00")
+	warned := targetReceipt
+	invalid := strings.Replace(targetReceipt, `"35.35"`, `"40.00"`, 1)
+	malformed := `{"retailer": ""}`
+
+	tests := []struct {
+		name     string
+		receipts []string
+		status   int
+	}{
+		{name: "all valid", receipts: []string{valid, valid}, status: http.StatusOK},
+		{name: "valid with warnings", receipts: []string{valid, warned}, status: http.StatusOK},
+		{name: "all invalid", receipts: []string{invalid, malformed}, status: http.StatusBadRequest},
+		{name: "valid first", receipts: []string{valid, invalid}, status: http.StatusMultiStatus},
+		{name: "invalid first", receipts: []string{malformed, warned}, status: http.StatusMultiStatus},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, http.MethodPost, "/receipts/validate/batch", "["+strings.Join(tt.receipts, ",")+"]")
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestPanickingRule(t *testing.T) {
+	builtIn := rules
+	t.Cleanup(func() { rules = builtIn })
+	rules = slices.Clone(builtIn)
+	RegisterRule("fragile", func(r Receipt) int {
+		if r.Retailer == "Boom" {
+			panic("unexpected retailer")
+		}
+		return 1
+	})
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	h := newTestServer(t, nil)
+	tests := []struct {
+		name     string
+		retailer string
+		want     int
+		fragile  ruleScore // the custom rule's contribution
+	}{
+		{name: "rule runs", retailer: "Target", want: 88, fragile: ruleScore{Rule: "fragile", Points: 1, Description: `1 point from the custom rule "fragile"`}},
+		{name: "rule panics", retailer: "Boom", want: 85, fragile: ruleScore{Rule: "fragile", Description: "No points because the rule failed on this receipt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := process(t, h, simpleReceipt(tt.retailer, "2022-01-01", "13:01", "1.00"))
+
+			var got struct {
+				Points    int
+				Breakdown []ruleScore
+			}
+			decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points?breakdown=true", ""), &got)
+			if got.Points != tt.want {
+				t.Errorf("got %d points, want %d", got.Points, tt.want)
+			}
+			if !slices.Contains(got.Breakdown, tt.fragile) {
+				t.Errorf("breakdown %+v is missing %+v", got.Breakdown, tt.fragile)
+			}
+			if panicked := strings.Contains(logged.String(), `rule "fragile" panicked scoring receipt `+id); panicked != (tt.retailer == "Boom") {
+				t.Errorf("panic logged: %v, log: %s", panicked, logged.String())
+			}
+		})
+	}
+
+	// Recomputing several receipts at once still scores the rest
+	boom := process(t, h, simpleReceipt("Boom", "2022-01-01", "13:01", "1.00"))
+	target := process(t, h, targetReceipt)
+	var compared struct {
+		A, B       struct{ Points int }
+		Difference int
+	}
+	decode(t, send(h, http.MethodGet, "/receipts/compare?recompute=true&a="+boom+"&b="+target, ""), &compared)
+	if compared.A.Points != 85 || compared.B.Points != 29 || compared.Difference != 56 {
+		t.Errorf("recomputed %+v", compared)
+	}
+}
+
+// The README Target receipt with its items grouped under two departments
+const departmentsReceipt = `{
+	"retailer": "Target",
+	"purchaseDate": "2022-01-01",
+	"purchaseTime": "13:01",
+	"departments": [
+		{"name": "Drinks", "items": [
+			{"shortDescription": "Mountain Dew 12PK", "price": "6.49"},
+			{"shortDescription": "   Klarbrunn 12-PK 12 FL OZ  ", "price": "12.00"}
+		]},
+		{"name": "Food", "items": [
+			{"shortDescription": "Emils Cheese Pizza", "price": "12.25"},
+			{"shortDescription": "Knorr Creamy Chicken", "price": "1.26"},
+			{"shortDescription": "Doritos Nacho Cheese", "price": "3.35"}
+		]}
+	],
+	"total": "35.35"
+}`
+
+func TestDepartments(t *testing.T) {
+	h := newTestServer(t, map[string]string{"MAX_ITEMS": "6"})
+	flat := process(t, h, targetReceipt)
+	nested := process(t, h, departmentsReceipt)
+
+	type points struct {
+		Points    int
+		Breakdown []ruleScore
+	}
+	var flatPoints, nestedPoints points
+	decode(t, send(h, http.MethodGet, "/receipts/"+flat+"/points?breakdown=true", ""), &flatPoints)
+	decode(t, send(h, http.MethodGet, "/receipts/"+nested+"/points?breakdown=true", ""), &nestedPoints)
+	if nestedPoints.Points != 28 || !reflect.DeepEqual(nestedPoints, flatPoints) {
+		t.Errorf("nested receipt scored %+v, flat one %+v", nestedPoints, flatPoints)
+	}
+
+	var stored Receipt
+	decode(t, send(h, http.MethodGet, "/receipts/"+nested, ""), &stored)
+	if len(stored.Items) != 5 || len(stored.Departments) != 2 || stored.Departments[0].Name != "Drinks" || len(stored.Departments[1].Items) != 3 {
+		t.Errorf("stored %+v", stored)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "items and departments", body: strings.Replace(departmentsReceipt, `"departments"`, `"items": [{"shortDescription": "Gum", "price": "1.00"}], "departments"`, 1), status: http.StatusBadRequest},
+		{name: "invalid nested price", body: strings.Replace(departmentsReceipt, `"3.35"`, `"3.3.5"`, 1), status: http.StatusBadRequest},
+		{name: "nested total mismatch", body: strings.Replace(departmentsReceipt, `"3.35"`, `"4.35"`, 1), status: http.StatusUnprocessableEntity},
+		{name: "empty department", body: strings.Replace(departmentsReceipt, `{"name": "Food", "items": [`, `{"name": "Empty", "items": []}, {"name": "Food", "items": [`, 1), status: http.StatusBadRequest},
+		{
+			name: "too many items across departments", status: http.StatusUnprocessableEntity,
+			body: strings.Replace(departmentsReceipt, `{"name": "Food", "items": [`, `{"name": "Gum", "items": [{"shortDescription": "Gum", "price": "0.00"}, {"shortDescription": "Gum", "price": "0.00"}]}, {"name": "Food", "items": [`, 1),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := send(h, http.MethodPost, "/receipts/process", tt.body); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestPointsHistory(t *testing.T) {
+	h := newTestServer(t, map[string]string{"POINTS_HISTORY": "3"})
+	clock = &tickingClock{now: storeEpoch}
+	id := process(t, h, targetReceipt)
+	initial := newRuleConfig(t, `{}`)
+	tuned := newRuleConfig(t, `{"itemPriceMultiplier": 0.5}`)
+	capped := newRuleConfig(t, `{"maxPoints": 20}`)
+
+	steps := []struct {
+		name string
+		rc   *RuleConfig // made active before recomputing, if any
+		want []int       // points in the history afterwards
+	}{
+		{name: "processed", want: []int{28}},
+		{name: "same rules", rc: &initial, want: []int{28}},
+		{name: "new rules", rc: &tuned, want: []int{28, 35}},
+		{name: "unchanged since", want: []int{28, 35}},
+		{name: "capped", rc: &capped, want: []int{28, 35, 20}},
+		{name: "oldest dropped", rc: &initial, want: []int{35, 20, 28}},
+	}
+
+	versions := map[int]string{}
+	for _, step := range steps {
+		if step.rc != nil {
+			activateRuleConfig(t, *step.rc)
+			w := send(h, http.MethodGet, "/receipts/"+id+"/points?recompute=true", "")
+			var recomputed struct{ Points int }
+			decode(t, w, &recomputed)
+			versions[recomputed.Points] = w.Header().Get("X-Rule-Config-Version")
+		}
+
+		var got struct {
+			ID      string
+			History []pointsRecord
+		}
+		decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points/history", ""), &got)
+
+		points := make([]int, len(got.History))
+		for i, record := range got.History {
+			points[i] = record.Points
+			if i > 0 && !record.At.After(got.History[i-1].At) {
+				t.Errorf("%s: history out of order: %+v", step.name, got.History)
+			}
+			if version, seen := versions[record.Points]; seen && record.ConfigVersion != version {
+				t.Errorf("%s: %d points recorded under %q, want %q", step.name, record.Points, record.ConfigVersion, version)
+			}
+		}
+		if got.ID != id || !slices.Equal(points, step.want) {
+			t.Errorf("%s: history of %s has points %v, want %v", step.name, got.ID, points, step.want)
+		}
+	}
+
+	// Without POINTS_HISTORY there is nothing to expose
+	h = newTestServer(t, map[string]string{"POINTS_HISTORY": "0"})
+	id = process(t, h, targetReceipt)
+	if w := send(h, http.MethodGet, "/receipts/"+id+"/points/history", ""); w.Code != http.StatusNotFound {
+		t.Errorf("history without POINTS_HISTORY: status %d", w.Code)
+	}
+}
+
+func TestPointsForRule(t *testing.T) {
+	h := newTestServer(t, nil)
+	id := process(t, h, targetReceipt)
+
+	var full struct{ Breakdown []ruleScore }
+	decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points?breakdown=true", ""), &full)
+
+	tests := []struct {
+		rule   string
+		status int
+		points int
+	}{
+		{rule: "retailer", status: http.StatusOK, points: 6},
+		{rule: "total", status: http.StatusOK, points: 0},
+		{rule: "items", status: http.StatusOK, points: 16},
+		{rule: "purchaseDate", status: http.StatusOK, points: 6},
+		{rule: "purchaseTime", status: http.StatusOK, points: 0},
+		{rule: "promptSubmission", status: http.StatusOK, points: 0},
+		{rule: "Items", status: http.StatusBadRequest},
+		{rule: "bogus", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			w := send(h, http.MethodGet, "/receipts/"+id+"/points?rule="+tt.rule, "")
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var got ruleScore
+			decode(t, w, &got)
+			if got.Rule != tt.rule || got.Points != tt.points {
+				t.Errorf("got %+v, want %d points", got, tt.points)
+			}
+			// Enabled rules match their entry in the full breakdown
+			if i := slices.IndexFunc(full.Breakdown, func(s ruleScore) bool { return s.Rule == tt.rule }); i >= 0 && got != full.Breakdown[i] {
+				t.Errorf("got %+v, breakdown has %+v", got, full.Breakdown[i])
+			}
+		})
+	}
+
+	if w := send(h, http.MethodGet, "/receipts/missing/points?rule=items", ""); w.Code != http.StatusNotFound {
+		t.Errorf("missing receipt: status %d", w.Code)
+	}
+}
+
+func TestTopReceipts(t *testing.T) {
+	h := newTestServer(t, nil)
+	clock = &tickingClock{now: storeEpoch}
+	target := process(t, h, targetReceipt)
+	walgreens := process(t, h, simpleReceipt("Walgreens", "2022-01-02", "08:13", "2.65"))
+	round := process(t, h, simpleReceipt("Corner Shop", "2022-01-01", "15:00", "1.00"))
+
+	type entry struct {
+		ID, Retailer string
+		Points       int
+	}
+	tests := []struct {
+		query  string
+		status int
+		want   []entry
+	}{
+		{query: "", status: http.StatusOK, want: []entry{{round, "Corner Shop", 101}, {target, "Target", 28}, {walgreens, "Walgreens", 9}}},
+		{query: "?n=2", status: http.StatusOK, want: []entry{{round, "Corner Shop", 101}, {target, "Target", 28}}},
+		{query: "?n=100", status: http.StatusOK, want: []entry{{round, "Corner Shop", 101}, {target, "Target", 28}, {walgreens, "Walgreens", 9}}},
+		{query: "?n=0", status: http.StatusBadRequest},
+		{query: "?n=101", status: http.StatusBadRequest},
+		{query: "?n=ten", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		w := send(h, http.MethodGet, "/receipts/top"+tt.query, "")
+		if w.Code != tt.status {
+			t.Errorf("GET /receipts/top%s: status %d, want %d", tt.query, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var got struct{ Receipts []entry }
+		decode(t, w, &got)
+		if !slices.Equal(got.Receipts, tt.want) {
+			t.Errorf("GET /receipts/top%s: got %+v, want %+v", tt.query, got.Receipts, tt.want)
+		}
+	}
+}
+
+func TestRawReceipt(t *testing.T) {
+	// Formatting, an unknown field, a numeric total and an alias all survive in the raw copy
+	body := "{\n  \"retailer\":  \"Tgt\",\n  \"purchaseDate\": \"2022-01-01\", \"purchaseTime\": \"13:01\",\n" +
+		"  \"items\": [{\"shortDescription\": \"Gatorade\", \"price\": \"6.49\"}],\n  \"total\": 6.49,\n  \"storeNumber\": 42\n}"
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string // empty when the raw body isn't kept
+	}{
+		{name: "not kept by default", env: map[string]string{"NUMERIC_AMOUNTS": "true"}},
+		{name: "kept", env: map[string]string{"NUMERIC_AMOUNTS": "true", "STORE_RAW_BYTES": "1024"}, want: body},
+		{name: "kept at the limit", env: map[string]string{"NUMERIC_AMOUNTS": "true", "STORE_RAW_BYTES": strconv.Itoa(len(body))}, want: body},
+		{name: "over the limit", env: map[string]string{"NUMERIC_AMOUNTS": "true", "STORE_RAW_BYTES": strconv.Itoa(len(body) - 1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, tt.env)
+			activateRuleConfig(t, newRuleConfig(t, `{"retailerAliases": {"Tgt": "Target"}}`))
+			id := process(t, h, body)
+
+			w := send(h, http.MethodGet, "/receipts/"+id+"?raw=true", "")
+			if tt.want == "" {
+				if w.Code != http.StatusNotFound {
+					t.Errorf("status %d, want %d", w.Code, http.StatusNotFound)
+				}
+				return
+			}
+			if w.Code != http.StatusOK || w.Body.String() != tt.want {
+				t.Fatalf("status %d: %q, want %q", w.Code, w.Body, tt.want)
+			}
+
+			// The parsed receipt is normalized all the same
+			var got struct {
+				Retailer         string
+				Total            string
+				OriginalRetailer string
+			}
+			decode(t, send(h, http.MethodGet, "/receipts/"+id, ""), &got)
+			if got.Retailer != "Target" || got.OriginalRetailer != "Tgt" || got.Total != "6.49" {
+				t.Errorf("parsed receipt %+v", got)
+			}
+		})
+	}
+}
+
+func TestReceiptWarnings(t *testing.T) {
+	checks := `{"warnings": {"totalAboveCents": 1000, "descriptionPattern": "^[A-Za-z0-9 ]+$"}}`
+
+	tests := []struct {
+		name   string
+		config string
+		body   string
+		want   []string
+	}{
+		{name: "no checks", config: `{}`, body: simpleReceipt("Target", "2022-01-01", "13:01", "500.00")},
+		{name: "usual receipt", config: checks, body: simpleReceipt("Target", "2022-01-01", "13:01", "10.00")},
+		{name: "unusual total", config: checks, body: simpleReceipt("Target", "2022-01-01", "13:01", "10.01"), want: []string{"total 10.01 is above 10.00"}},
+		{
+			name: "odd descriptions", config: checks,
+			body: `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "total": "2.00",
+				"items": [{"shortDescription": " Gum ", "price": "1.00"}, {"shortDescription": "M&M's", "price": "1.00"}]}`,
+			want: []string{`items[1].shortDescription "M&M's" does not match ^[A-Za-z0-9 ]+$`},
+		},
+		{
+			name: "several warnings", config: checks,
+			body: `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "total": "99.99",
+				"items": [{"shortDescription": "Gift card!", "price": "99.99"}]}`,
+			want: []string{"total 99.99 is above 10.00", `items[0].shortDescription "Gift card!" does not match ^[A-Za-z0-9 ]+$`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, nil)
+			activateRuleConfig(t, newRuleConfig(t, tt.config))
+
+			w := send(h, http.MethodPost, "/receipts/process", tt.body)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var got struct {
+				ID       string
+				Warnings []string
+			}
+			decode(t, w, &got)
+			if !slices.Equal(got.Warnings, tt.want) {
+				t.Errorf("warnings %q, want %q", got.Warnings, tt.want)
+			}
+			if w := send(h, http.MethodGet, "/receipts/"+got.ID, ""); w.Code != http.StatusOK {
+				t.Errorf("stored receipt: status %d", w.Code)
+			}
+		})
+	}
+
+	if _, err := parseRuleConfig([]byte(`{"warnings": {"descriptionPattern": "("}}`), "test config"); err == nil {
+		t.Error("an invalid description pattern was accepted")
+	}
+}
+
+func TestRewardsRate(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		query string
+		want  string // the rate as JSON, empty when it is left out
+	}{
+		{name: "not asked for", body: targetReceipt, query: ""},
+		{name: "known receipt", body: targetReceipt, query: "?rate=true", want: `{"percent":"79.21%","pointsPerDollar":0.7921}`},
+		{name: "more points than dollars", body: simpleReceipt("Walgreens", "2022-01-02", "08:13", "2.65"), query: "?rate=true", want: `{"percent":"339.62%","pointsPerDollar":3.3962}`},
+		{name: "zero total", body: simpleReceipt("Target", "2022-01-01", "13:01", "0.00"), query: "?rate=true", want: `null`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, nil)
+			id := process(t, h, tt.body)
+
+			w := send(h, http.MethodGet, "/receipts/"+id+"/points"+tt.query, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var got map[string]json.RawMessage
+			decode(t, w, &got)
+			rate, found := got["rate"]
+			if tt.want == "" {
+				if found {
+					t.Errorf("unexpected rate %s", rate)
+				}
+				return
+			}
+			if string(rate) != tt.want {
+				t.Errorf("rate %s, want %s", rate, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	h := newTestServer(t, map[string]string{"RECEIPT_COUNT_HEADER": "true", "POINTS_HISTORY": "3"})
+	id := process(t, h, targetReceipt)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	// Sends the request with a fixed request ID, so only timing headers differ
+	do := func(method, path string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.Header.Set("X-Request-ID", "req-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		resp.Header.Del("Date")
+		resp.Header.Del("X-Response-Time")
+		return resp, string(body)
+	}
+
+	for _, path := range []string{
+		"/receipts/" + id,
+		"/receipts/" + id + "/points",
+		"/receipts/" + id + "/points?recompute=true",
+		"/receipts/" + id + "/points?rule=retailer",
+		"/receipts/missing",
+		"/receipts/missing/points",
+	} {
+		t.Run(path, func(t *testing.T) {
+			lookups := atomic.LoadInt64(&pointsLookups)
+			head, body := do(http.MethodHead, path)
+			if body != "" {
+				t.Errorf("HEAD body %q", body)
+			}
+			if got := atomic.LoadInt64(&pointsLookups); got != lookups {
+				t.Errorf("HEAD counted as a lookup, %d lookups after %d", got, lookups)
+			}
+
+			get, _ := do(http.MethodGet, path)
+			if head.StatusCode != get.StatusCode {
+				t.Errorf("HEAD status %d, GET %d", head.StatusCode, get.StatusCode)
+			}
+			if !reflect.DeepEqual(head.Header, get.Header) {
+				t.Errorf("HEAD headers %v, GET %v", head.Header, get.Header)
+			}
+			if got := head.Header.Get("X-Receipt-Count"); got != "1" {
+				t.Errorf("X-Receipt-Count %q, want %q", got, "1")
+			}
+		})
+	}
+
+	// Recomputing under new rules over HEAD leaves no history, unlike GET
+	activateRuleConfig(t, newRuleConfig(t, `{"itemPriceMultiplier": 0.5}`))
+	for i, method := range []string{http.MethodHead, http.MethodGet} {
+		do(method, "/receipts/"+id+"/points?recompute=true")
+		var history struct{ History []pointsRecord }
+		decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points/history", ""), &history)
+		if len(history.History) != i+1 {
+			t.Errorf("after %s, history %+v, want %d records", method, history.History, i+1)
+		}
+	}
+}
+
+func TestStreakPoints(t *testing.T) {
+	h := newTestServer(t, nil)
+	clock = &tickingClock{now: storeEpoch}
+	activateRuleConfig(t, newRuleConfig(t, `{"streakPoints": 5}`))
+
+	streakOf := func(id, query string) ruleScore {
+		t.Helper()
+		var response struct{ Breakdown []ruleScore }
+		decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points?breakdown=true"+query, ""), &response)
+		i := slices.IndexFunc(response.Breakdown, func(s ruleScore) bool { return s.Rule == "streak" })
+		if i < 0 {
+			t.Fatalf("no streak in breakdown %+v", response.Breakdown)
+		}
+		return response.Breakdown[i]
+	}
+
+	// Processed in order, each scored against the receipts stored before it
+	steps := []struct {
+		name     string
+		retailer string
+		date     string
+		want     int
+	}{
+		{name: "first day", retailer: "Target", date: "2022-01-01", want: 0},
+		{name: "second day", retailer: "Target", date: "2022-01-02", want: 5},
+		{name: "third day", retailer: "Target", date: "2022-01-03", want: 5},
+		{name: "third day again", retailer: "Target", date: "2022-01-03", want: 0},
+		{name: "after a gap", retailer: "Target", date: "2022-01-05", want: 0},
+		{name: "other retailer", retailer: "Walgreens", date: "2022-01-04", want: 0},
+		{name: "filling the gap", retailer: "Target", date: "2022-01-04", want: 5},
+	}
+
+	ids := map[string]string{}
+	for _, step := range steps {
+		id := process(t, h, simpleReceipt(step.retailer, step.date, "13:01", "1.00"))
+		ids[step.name] = id
+		if got := streakOf(id, ""); got.Points != step.want {
+			t.Errorf("%s: %+v, want %d points", step.name, got, step.want)
+		}
+	}
+
+	want := ruleScore{Rule: "streak", Points: 5, Description: `5 points because this extends a streak of daily receipts for "Target"`}
+	if got := streakOf(ids["second day"], ""); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// The day before was stored later, so recomputing doesn't award the streak
+	if got := streakOf(ids["after a gap"], "&recompute=true"); got.Points != 0 {
+		t.Errorf("recomputed after the gap was filled: %+v", got)
+	}
+}
+
+func TestReceiptXML(t *testing.T) {
+	h := newTestServer(t, nil)
+	id := process(t, h, targetReceipt)
+
+	tests := []struct {
+		accept      string
+		status      int
+		contentType string
+	}{
+		{accept: "", status: http.StatusOK, contentType: "application/json; charset=utf-8"},
+		{accept: "*/*", status: http.StatusOK, contentType: "application/json; charset=utf-8"},
+		{accept: "application/json", status: http.StatusOK, contentType: "application/json; charset=utf-8"},
+		{accept: "application/xml", status: http.StatusOK, contentType: "application/xml; charset=utf-8"},
+		{accept: "text/xml", status: http.StatusOK, contentType: "application/xml; charset=utf-8"},
+		{accept: "application/xml, application/json", status: http.StatusOK, contentType: "application/xml; charset=utf-8"},
+		{accept: "text/html", status: http.StatusNotAcceptable, contentType: "application/json; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			w := send(h, http.MethodGet, "/receipts/"+id, "", "Accept", tt.accept)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type %q, want %q", got, tt.contentType)
+			}
+		})
+	}
+
+	// Both representations carry the same receipt
+	for name, body := range map[string]string{
+		"plain":       targetReceipt,
+		"tagged":      taggedReceipt("1.00", `["groceries", "work-trip"]`),
+		"departments": departmentsReceipt,
+	} {
+		t.Run(name, func(t *testing.T) {
+			id := process(t, h, body)
+
+			var fromJSON receiptResponse
+			decode(t, send(h, http.MethodGet, "/receipts/"+id+"?sum=true", ""), &fromJSON)
+
+			w := send(h, http.MethodGet, "/receipts/"+id+"?sum=true", "", "Accept", "application/xml")
+			if !strings.HasPrefix(w.Body.String(), "<receipt>") {
+				t.Errorf("XML body %s", w.Body)
+			}
+			var fromXML receiptResponse
+			if err := xml.Unmarshal(w.Body.Bytes(), &fromXML); err != nil {
+				t.Fatalf("decoding %s: %v", w.Body, err)
+			}
+			if fromXML.XMLTags != nil {
+				fromXML.Tags = fromXML.XMLTags.Tags
+			}
+			if fromXML.XMLDepartments != nil {
+				fromXML.Departments = fromXML.XMLDepartments.Departments
+			}
+			fromXML.XMLName, fromXML.XMLTags, fromXML.XMLDepartments = xml.Name{}, nil, nil
+
+			if fromJSON.ID != id || !reflect.DeepEqual(fromJSON, fromXML) {
+				t.Errorf("JSON %+v\nXML  %+v", fromJSON, fromXML)
+			}
+		})
+	}
+}
+
+func TestDeriveTotal(t *testing.T) {
+	omitted := strings.Replace(targetReceipt, `,
+	"total": "35.35"`, "", 1)
+	mismatched := strings.Replace(targetReceipt, `"35.35"`, `"40.00"`, 1)
+	unparsable := strings.Replace(omitted, `"6.49"`, `"six"`, 1)
+
+	tests := []struct {
+		name   string
+		derive string
+		body   string
+		status int
+		total  string // stored, when the receipt is accepted
+	}{
+		{name: "strict, omitted", derive: "false", body: omitted, status: http.StatusBadRequest},
+		{name: "strict, sent", derive: "false", body: targetReceipt, status: http.StatusCreated, total: "35.35"},
+		{name: "lenient, omitted", derive: "true", body: omitted, status: http.StatusCreated, total: "35.35"},
+		{name: "lenient, sent", derive: "true", body: targetReceipt, status: http.StatusCreated, total: "35.35"},
+		{name: "lenient, mismatched", derive: "true", body: mismatched, status: http.StatusUnprocessableEntity},
+		{name: "lenient, null", derive: "true", body: strings.Replace(targetReceipt, `"35.35"`, `null`, 1), status: http.StatusBadRequest},
+		{name: "lenient, unparsable price", derive: "true", body: unparsable, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, map[string]string{"DERIVE_TOTAL": tt.derive})
+
+			w := send(h, http.MethodPost, "/receipts/process", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.total == "" {
+				return
+			}
+
+			var created struct{ ID string }
+			decode(t, w, &created)
+			var stored struct{ Total string }
+			decode(t, send(h, http.MethodGet, "/receipts/"+created.ID, ""), &stored)
+			var points struct{ Points int }
+			decode(t, send(h, http.MethodGet, "/receipts/"+created.ID+"/points", ""), &points)
+			if stored.Total != tt.total || points.Points != 28 {
+				t.Errorf("stored total %q with %d points, want %q with 28", stored.Total, points.Points, tt.total)
+			}
+		})
+	}
+}
+
+func TestPreviewOverride(t *testing.T) {
+	h := newTestServer(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	global := currentRuleConfig()
+	tuned := newRuleConfig(t, `{"itemPriceMultiplier": 0.5}`)
+
+	tests := []struct {
+		name    string
+		header  []string
+		status  int
+		points  int
+		version string
+	}{
+		{name: "no override", status: http.StatusOK, points: 28, version: global.version},
+		{name: "override", header: []string{"X-Rule-Config", `{"itemPriceMultiplier": 0.5}`, "Authorization", "Bearer secret"}, status: http.StatusOK, points: 35, version: tuned.version},
+		{name: "without a token", header: []string{"X-Rule-Config", `{"itemPriceMultiplier": 0.5}`}, status: http.StatusUnauthorized},
+		{name: "with a wrong token", header: []string{"X-Rule-Config", `{"itemPriceMultiplier": 0.5}`, "Authorization", "Bearer guess"}, status: http.StatusUnauthorized},
+		{name: "invalid override", header: []string{"X-Rule-Config", `{"itemPriceMultiplier": -1}`, "Authorization", "Bearer secret"}, status: http.StatusUnprocessableEntity},
+		{name: "unknown setting", header: []string{"X-Rule-Config", `{"bonus": 5}`, "Authorization", "Bearer secret"}, status: http.StatusUnprocessableEntity},
+		{name: "no override afterwards", status: http.StatusOK, points: 28, version: global.version},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, http.MethodPost, "/receipts/points", targetReceipt, tt.header...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got struct{ Points int }
+			decode(t, w, &got)
+			if got.Points != tt.points || w.Header().Get("X-Rule-Config-Version") != tt.version {
+				t.Errorf("got %d points under %q, want %d under %q", got.Points, w.Header().Get("X-Rule-Config-Version"), tt.points, tt.version)
+			}
+		})
+	}
+
+	// The global config is untouched, and previews store nothing
+	if currentRuleConfig().version != global.version || receipts.Len() != 0 {
+		t.Errorf("config %q and %d receipts after previews", currentRuleConfig().version, receipts.Len())
+	}
+}
+
+func TestDeterministicPages(t *testing.T) {
+	h := newTestServer(t, nil)
+	descriptions := []string{"Whole Milk", "Oat Milk", "Milk Chocolate", "Bread", "Skim milk", "Almond Milk"}
+
+	// Two batches stored at the same instant each, so ties fall back to the ID. The
+	// second batch is stored earlier, so it comes first.
+	var milk, all []string
+	for batch, at := range []time.Time{storeEpoch.Add(time.Minute), storeEpoch} {
+		clock = fixedClock(at)
+		var batchMilk, batchAll []string
+		for i, description := range descriptions {
+			body := strings.Replace(taggedReceipt(fmt.Sprintf("%d.00", batch*10+i+1), `["dairy"]`), "Gatorade", description, 1)
+			id := process(t, h, body)
+			batchAll = append(batchAll, id)
+			if description != "Bread" {
+				batchMilk = append(batchMilk, id)
+			}
+		}
+		slices.Sort(batchMilk)
+		slices.Sort(batchAll)
+		milk, all = append(batchMilk, milk...), append(batchAll, all...)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "/receipts/search?q=milk", want: milk},
+		{query: "/receipts/search?q=milk&tag=dairy", want: milk},
+		{query: "/receipts?tag=dairy", want: all},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			pages := func() []string {
+				var ids []string
+				for offset := 0; ; offset += 5 {
+					var got struct {
+						IDs   []string
+						Total int
+					}
+					decode(t, send(h, http.MethodGet, fmt.Sprintf("%s&offset=%d&limit=5", tt.query, offset), ""), &got)
+					if got.Total != len(tt.want) {
+						t.Fatalf("total %d, want %d", got.Total, len(tt.want))
+					}
+					if len(got.IDs) == 0 {
+						return ids
+					}
+					ids = append(ids, got.IDs...)
+				}
+			}
+
+			first := pages()
+			if !slices.Equal(first, tt.want) {
+				t.Errorf("pages %q, want %q", first, tt.want)
+			}
+			for range 20 {
+				if again := pages(); !slices.Equal(again, first) {
+					t.Fatalf("pages %q on repeat, first %q", again, first)
+				}
+			}
+		})
+	}
+}
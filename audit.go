@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// One state change, written to the audit log as a JSON line
+type auditEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	RequestID string    `json:"requestId"`
+	ClientIP  string    `json:"clientIp"`
+	ReceiptID string    `json:"receiptId,omitempty"`
+	Action    string    `json:"action"`
+}
+
+// Nil when audit logging is disabled
+var auditLog chan auditEntry
+
+// Entries are handed to a single writer goroutine, which keeps writes ordered
+// without making handlers wait on the file
+func startAuditLog(destination string) error {
+	if destination == "" {
+		return nil
+	}
+
+	var w io.Writer = os.Stdout
+	if destination != "stdout" {
+		f, err := os.OpenFile(destination, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	auditLog = make(chan auditEntry, 1024)
+	go func() {
+		encoder := json.NewEncoder(w)
+		for entry := range auditLog {
+			if err := encoder.Encode(entry); err != nil {
+				log.Printf("writing audit log: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func audit(c *gin.Context, action, receiptID string) {
+	auditFor(c.GetString(requestIDKey), c.ClientIP(), action, receiptID)
+}
+
+// Like audit, for changes made after the request that asked for them has finished
+func auditFor(requestID, clientIP, action, receiptID string) {
+	if auditLog == nil {
+		return
+	}
+
+	auditLog <- auditEntry{
+		Timestamp: clock.Now().UTC(),
+		RequestID: requestID,
+		ClientIP:  clientIP,
+		ReceiptID: receiptID,
+		Action:    action,
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	h := newTestServer(t, map[string]string{
+		"AUDIT_LOG":       path,
+		"MAX_RECEIPTS":    "1",
+		"STORE_FULL_MODE": "evict",
+		"ALLOW_OVERWRITE": "true",
+	})
+
+	const putID = "0b6b1fd5-5b7a-4a7e-9f43-2c5c8a1f9d10"
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   []string // actions logged
+	}{
+		{name: "process", method: http.MethodPost, path: "/receipts/process", body: targetReceipt, want: []string{"process"}},
+		{name: "put evicting", method: http.MethodPut, path: "/receipts/" + putID, body: targetReceipt, want: []string{"process", "evict"}},
+		{name: "overwrite", method: http.MethodPut, path: "/receipts/" + putID, body: targetReceipt, want: []string{"overwrite"}},
+		{name: "rejected", method: http.MethodPost, path: "/receipts/process", body: `{}`},
+		{name: "read", method: http.MethodGet, path: "/receipts/" + putID},
+
+		// Nothing else may be logged before it
+		{name: "last", method: http.MethodPost, path: "/receipts/process", body: targetReceipt, want: []string{"process", "evict"}},
+	}
+
+	var want []string
+	for _, tt := range tests {
+		w := send(h, tt.method, tt.path, tt.body, "X-Request-ID", tt.name)
+		if w.Code >= 500 {
+			t.Fatalf("%s: status %d", tt.name, w.Code)
+		}
+		want = append(want, tt.want...)
+	}
+
+	entries := readAuditLog(t, path, len(want))
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+		if entry.RequestID == "" || entry.ClientIP == "" || entry.ReceiptID == "" || entry.Timestamp.IsZero() {
+			t.Errorf("incomplete entry %+v", entry)
+		}
+	}
+	if !slices.Equal(actions, want) {
+		t.Fatalf("logged %q, want %q", actions, want)
+	}
+	if overwrite := entries[3]; overwrite.RequestID != "overwrite" || overwrite.ReceiptID != putID {
+		t.Errorf("got %+v, want the overwrite of %s", overwrite, putID)
+	}
+}
+
+// Waits for the writer goroutine to append n entries
+func readAuditLog(t *testing.T, path string, n int) []auditEntry {
+	t.Helper()
+
+	var entries []auditEntry
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		entries = nil
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry auditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatalf("decoding %s: %v", scanner.Bytes(), err)
+			}
+			entries = append(entries, entry)
+		}
+		f.Close()
+
+		if len(entries) >= n {
+			break
+		}
+	}
+	return entries
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// An LRU cache of recently used receipts in front of another store. Reads are
+// answered from the cache when possible, and writes go through to the store.
+//
+// The store is called without holding mu, so a slow write doesn't hold up reads of
+// other receipts. A miss is tagged when it starts, and only fills the cache if its
+// tag is still current for that ID; a write clears the tags of the IDs it touches,
+// so a read can't put back a receipt that was replaced, evicted or given new history
+// in the meantime. Overlapping writes to one ID leave it uncached, as the cache can't
+// tell which the store applied last.
+type cachedStore struct {
+	Store
+
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	recent  *list.List             // most recently used first
+	fills   map[string]uint64      // ID -> tag of the misses being read
+	writes  map[string]*cacheWrite // ID -> writes in progress
+	tags    uint64                 // fills tagged so far
+}
+
+type cacheEntry struct {
+	id      string
+	receipt storedReceipt
+}
+
+type cacheWrite struct {
+	active     int
+	overlapped bool
+}
+
+func newCachedStore(store Store, size int) *cachedStore {
+	return &cachedStore{
+		Store:   store,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		recent:  list.New(),
+		fills:   make(map[string]uint64),
+		writes:  make(map[string]*cacheWrite),
+	}
+}
+
+func (s *cachedStore) Put(ctx context.Context, id string, receipt storedReceipt) (string, error) {
+	s.beginWrite(id)
+	evicted, err := s.Store.Put(ctx, id, receipt)
+	if err != nil {
+		s.endWrite(id, nil, evicted)
+		return evicted, err
+	}
+
+	s.endWrite(id, &receipt, evicted)
+	return evicted, nil
+}
+
+func (s *cachedStore) Create(ctx context.Context, id string, receipt storedReceipt) (string, error) {
+	s.beginWrite(id)
+	evicted, err := s.Store.Create(ctx, id, receipt)
+	if err != nil {
+		s.endWrite(id, nil, evicted)
+		return evicted, err
+	}
+
+	s.endWrite(id, &receipt, evicted)
+	return evicted, nil
+}
+
+func (s *cachedStore) PutIfNew(ctx context.Context, id string, receipt storedReceipt) (string, string, error) {
+	s.beginWrite(id)
+	existing, evicted, err := s.Store.PutIfNew(ctx, id, receipt)
+	if err != nil || existing != "" {
+		s.endWrite(id, nil, evicted)
+		return existing, evicted, err
+	}
+
+	s.endWrite(id, &receipt, evicted)
+	return "", evicted, nil
+}
+
+// The cached copy is dropped, so the next read sees the new history
+func (s *cachedStore) RecordPoints(ctx context.Context, id string, record pointsRecord, limit int) error {
+	s.beginWrite(id)
+	err := s.Store.RecordPoints(ctx, id, record, limit)
+	s.endWrite(id, nil, "")
+	return err
+}
+
+func (s *cachedStore) Get(ctx context.Context, id string) (storedReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return storedReceipt{}, err
+	}
+
+	receipt, hit, tag := s.lookup(id)
+	if hit {
+		return receipt, nil
+	}
+
+	receipt, err := s.Store.Get(ctx, id)
+	if err != nil {
+		return receipt, err
+	}
+
+	s.mu.Lock()
+	s.fill(id, tag, receipt)
+	s.mu.Unlock()
+
+	return receipt, nil
+}
+
+// Only the receipts missing from the cache are looked up in the store
+func (s *cachedStore) GetMany(ctx context.Context, ids []string) (map[string]storedReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	found := make(map[string]storedReceipt, len(ids))
+	var misses []string
+	tags := make(map[string]uint64)
+	for _, id := range ids {
+		if element, hit := s.entries[id]; hit {
+			s.recent.MoveToFront(element)
+			found[id] = element.Value.(*cacheEntry).receipt
+		} else {
+			misses = append(misses, id)
+			tags[id] = s.tag(id)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(misses) > 0 {
+		fetched, err := s.Store.GetMany(ctx, misses)
+		if err != nil {
+			return nil, err
+		}
+
+		s.mu.Lock()
+		for id, receipt := range fetched {
+			found[id] = receipt
+			s.fill(id, tags[id], receipt)
+		}
+		s.mu.Unlock()
+	}
+
+	return found, nil
+}
+
+// The cached receipt if there is one, and the tag to fill the cache with on a miss
+func (s *cachedStore) lookup(id string) (storedReceipt, bool, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, hit := s.entries[id]
+	if !hit {
+		return storedReceipt{}, false, s.tag(id)
+	}
+	s.recent.MoveToFront(element)
+	return element.Value.(*cacheEntry).receipt, true, 0
+}
+
+// Concurrent misses for one ID share a tag. Callers hold s.mu.
+func (s *cachedStore) tag(id string) uint64 {
+	if tag, reading := s.fills[id]; reading {
+		return tag
+	}
+	s.tags++
+	s.fills[id] = s.tags
+	return s.tags
+}
+
+// Caches a receipt read from the store, unless a write to it started since the read
+// did. Callers hold s.mu.
+func (s *cachedStore) fill(id string, tag uint64, receipt storedReceipt) {
+	if s.fills[id] != tag {
+		return
+	}
+	delete(s.fills, id)
+	if s.writes[id] == nil {
+		s.add(id, receipt)
+	}
+}
+
+func (s *cachedStore) beginWrite(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.fills, id)
+	if w := s.writes[id]; w != nil {
+		w.active++
+		w.overlapped = true
+		return
+	}
+	s.writes[id] = &cacheWrite{active: 1}
+}
+
+// Caches what was written, or drops the cached copy when there's nothing to cache
+// or another write to the same ID overlapped this one
+func (s *cachedStore) endWrite(id string, written *storedReceipt, evicted string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := s.writes[id]
+	if w.active--; w.active == 0 {
+		delete(s.writes, id)
+	}
+	delete(s.fills, id)
+	if evicted != "" {
+		delete(s.fills, evicted)
+		s.remove(evicted)
+	}
+
+	if written == nil || w.overlapped {
+		s.remove(id)
+		return
+	}
+	s.add(id, *written)
+}
+
+// Callers hold s.mu
+func (s *cachedStore) add(id string, receipt storedReceipt) {
+	if element, exists := s.entries[id]; exists {
+		element.Value.(*cacheEntry).receipt = receipt
+		s.recent.MoveToFront(element)
+		return
+	}
+
+	s.entries[id] = s.recent.PushFront(&cacheEntry{id: id, receipt: receipt})
+	if s.recent.Len() > s.size {
+		s.remove(s.recent.Back().Value.(*cacheEntry).id)
+	}
+}
+
+// Callers hold s.mu
+func (s *cachedStore) remove(id string) {
+	if element, exists := s.entries[id]; exists {
+		s.recent.Remove(element)
+		delete(s.entries, id)
+	}
+}
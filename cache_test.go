@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A store recording which IDs were read from it
+type countingStore struct {
+	Store
+
+	mu    sync.Mutex
+	reads []string
+}
+
+func (s *countingStore) Get(ctx context.Context, id string) (storedReceipt, error) {
+	s.mu.Lock()
+	s.reads = append(s.reads, id)
+	s.mu.Unlock()
+	return s.Store.Get(ctx, id)
+}
+
+func (s *countingStore) GetMany(ctx context.Context, ids []string) (map[string]storedReceipt, error) {
+	s.mu.Lock()
+	s.reads = append(s.reads, ids...)
+	s.mu.Unlock()
+	return s.Store.GetMany(ctx, ids)
+}
+
+func TestCachedStore(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		ops  []string // "seed a" stores a behind the cache's back; "put", "get", "getMany a,b" and "record" go through it
+		want []string // IDs read from the backend
+	}{
+		{name: "writes fill the cache", size: 2, ops: []string{"put a", "get a", "get a"}, want: nil},
+		{name: "a miss fills the cache", size: 2, ops: []string{"seed a", "get a", "get a", "get a"}, want: []string{"a"}},
+		{name: "missing receipts aren't cached", size: 2, ops: []string{"get a", "get a"}, want: []string{"a", "a"}},
+		{
+			name: "least recently used is evicted", size: 2,
+			ops:  []string{"seed a", "seed b", "seed c", "get a", "get b", "get c", "get a"},
+			want: []string{"a", "b", "c", "a"},
+		},
+		{
+			name: "reads keep a receipt recent", size: 2,
+			ops:  []string{"seed a", "seed b", "seed c", "get a", "get b", "get a", "get c", "get a", "get b"},
+			want: []string{"a", "b", "c", "b"},
+		},
+		{name: "batches only fetch misses", size: 3, ops: []string{"put a", "seed b", "getMany a,b", "getMany a,b"}, want: []string{"b"}},
+		{name: "new points history is reread", size: 2, ops: []string{"put a", "record a", "get a", "get a"}, want: []string{"a"}},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &countingStore{Store: newReceiptStore(0, false)}
+			cache := newCachedStore(backend, tt.size)
+
+			for i, op := range tt.ops {
+				kind, id, _ := strings.Cut(op, " ")
+				switch kind {
+				case "seed":
+					backend.Put(ctx, id, storedWith(i))
+				case "put":
+					cache.Put(ctx, id, storedWith(i))
+				case "get":
+					cache.Get(ctx, id)
+				case "getMany":
+					cache.GetMany(ctx, strings.Split(id, ","))
+				case "record":
+					cache.RecordPoints(ctx, id, pointsRecord{Points: 1}, 10)
+				}
+			}
+
+			if !slices.Equal(backend.reads, tt.want) {
+				t.Errorf("backend reads %q, want %q", backend.reads, tt.want)
+			}
+		})
+	}
+}
+
+// A store whose next read waits until a write has happened
+type racedStore struct {
+	Store
+	reading chan struct{}
+	written chan struct{}
+}
+
+func (s racedStore) Get(ctx context.Context, id string) (storedReceipt, error) {
+	receipt, err := s.Store.Get(ctx, id)
+	close(s.reading)
+	<-s.written
+	return receipt, err
+}
+
+func TestCachedStoreMissDuringWrite(t *testing.T) {
+	ctx := context.Background()
+	backend := newReceiptStore(0, false)
+	backend.Put(ctx, "a", storedWith(0, "Old"))
+
+	raced := racedStore{Store: backend, reading: make(chan struct{}), written: make(chan struct{})}
+	cache := newCachedStore(raced, 2)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.Get(ctx, "a")
+	}()
+
+	// The read has the old receipt in hand when the new one is written
+	<-raced.reading
+	cache.Put(ctx, "a", storedWith(1, "New"))
+	close(raced.written)
+	<-done
+
+	got, _, _ := cache.lookup("a")
+	if len(got.Receipt.Items) != 1 || got.Receipt.Items[0].ShortDescription != "New" {
+		t.Errorf("cached %+v after the write, want the new receipt", got.Receipt.Items)
+	}
+}
+
+func TestCachedStoreReadDuringSlowWrite(t *testing.T) {
+	ctx := context.Background()
+	backend := newReceiptStore(0, false)
+	backend.Put(ctx, "a", storedWith(0, "Old"))
+	backend.Put(ctx, "b", storedWith(1))
+
+	held := heldStore{Store: backend, release: make(chan struct{})}
+	cache := newCachedStore(held, 2)
+	cache.Get(ctx, "a")
+	cache.Get(ctx, "b")
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		cache.Put(ctx, "a", storedWith(2, "New"))
+	}()
+
+	// Reads go on while the store is still writing
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		cache.Get(ctx, "a")
+		cache.Get(ctx, "b")
+	}()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reads waited for the write")
+	}
+
+	close(held.release)
+	<-written
+	got, _ := cache.Get(ctx, "a")
+	if len(got.Receipt.Items) != 1 || got.Receipt.Items[0].ShortDescription != "New" {
+		t.Errorf("read %+v after the write, want the new receipt", got.Receipt.Items)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// The server's notion of the current time. Everything that records or compares
+// against "now" goes through clock, so time-dependent behavior can be pinned.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+var clock Clock = realClock{}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Always reports the same instant, for reproducible scoring
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// Moves on a second every time it is read, so receipts are stored at distinct,
+// predictable times
+type tickingClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(time.Second)
+	return c.now
+}
+
+func TestPromptSubmission(t *testing.T) {
+	purchased := time.Date(2022, time.January, 1, 13, 1, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		now         time.Time
+		points      int
+		description string
+	}{
+		{name: "right away", now: purchased.Add(time.Minute), points: 10, description: "10 points because the receipt was processed within 24 hours of the purchase"},
+		{name: "at the end of the window", now: purchased.Add(24 * time.Hour), points: 10, description: "10 points because the receipt was processed within 24 hours of the purchase"},
+		{name: "after the window", now: purchased.Add(24*time.Hour + time.Minute), description: "No points because the receipt was not processed within 24 hours of the purchase"},
+		{name: "before the purchase", now: purchased.Add(-time.Minute), description: "No points because the purchase time is later than when the receipt was processed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, nil)
+			activateRuleConfig(t, newRuleConfig(t, `{"promptSubmission": {"withinHours": 24, "points": 10}}`))
+			clock = fixedClock(tt.now)
+			id := process(t, h, simpleReceipt("Target", "2022-01-01", "13:01", "1.00"))
+
+			// Stored at processing time, so moving the clock on afterwards changes nothing
+			clock = fixedClock(tt.now.Add(72 * time.Hour))
+
+			var got struct {
+				Points      int
+				Description string
+			}
+			decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points?rule=promptSubmission", ""), &got)
+			if got.Points != tt.points || got.Description != tt.description {
+				t.Errorf("got %d points, %q; want %d points, %q", got.Points, got.Description, tt.points, tt.description)
+			}
+		})
+	}
+}
+
+func TestPromptSubmissionEdges(t *testing.T) {
+	prompt := `{"promptSubmission": {"withinHours": 24, "points": 10}}`
+	eastern := time.FixedZone("UTC-5", -5*60*60)
+
+	tests := []struct {
+		name      string
+		config    string
+		time      string
+		createdAt time.Time
+		want      int
+	}{
+		{name: "disabled", config: `{}`, time: "13:01", createdAt: time.Date(2022, time.January, 1, 14, 0, 0, 0, time.UTC), want: 0},
+		{name: "no window", config: `{"promptSubmission": {"points": 10}}`, time: "13:01", createdAt: time.Date(2022, time.January, 1, 14, 0, 0, 0, time.UTC), want: 0},
+		{name: "missing time", config: prompt, time: "", createdAt: time.Date(2022, time.January, 1, 14, 0, 0, 0, time.UTC), want: 0},
+		{name: "unparsable time", config: prompt, time: "1pm", createdAt: time.Date(2022, time.January, 1, 14, 0, 0, 0, time.UTC), want: 0},
+		// The purchase is read in the server's zone: 13:01 there is 18:01 UTC
+		{name: "server time zone", config: prompt, time: "13:01", createdAt: time.Date(2022, time.January, 1, 13, 30, 0, 0, eastern), want: 10},
+		{name: "future in the server time zone", config: prompt, time: "13:01", createdAt: time.Date(2022, time.January, 1, 12, 30, 0, 0, eastern), want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := parseReceipt(t, simpleReceipt("Target", "2022-01-01", "13:01", "1.00"))
+			receipt.PurchaseTime = tt.time
+
+			_, breakdown, _ := scoreWithConfig(newRuleConfig(t, tt.config), scoring{id: "test", receipt: receipt, createdAt: tt.createdAt})
+			got := 0
+			if i := slices.IndexFunc(breakdown, func(s ruleScore) bool { return s.Rule == "promptSubmission" }); i >= 0 {
+				got = breakdown[i].Points
+			}
+			if got != tt.want {
+				t.Errorf("got %d points, want %d: %+v", got, tt.want, breakdown)
+			}
+		})
+	}
+}
+
+func TestPointsDecay(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		age    time.Duration
+		want   int // effective points, or -1 when they are left out
+	}{
+		{name: "no decay", config: `{}`, age: 90 * 24 * time.Hour, want: -1},
+		{name: "new", config: `{"pointsHalfLifeDays": 30, "pointsRounding": "down"}`, want: 28},
+		{name: "one half-life", config: `{"pointsHalfLifeDays": 30, "pointsRounding": "down"}`, age: 30 * 24 * time.Hour, want: 14},
+		{name: "two half-lives", config: `{"pointsHalfLifeDays": 30, "pointsRounding": "down"}`, age: 60 * 24 * time.Hour, want: 7},
+		{name: "between, rounded down", config: `{"pointsHalfLifeDays": 30, "pointsRounding": "down"}`, age: 45 * 24 * time.Hour, want: 9},
+		{name: "between, rounded up", config: `{"pointsHalfLifeDays": 30, "pointsRounding": "up"}`, age: 45 * 24 * time.Hour, want: 10},
+		{name: "an hour old", config: `{"pointsHalfLifeDays": 1, "pointsRounding": "down"}`, age: time.Hour, want: 27},
+		{name: "clock behind creation", config: `{"pointsHalfLifeDays": 30, "pointsRounding": "down"}`, age: -24 * time.Hour, want: 28},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, nil)
+			activateRuleConfig(t, newRuleConfig(t, tt.config))
+			clock = fixedClock(storeEpoch)
+			id := process(t, h, targetReceipt)
+			clock = fixedClock(storeEpoch.Add(tt.age))
+
+			var got struct {
+				Points          int
+				EffectivePoints *int
+			}
+			decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points", ""), &got)
+			if got.Points != 28 {
+				t.Errorf("stored points changed to %d", got.Points)
+			}
+			switch {
+			case tt.want < 0 && got.EffectivePoints != nil:
+				t.Errorf("got effective points %d without decay", *got.EffectivePoints)
+			case tt.want >= 0 && (got.EffectivePoints == nil || *got.EffectivePoints != tt.want):
+				t.Errorf("got effective points %v, want %d", got.EffectivePoints, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetailerCooldown(t *testing.T) {
+	first := time.Date(2022, time.January, 1, 13, 1, 0, 0, time.UTC)
+	cooldown := `{"retailerCooldownSeconds": 60, "retailerAliases": {"Tgt": "Target"}}`
+
+	tests := []struct {
+		name       string
+		config     string
+		retailer   string
+		after      time.Duration
+		status     int
+		retryAfter string
+	}{
+		{name: "disabled", config: `{}`, retailer: "Target", after: time.Second, status: http.StatusCreated},
+		{name: "within the cooldown", config: cooldown, retailer: "Target", after: 20500 * time.Millisecond, status: http.StatusTooManyRequests, retryAfter: "40"},
+		{name: "just before the end", config: cooldown, retailer: "Target", after: 59 * time.Second, status: http.StatusTooManyRequests, retryAfter: "1"},
+		{name: "at the end", config: cooldown, retailer: "Target", after: time.Minute, status: http.StatusCreated},
+		{name: "after the cooldown", config: cooldown, retailer: "Target", after: time.Hour, status: http.StatusCreated},
+		{name: "another retailer", config: cooldown, retailer: "Walgreens", after: time.Second, status: http.StatusCreated},
+		{name: "an alias of the retailer", config: cooldown, retailer: "Tgt", after: time.Second, status: http.StatusTooManyRequests, retryAfter: "59"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, nil)
+			activateRuleConfig(t, newRuleConfig(t, tt.config))
+			clock = fixedClock(first)
+			process(t, h, simpleReceipt("Target", "2022-01-01", "13:01", "1.00"))
+
+			clock = fixedClock(first.Add(tt.after))
+			w := send(h, http.MethodPost, "/receipts/process", simpleReceipt(tt.retailer, "2022-01-01", "13:02", "2.00"))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
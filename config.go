@@ -0,0 +1,304 @@
+package main
+
+import (
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Server settings, read from the environment at startup
+type Config struct {
+	MaxReceipts      int
+	EvictWhenFull    bool
+	AllowOverwrite   bool
+	CacheSize        int
+	ProblemDetails   bool
+	RuleConfigPath   string
+	PointsKey        string
+	MaxBodyBytes     int64
+	MaxItems         int
+	ItemBudget       int
+	ApproxItems      bool
+	MaxBatchIDs      int
+	MaxValidateBatch int
+	PointsHistory    int
+	MaxRawBytes      int
+	AsyncWorkers     int
+	AsyncQueue       int
+	MaxAsyncBatch    int
+	CreatedStatus    int
+	BasePath         string
+	OpsUnderBase     bool
+
+	ThousandsSeparator string
+	NumericAmounts     bool
+	StrictJSONKeys     bool
+	DeriveTotal        bool
+	AuditLog           string
+	TrustedProxies     []string
+
+	APIVersionHeader   string
+	APIVersionRequired bool
+
+	DeprecatedRoutes map[string]deprecation
+	DisabledFeatures map[string]bool
+
+	H2C                bool
+	RequestTimeout     time.Duration
+	MaxHeaderLength    int
+	ReceiptCountHeader bool
+	JWTSecret          string
+	AdminToken         string
+}
+
+// When a route was deprecated and, optionally, when it will be removed
+type deprecation struct {
+	Since  time.Time
+	Sunset time.Time
+}
+
+var config Config
+
+func loadConfig() Config {
+	var cfg Config
+
+	cfg.MaxReceipts = envInt("MAX_RECEIPTS", 0)
+	if cfg.MaxReceipts < 0 {
+		log.Fatalf("MAX_RECEIPTS must not be negative, got %d", cfg.MaxReceipts)
+	}
+
+	switch mode := envString("STORE_FULL_MODE", "reject"); mode {
+	case "reject":
+	case "evict":
+		cfg.EvictWhenFull = true
+	default:
+		log.Fatalf("STORE_FULL_MODE must be \"reject\" or \"evict\", got %q", mode)
+	}
+
+	cfg.AllowOverwrite = envBool("ALLOW_OVERWRITE", false)
+
+	cfg.CacheSize = envInt("CACHE_SIZE", 0)
+	if cfg.CacheSize < 0 {
+		log.Fatalf("CACHE_SIZE must not be negative, got %d", cfg.CacheSize)
+	}
+
+	cfg.RuleConfigPath = envString("RULE_CONFIG", "")
+
+	// Errors as RFC 7807 problem details even for clients that don't ask for them
+	cfg.ProblemDetails = envBool("PROBLEM_DETAILS", false)
+
+	// 200 keeps the original response for clients that don't expect 201 yet
+	cfg.CreatedStatus = envInt("CREATED_STATUS", 201)
+	if cfg.CreatedStatus != 200 && cfg.CreatedStatus != 201 {
+		log.Fatalf("CREATED_STATUS must be 200 or 201, got %d", cfg.CreatedStatus)
+	}
+
+	cfg.MaxBatchIDs = envInt("MAX_BATCH_IDS", 100)
+	if cfg.MaxBatchIDs <= 0 {
+		log.Fatalf("MAX_BATCH_IDS must be positive, got %d", cfg.MaxBatchIDs)
+	}
+
+	cfg.MaxValidateBatch = envInt("MAX_VALIDATE_BATCH", 100)
+	if cfg.MaxValidateBatch <= 0 {
+		log.Fatalf("MAX_VALIDATE_BATCH must be positive, got %d", cfg.MaxValidateBatch)
+	}
+
+	cfg.AsyncWorkers = envInt("ASYNC_WORKERS", 4)
+	if cfg.AsyncWorkers <= 0 {
+		log.Fatalf("ASYNC_WORKERS must be positive, got %d", cfg.AsyncWorkers)
+	}
+
+	cfg.AsyncQueue = envInt("ASYNC_QUEUE", 100)
+	if cfg.AsyncQueue <= 0 {
+		log.Fatalf("ASYNC_QUEUE must be positive, got %d", cfg.AsyncQueue)
+	}
+
+	cfg.MaxAsyncBatch = envInt("MAX_ASYNC_BATCH", 1000)
+	if cfg.MaxAsyncBatch <= 0 {
+		log.Fatalf("MAX_ASYNC_BATCH must be positive, got %d", cfg.MaxAsyncBatch)
+	}
+
+	cfg.MaxRawBytes = envInt("STORE_RAW_BYTES", 0)
+	if cfg.MaxRawBytes < 0 {
+		log.Fatalf("STORE_RAW_BYTES must not be negative, got %d", cfg.MaxRawBytes)
+	}
+
+	cfg.PointsHistory = envInt("POINTS_HISTORY", 0)
+	if cfg.PointsHistory < 0 {
+		log.Fatalf("POINTS_HISTORY must not be negative, got %d", cfg.PointsHistory)
+	}
+
+	cfg.MaxBodyBytes = int64(envInt("MAX_BODY_BYTES", 1<<20))
+	if cfg.MaxBodyBytes <= 0 {
+		log.Fatalf("MAX_BODY_BYTES must be positive, got %d", cfg.MaxBodyBytes)
+	}
+
+	cfg.MaxItems = envInt("MAX_ITEMS", 1000)
+	if cfg.MaxItems <= 0 {
+		log.Fatalf("MAX_ITEMS must be positive, got %d", cfg.MaxItems)
+	}
+
+	// Bounds the per-item scoring work, below the parsing limit of MAX_ITEMS
+	cfg.ItemBudget = envInt("ITEM_BUDGET", 0)
+	if cfg.ItemBudget < 0 {
+		log.Fatalf("ITEM_BUDGET must not be negative, got %d", cfg.ItemBudget)
+	}
+	switch mode := envString("ITEM_BUDGET_MODE", "reject"); mode {
+	case "reject":
+	case "approximate":
+		cfg.ApproxItems = true
+	default:
+		log.Fatalf("ITEM_BUDGET_MODE must be \"reject\" or \"approximate\", got %q", mode)
+	}
+
+	// Any non-empty UTF-8 string can be encoded as a JSON object key
+	cfg.PointsKey = envString("POINTS_KEY", "points")
+	if strings.TrimSpace(cfg.PointsKey) == "" || !utf8.ValidString(cfg.PointsKey) {
+		log.Fatalf("POINTS_KEY must be a non-empty UTF-8 string, got %q", cfg.PointsKey)
+	}
+
+	// "api/v1/" and "/api/v1" both mount routes under /api/v1
+	if base := strings.Trim(envString("BASE_PATH", ""), "/"); base != "" {
+		cfg.BasePath = "/" + base
+	}
+	cfg.OpsUnderBase = envBool("OPS_UNDER_BASE_PATH", false)
+
+	// Off by default so amounts stay strict; "." can't be used as it is the decimal point
+	cfg.ThousandsSeparator = envString("THOUSANDS_SEPARATOR", "")
+	if strings.ContainsAny(cfg.ThousandsSeparator, ".-+0123456789") {
+		log.Fatalf("THOUSANDS_SEPARATOR must not contain digits, signs or \".\", got %q", cfg.ThousandsSeparator)
+	}
+
+	cfg.NumericAmounts = envBool("NUMERIC_AMOUNTS", false)
+	cfg.StrictJSONKeys = envBool("STRICT_JSON_KEYS", false)
+	cfg.DeriveTotal = envBool("DERIVE_TOTAL", false)
+
+	cfg.AuditLog = envString("AUDIT_LOG", "")
+
+	// X-Forwarded-For is only honoured from these addresses; nothing is trusted by default
+	for _, proxy := range strings.Split(envString("TRUSTED_PROXIES", ""), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			cfg.TrustedProxies = append(cfg.TrustedProxies, proxy)
+		}
+	}
+
+	cfg.APIVersionHeader = envString("API_VERSION_HEADER", "Accept-Version")
+	cfg.APIVersionRequired = envBool("API_VERSION_REQUIRED", false)
+
+	cfg.DeprecatedRoutes = parseDeprecatedRoutes(envString("DEPRECATED_ROUTES", ""))
+
+	// Optional endpoints left unmounted, so they answer 404
+	cfg.DisabledFeatures = make(map[string]bool)
+	for _, feature := range strings.Split(envString("DISABLED_FEATURES", ""), ",") {
+		if feature = strings.TrimSpace(feature); feature == "" {
+			continue
+		}
+		if !slices.Contains(features, feature) {
+			log.Fatalf("DISABLED_FEATURES: unknown feature %q, expected one of %s", feature, strings.Join(features, ", "))
+		}
+		cfg.DisabledFeatures[feature] = true
+	}
+
+	cfg.H2C = envBool("H2C", false)
+	cfg.JWTSecret = envString("JWT_SECRET", "")
+	cfg.AdminToken = envString("ADMIN_TOKEN", "")
+
+	cfg.ReceiptCountHeader = envBool("RECEIPT_COUNT_HEADER", false)
+
+	cfg.RequestTimeout = envDuration("REQUEST_TIMEOUT", 0)
+	if cfg.RequestTimeout < 0 {
+		log.Fatalf("REQUEST_TIMEOUT must not be negative, got %s", cfg.RequestTimeout)
+	}
+
+	cfg.MaxHeaderLength = envInt("MAX_HEADER_LENGTH", 1024)
+	if cfg.MaxHeaderLength < 1 {
+		log.Fatalf("MAX_HEADER_LENGTH must be positive, got %d", cfg.MaxHeaderLength)
+	}
+
+	return cfg
+}
+
+// Endpoint groups that DISABLED_FEATURES can switch off
+var features = []string{"batch", "search", "export", "compare", "schema", "stats", "admin", "top", "async", "preview"}
+
+func featureEnabled(feature string) bool {
+	return !config.DisabledFeatures[feature]
+}
+
+// Parses "METHOD PATH DEPRECATED_ON [SUNSET_ON]" entries separated by semicolons,
+// e.g. "GET /receipts/:id/points 2026-10-01 2027-06-30", keyed by "METHOD PATH"
+func parseDeprecatedRoutes(value string) map[string]deprecation {
+	routes := make(map[string]deprecation)
+
+	for _, entry := range strings.Split(value, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 4 {
+			log.Fatalf("DEPRECATED_ROUTES entry %q must be \"METHOD PATH DEPRECATED_ON [SUNSET_ON]\"", entry)
+		}
+
+		var d deprecation
+		var err error
+		if d.Since, err = time.Parse("2006-01-02", fields[2]); err != nil {
+			log.Fatalf("DEPRECATED_ROUTES entry %q has an invalid deprecation date", entry)
+		}
+		if len(fields) == 4 {
+			if d.Sunset, err = time.Parse("2006-01-02", fields[3]); err != nil {
+				log.Fatalf("DEPRECATED_ROUTES entry %q has an invalid sunset date", entry)
+			}
+		}
+
+		routes[strings.ToUpper(fields[0])+" "+fields[1]] = d
+	}
+
+	return routes
+}
+
+func envString(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	v := envString(key, "")
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s must be an integer, got %q", key, v)
+	}
+	return n
+}
+
+func envBool(key string, fallback bool) bool {
+	v := envString(key, "")
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("%s must be a boolean, got %q", key, v)
+	}
+	return b
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := envString(key, "")
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s must be a duration such as \"5s\", got %q", key, v)
+	}
+	return d
+}
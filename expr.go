@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A compiled rule expression such as `total > 10 ? 20 : 0`. Expressions combine
+// receipt fields with numbers and double-quoted strings using ?:, ||, &&, !, the
+// comparisons ==, !=, <, <=, >, >= and the arithmetic + - * / %. Comparisons and
+// logic give 1 or 0, and any non-zero number counts as true. Strings may only be
+// compared with == and !=. Dividing by zero gives 0.
+type expression struct {
+	root exprNode
+}
+
+// Receipt fields available to expressions, with whether they are strings
+var exprFields = map[string]bool{
+	"retailer":       true,
+	"retailerLength": false, // letters and digits in the retailer name
+	"total":          false, // in dollars, e.g. 35.35
+	"totalCents":     false,
+	"items":          false, // number of items
+	"purchaseYear":   false,
+	"purchaseMonth":  false,
+	"purchaseDay":    false,
+	"weekday":        false, // 0 for Sunday through 6 for Saturday
+	"purchaseHour":   false,
+	"purchaseMinute": false,
+}
+
+type exprValue struct {
+	num float64
+	str string
+}
+
+type exprNode interface {
+	eval(fields map[string]exprValue) exprValue
+	isString() bool
+}
+
+func compileExpression(source string) (*expression, error) {
+	p := &exprParser{tokens: tokenizeExpr(source)}
+	root, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token != "" {
+		return nil, fmt.Errorf("unexpected %q", token)
+	}
+	if root.isString() {
+		return nil, fmt.Errorf("must give a number of points, not a string")
+	}
+	return &expression{root: root}, nil
+}
+
+// Points for the receipt, rounded to the nearest whole point
+func (e *expression) points(receipt Receipt) int {
+	return int(math.Round(e.root.eval(exprFieldsFor(receipt)).num))
+}
+
+// The field values as JSON-friendly inputs for debug traces
+func exprInputs(receipt Receipt) gin.H {
+	inputs := gin.H{}
+	for name, value := range exprFieldsFor(receipt) {
+		if exprFields[name] {
+			inputs[name] = value.str
+		} else {
+			inputs[name] = value.num
+		}
+	}
+	return inputs
+}
+
+func exprFieldsFor(receipt Receipt) map[string]exprValue {
+	total, _ := parseAmount(string(receipt.Total))
+	cents, _ := parseCents(string(receipt.Total))
+	date, _ := time.Parse("2006-01-02", receipt.PurchaseDate)
+	clock, _ := time.Parse("15:04", receipt.PurchaseTime)
+
+	return map[string]exprValue{
+		"retailer":       {str: receipt.Retailer},
+		"retailerLength": {num: float64(len(aliasKey(receipt.Retailer)))},
+		"total":          {num: total},
+		"totalCents":     {num: float64(cents)},
+		"items":          {num: float64(len(receipt.Items))},
+		"purchaseYear":   {num: float64(date.Year())},
+		"purchaseMonth":  {num: float64(date.Month())},
+		"purchaseDay":    {num: float64(date.Day())},
+		"weekday":        {num: float64(date.Weekday())},
+		"purchaseHour":   {num: float64(clock.Hour())},
+		"purchaseMinute": {num: float64(clock.Minute())},
+	}
+}
+
+// Splits into numbers, quoted strings, names and operators. Anything unrecognized
+// becomes a token of its own for the parser to reject.
+func tokenizeExpr(source string) []string {
+	var tokens []string
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(source) && (unicode.IsDigit(rune(source[j])) || source[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, source[i:j])
+			i = j
+		case unicode.IsLetter(c):
+			j := i
+			for j < len(source) && (unicode.IsLetter(rune(source[j])) || unicode.IsDigit(rune(source[j]))) {
+				j++
+			}
+			tokens = append(tokens, source[i:j])
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(source) && source[j] != '"' {
+				j++
+			}
+			tokens = append(tokens, source[i:min(j+1, len(source))])
+			i = j + 1
+		default:
+			if i+1 < len(source) && slices.Contains(exprOperators, source[i:i+2]) {
+				tokens = append(tokens, source[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, source[i:i+1])
+				i++
+			}
+		}
+	}
+	return tokens
+}
+
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||"}
+
+// Recursive descent, one method per precedence level from lowest to highest
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *exprParser) ternary() (exprNode, error) {
+	condition, err := p.binary(0)
+	if err != nil || p.peek() != "?" {
+		return condition, err
+	}
+	p.next()
+
+	then, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.next(); token != ":" {
+		return nil, fmt.Errorf("expected \":\", got %q", token)
+	}
+	otherwise, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+
+	if condition.isString() {
+		return nil, fmt.Errorf("the condition before \"?\" must be a number")
+	}
+	if then.isString() != otherwise.isString() {
+		return nil, fmt.Errorf("both sides of \":\" must be numbers or both strings")
+	}
+	return &conditionalNode{condition, then, otherwise}, nil
+}
+
+// Binary operators by precedence, loosest first
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) binary(level int) (exprNode, error) {
+	if level == len(exprPrecedence) {
+		return p.unary()
+	}
+
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for slices.Contains(exprPrecedence[level], p.peek()) {
+		op := p.next()
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if op == "==" || op == "!=" {
+			if left.isString() != right.isString() {
+				return nil, fmt.Errorf("%q compares a string with a number", op)
+			}
+		} else if left.isString() || right.isString() {
+			return nil, fmt.Errorf("%q needs numbers, not strings", op)
+		}
+		left = &binaryNode{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if op := p.peek(); op == "!" || op == "-" {
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if operand.isString() {
+			return nil, fmt.Errorf("%q needs a number, not a string", op)
+		}
+		return &unaryNode{op, operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case token == "(":
+		inner, err := p.ternary()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing != ")" {
+			return nil, fmt.Errorf("expected \")\", got %q", closing)
+		}
+		return inner, nil
+	case strings.HasPrefix(token, "\""):
+		if len(token) < 2 || !strings.HasSuffix(token, "\"") {
+			return nil, fmt.Errorf("unterminated string %s", token)
+		}
+		return &literalNode{exprValue{str: token[1 : len(token)-1]}, true}, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		n, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token)
+		}
+		return &literalNode{exprValue{num: n}, false}, nil
+	case unicode.IsLetter(rune(token[0])):
+		isString, known := exprFields[token]
+		if !known {
+			return nil, fmt.Errorf("unknown field %q", token)
+		}
+		return &fieldNode{token, isString}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+type literalNode struct {
+	value  exprValue
+	string bool
+}
+
+func (n *literalNode) eval(map[string]exprValue) exprValue { return n.value }
+func (n *literalNode) isString() bool                      { return n.string }
+
+type fieldNode struct {
+	name   string
+	string bool
+}
+
+func (n *fieldNode) eval(fields map[string]exprValue) exprValue { return fields[n.name] }
+func (n *fieldNode) isString() bool                             { return n.string }
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(fields map[string]exprValue) exprValue {
+	v := n.operand.eval(fields).num
+	if n.op == "-" {
+		return exprValue{num: -v}
+	}
+	return exprValue{num: boolNum(v == 0)}
+}
+
+func (n *unaryNode) isString() bool { return false }
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(fields map[string]exprValue) exprValue {
+	// Short-circuiting, so the right side only runs when it matters
+	switch n.op {
+	case "&&":
+		return exprValue{num: boolNum(n.left.eval(fields).num != 0 && n.right.eval(fields).num != 0)}
+	case "||":
+		return exprValue{num: boolNum(n.left.eval(fields).num != 0 || n.right.eval(fields).num != 0)}
+	}
+
+	l, r := n.left.eval(fields), n.right.eval(fields)
+	switch n.op {
+	case "==":
+		return exprValue{num: boolNum(l == r)}
+	case "!=":
+		return exprValue{num: boolNum(l != r)}
+	case "<":
+		return exprValue{num: boolNum(l.num < r.num)}
+	case "<=":
+		return exprValue{num: boolNum(l.num <= r.num)}
+	case ">":
+		return exprValue{num: boolNum(l.num > r.num)}
+	case ">=":
+		return exprValue{num: boolNum(l.num >= r.num)}
+	case "+":
+		return exprValue{num: l.num + r.num}
+	case "-":
+		return exprValue{num: l.num - r.num}
+	case "*":
+		return exprValue{num: l.num * r.num}
+	case "/":
+		if r.num == 0 {
+			return exprValue{}
+		}
+		return exprValue{num: l.num / r.num}
+	default: // "%"
+		if r.num == 0 {
+			return exprValue{}
+		}
+		return exprValue{num: math.Mod(l.num, r.num)}
+	}
+}
+
+func (n *binaryNode) isString() bool { return false }
+
+type conditionalNode struct {
+	condition, then, otherwise exprNode
+}
+
+func (n *conditionalNode) eval(fields map[string]exprValue) exprValue {
+	if n.condition.eval(fields).num != 0 {
+		return n.then.eval(fields)
+	}
+	return n.otherwise.eval(fields)
+}
+
+func (n *conditionalNode) isString() bool { return n.then.isString() }
+
+func boolNum(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExpression(t *testing.T) {
+	// Target, 35.35, 5 items, bought on Saturday 2022-01-01 at 13:01
+	receipt := parseReceipt(t, targetReceipt)
+
+	tests := []struct {
+		expression string
+		want       int
+	}{
+		{expression: "total > 10 ? 20 : 0", want: 20},
+		{expression: "total > 50 ? 20 : 0", want: 0},
+		{expression: "totalCents % 100", want: 35},
+		{expression: "items * 2 + 1", want: 11},
+		{expression: "2 + 3 * 4", want: 14},
+		{expression: "(2 + 3) * 4", want: 20},
+		{expression: "-items + 10", want: 5},
+		{expression: "total / 2", want: 18}, // 17.675 rounds to the nearest point
+		{expression: "items / 0", want: 0},
+		{expression: `retailer == "Target" ? 5 : 0`, want: 5},
+		{expression: `retailer != "Target" ? 5 : 0`, want: 0},
+		{expression: "weekday == 0 || weekday == 6 ? 7 : 0", want: 7},
+		{expression: "purchaseHour >= 14 && purchaseHour < 16 ? 10 : 0", want: 0},
+		{expression: "!(purchaseDay % 2)", want: 0},
+		{expression: "purchaseYear == 2022 && purchaseMonth == 1 ? retailerLength : 0", want: 6},
+		{expression: "items > 3 ? items > 4 ? 2 : 1 : 0", want: 2},
+		{expression: "purchaseMinute <= 1", want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			e, err := compileExpression(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.points(receipt); got != tt.want {
+				t.Errorf("got %d points, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{expression: "", want: "unexpected end of expression"},
+		{expression: "total >", want: "unexpected end of expression"},
+		{expression: "total > 10 ? 20", want: `expected ":", got ""`},
+		{expression: "(total", want: `expected ")", got ""`},
+		{expression: "total 10", want: `unexpected "10"`},
+		{expression: "subtotal > 10", want: `unknown field "subtotal"`},
+		{expression: `retailer == "Target`, want: `unterminated string "Target`},
+		{expression: "retailer", want: "must give a number of points, not a string"},
+		{expression: `retailer > "A"`, want: `">" needs numbers, not strings`},
+		{expression: "-retailer", want: `"-" needs a number, not a string`},
+		{expression: "total $ 10", want: `unexpected "$"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			_, err := compileExpression(tt.expression)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpressionRules(t *testing.T) {
+	rc := newRuleConfig(t, `{"expressionRules": [
+		{"name": "bigBasket", "expression": "items >= 5 ? 15 : 0"},
+		{"name": "weekend", "expression": "weekday == 0 || weekday == 6 ? 4 : 0"}
+	]}`)
+
+	points, breakdown := scoreUnder(t, rc, parseReceipt(t, targetReceipt))
+	if points != 28+15+4 {
+		t.Errorf("got %d points, want %d", points, 28+15+4)
+	}
+	want := []ruleScore{
+		{Rule: "bigBasket", Points: 15, Description: "15 points from the expression items >= 5 ? 15 : 0"},
+		{Rule: "weekend", Points: 4, Description: "4 points from the expression weekday == 0 || weekday == 6 ? 4 : 0"},
+	}
+	if got := breakdown[len(breakdown)-2:]; !slices.Equal(got, want) {
+		t.Errorf("breakdown ends %+v, want %+v", got, want)
+	}
+
+	for _, invalid := range []string{
+		`{"expressionRules": [{"name": "bonus", "expression": "total >"}]}`,
+		`{"expressionRules": [{"expression": "1"}]}`,
+		`{"expressionRules": [{"name": "retailer", "expression": "1"}]}`,
+		`{"expressionRules": [{"name": "bonus", "expression": "1"}, {"name": "bonus", "expression": "2"}]}`,
+	} {
+		if _, err := parseRuleConfig([]byte(invalid), "test config"); err == nil {
+			t.Errorf("%s was accepted", invalid)
+		}
+	}
+}
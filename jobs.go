@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	jobPending  = "pending"
+	jobRunning  = "running"
+	jobComplete = "complete"
+)
+
+// Finished jobs kept for status lookups, oldest dropped first
+const maxFinishedJobs = 1000
+
+// A batch of receipts processed in the background. Fields are guarded by mu once the
+// job is queued.
+type job struct {
+	mu          sync.Mutex
+	id          string
+	status      string
+	total       int
+	bodies      []json.RawMessage // released once the job is complete
+	results     []jobResult
+	createdAt   time.Time
+	completedAt time.Time
+
+	// Attributed to the request that submitted the job in the audit log
+	requestID string
+	clientIP  string
+}
+
+// The outcome for one receipt of a job: its ID and points once stored, or why not
+type jobResult struct {
+	Index       int
+	ID          string
+	Points      *int
+	Description string
+	Errors      []string
+	Warnings    []string
+}
+
+// Points go under POINTS_KEY like everywhere else, so the keys are chosen at runtime
+func (r jobResult) MarshalJSON() ([]byte, error) {
+	result := gin.H{"index": r.Index}
+	if r.ID != "" {
+		result["id"] = r.ID
+	}
+	if r.Points != nil {
+		result[config.PointsKey] = *r.Points
+	}
+	if r.Description != "" {
+		result["description"] = r.Description
+	}
+	if len(r.Errors) > 0 {
+		result["errors"] = r.Errors
+	}
+	if len(r.Warnings) > 0 {
+		result["warnings"] = r.Warnings
+	}
+	return json.Marshal(result)
+}
+
+var (
+	jobsMu   sync.Mutex
+	jobs     = make(map[string]*job)
+	finished []string // IDs of finished jobs, oldest first
+	jobQueue chan *job
+)
+
+// Starts the bounded pool of workers that process queued jobs
+func startJobWorkers(workers, queue int) {
+	pending := make(chan *job, queue)
+	jobQueue = pending
+	for range workers {
+		go func() {
+			for j := range pending {
+				runJob(j)
+			}
+		}()
+	}
+}
+
+func runJob(j *job) {
+	j.mu.Lock()
+	j.status = jobRunning
+	j.mu.Unlock()
+
+	for i, body := range j.bodies {
+		result := processJobReceipt(j, i, body)
+
+		j.mu.Lock()
+		j.results = append(j.results, result)
+		j.mu.Unlock()
+	}
+
+	j.mu.Lock()
+	j.status = jobComplete
+	j.completedAt = clock.Now()
+	j.bodies = nil
+	j.mu.Unlock()
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	finished = append(finished, j.id)
+	if len(finished) > maxFinishedJobs {
+		delete(jobs, finished[0])
+		finished = finished[1:]
+	}
+}
+
+// Validates, scores and stores one receipt the way POST /receipts/process would
+func processJobReceipt(j *job, index int, body []byte) jobResult {
+	receipt, problem := checkBatchReceipt(body)
+	if problem != nil {
+		return jobResult{Index: index, Description: problem.description, Errors: problem.errors}
+	}
+
+	receiptId := uuid.New().String()
+	stored := newStoredReceipt(receiptId, receipt)
+	if wait := cooldownRemaining(receiptId, stored); wait > 0 {
+		return jobResult{Index: index, Description: fmt.Sprintf("A receipt from %s was processed too recently; try again in %s.", stored.Receipt.Retailer, wait.Round(time.Second))}
+	}
+	stored.Raw = rawCopy(body)
+	evicted, err := receipts.Put(context.Background(), receiptId, stored)
+	if err != nil {
+		return jobResult{Index: index, Description: fmt.Sprintf("The receipt could not be stored: %v.", err)}
+	}
+
+	auditFor(j.requestID, j.clientIP, "process", receiptId)
+	if evicted != "" {
+		auditFor(j.requestID, j.clientIP, "evict", evicted)
+	}
+	atomic.AddInt64(&receiptsProcessed, 1)
+
+	return jobResult{Index: index, ID: receiptId, Points: &stored.Points, Warnings: currentRuleConfig().Warnings.check(stored.Receipt)}
+}
+
+// Accepts a receipt or a JSON array of receipts and queues them for processing,
+// answering right away with the job to poll
+func enqueueReceipts(c *gin.Context) {
+	body, err := c.GetRawData()
+	if errors.Is(bodyError(err), errBodyTooLarge) {
+		respondError(c, http.StatusRequestEntityTooLarge, "The request is too large.")
+		return
+	} else if err != nil {
+		respondError(c, http.StatusBadRequest, "The request could not be read.")
+		return
+	}
+
+	var bodies []json.RawMessage
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		bodies = []json.RawMessage{trimmed}
+	} else if err := json.Unmarshal(body, &bodies); err != nil || len(bodies) == 0 {
+		respondError(c, http.StatusBadRequest, "The request must be a receipt or a non-empty JSON array of receipts.")
+		return
+	}
+
+	if len(bodies) > config.MaxAsyncBatch {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("At most %d receipts can be submitted in one job.", config.MaxAsyncBatch))
+		return
+	}
+
+	j := &job{
+		id:        uuid.New().String(),
+		status:    jobPending,
+		total:     len(bodies),
+		bodies:    bodies,
+		createdAt: clock.Now(),
+		requestID: c.GetString(requestIDKey),
+		clientIP:  c.ClientIP(),
+	}
+
+	jobsMu.Lock()
+	jobs[j.id] = j
+	jobsMu.Unlock()
+
+	select {
+	case jobQueue <- j:
+	default:
+		jobsMu.Lock()
+		delete(jobs, j.id)
+		jobsMu.Unlock()
+
+		c.Header("Retry-After", "1")
+		respondError(c, http.StatusServiceUnavailable, "Too many jobs are waiting to be processed.")
+		return
+	}
+
+	c.Header("Location", config.BasePath+"/jobs/"+j.id)
+	c.JSON(http.StatusAccepted, gin.H{"jobId": j.id})
+}
+
+// Reports a job's progress, with the results once it is complete
+func getJob(c *gin.Context) {
+	jobsMu.Lock()
+	j, found := jobs[c.Param("id")]
+	jobsMu.Unlock()
+
+	if !found {
+		respondError(c, http.StatusNotFound, "No job found for that ID.")
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	response := gin.H{
+		"id":        j.id,
+		"status":    j.status,
+		"total":     j.total,
+		"completed": len(j.results),
+		"createdAt": j.createdAt,
+	}
+	if j.status == jobComplete {
+		response["completedAt"] = j.completedAt
+		response["results"] = j.results
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A store whose writes wait until released
+type heldStore struct {
+	Store
+	release chan struct{}
+}
+
+func (s heldStore) Put(ctx context.Context, id string, receipt storedReceipt) (string, error) {
+	<-s.release
+	return s.Store.Put(ctx, id, receipt)
+}
+
+type jobStatus struct {
+	ID        string
+	Status    string
+	Total     int
+	Completed int
+	Results   []struct {
+		Index       int
+		ID          string
+		Points      *int
+		Description string
+	}
+}
+
+// Submits receipts for async processing, returning the job ID
+func submitJob(t *testing.T, h http.Handler, body string) string {
+	t.Helper()
+
+	w := send(h, http.MethodPost, "/receipts/process/async", body)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var accepted struct{ JobID string }
+	decode(t, w, &accepted)
+	if got, want := w.Header().Get("Location"), "/jobs/"+accepted.JobID; got != want {
+		t.Errorf("Location %q, want %q", got, want)
+	}
+	return accepted.JobID
+}
+
+func getJobStatus(t *testing.T, h http.Handler, id string) jobStatus {
+	t.Helper()
+
+	w := send(h, http.MethodGet, "/jobs/"+id, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var status jobStatus
+	decode(t, w, &status)
+	return status
+}
+
+// Polls until the job is complete
+func awaitJob(t *testing.T, h http.Handler, id string) jobStatus {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := getJobStatus(t, h, id)
+		if status.Status == jobComplete {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", status.Status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAsyncJob(t *testing.T) {
+	h := newTestServer(t, map[string]string{"ASYNC_WORKERS": "1", "ASYNC_QUEUE": "1", "MAX_ASYNC_BATCH": "2"})
+	release := make(chan struct{})
+	receipts = heldStore{Store: receipts, release: release}
+
+	// The only worker holds the first job while the second waits in the queue
+	first := submitJob(t, h, targetReceipt)
+	for getJobStatus(t, h, first).Status != jobRunning {
+		time.Sleep(time.Millisecond)
+	}
+	second := submitJob(t, h, `[`+targetReceipt+`, {"retailer": "Target"}]`)
+	if status := getJobStatus(t, h, second); status.Status != jobPending || status.Total != 2 || status.Completed != 0 || status.Results != nil {
+		t.Errorf("queued job %+v", status)
+	}
+
+	if w := send(h, http.MethodPost, "/receipts/process/async", targetReceipt); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("full queue: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	close(release)
+
+	status := awaitJob(t, h, second)
+	if status.ID != second || status.Total != 2 || status.Completed != 2 || len(status.Results) != 2 {
+		t.Fatalf("completed job %+v", status)
+	}
+	stored, invalid := status.Results[0], status.Results[1]
+	if stored.Index != 0 || stored.ID == "" || stored.Points == nil || *stored.Points != 28 {
+		t.Errorf("stored result %+v", stored)
+	}
+	if invalid.Index != 1 || invalid.ID != "" || invalid.Points != nil || invalid.Description == "" {
+		t.Errorf("invalid result %+v", invalid)
+	}
+	if w := send(h, http.MethodGet, "/receipts/"+stored.ID+"/points", ""); w.Code != http.StatusOK {
+		t.Errorf("stored receipt: status %d", w.Code)
+	}
+	awaitJob(t, h, first)
+
+	rejected := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "empty batch", body: `[]`, want: http.StatusBadRequest},
+		{name: "not a batch", body: `"receipt"`, want: http.StatusBadRequest},
+		{name: "too many receipts", body: `[{}, {}, {}]`, want: http.StatusBadRequest},
+	}
+	for _, tt := range rejected {
+		if w := send(h, http.MethodPost, "/receipts/process/async", tt.body); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+	if w := send(h, http.MethodGet, "/jobs/missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d", w.Code)
+	}
+}
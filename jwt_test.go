@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Checks the token's HS256 signature with the secret and decodes its claims
+func verifyJWT(t *testing.T, token, secret string) (pointsClaims, bool) {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q doesn't have three parts", token)
+	}
+
+	encoding := base64.RawURLEncoding
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return pointsClaims{}, false
+	}
+
+	var header struct{ Alg, Typ string }
+	headerJSON, _ := encoding.DecodeString(parts[0])
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "HS256" || header.Typ != "JWT" {
+		t.Fatalf("unexpected header %s", headerJSON)
+	}
+
+	var claims pointsClaims
+	payload, _ := encoding.DecodeString(parts[1])
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims, true
+}
+
+func TestPointsJWT(t *testing.T) {
+	h := newTestServer(t, map[string]string{"JWT_SECRET": "s3cret"})
+	clock = fixedClock(storeEpoch)
+	id := process(t, h, targetReceipt)
+
+	var response struct {
+		Points int
+		Token  string
+	}
+	decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points?format=jwt", ""), &response)
+
+	tests := []struct {
+		name   string
+		token  string
+		secret string
+		valid  bool
+	}{
+		{name: "issued", token: response.Token, secret: "s3cret", valid: true},
+		{name: "other secret", token: response.Token, secret: "guess", valid: false},
+		{name: "tampered", token: tamperPoints(t, response.Token), secret: "s3cret", valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, valid := verifyJWT(t, tt.token, tt.secret)
+			if valid != tt.valid {
+				t.Fatalf("signature valid %v, want %v", valid, tt.valid)
+			}
+			want := pointsClaims{Subject: id, Points: 28, IssuedAt: storeEpoch.Unix()}
+			if valid && claims != want {
+				t.Errorf("claims %+v, want %+v", claims, want)
+			}
+		})
+	}
+
+	if response.Points != 28 {
+		t.Errorf("points %d alongside the token, want 28", response.Points)
+	}
+
+	// Without a secret there is nothing to sign with
+	h = newTestServer(t, map[string]string{"JWT_SECRET": ""})
+	id = process(t, h, targetReceipt)
+	if w := send(h, http.MethodGet, "/receipts/"+id+"/points?format=jwt", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("without JWT_SECRET: status %d, want 400", w.Code)
+	}
+}
+
+// Rewrites the token's points claim, keeping the original signature
+func tamperPoints(t *testing.T, token string) string {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(payload), `"points":28`, `"points":2800`, 1)
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(tampered)) + "." + parts[2]
+}
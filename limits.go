@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A receipt is an object holding an array of item objects, so anything much
+// deeper than that is not a receipt
+const maxJSONDepth = 8
+
+var (
+	errBodyTooLarge  = errors.New("request body is too large")
+	errTooManyItems  = errors.New("receipt has too many items")
+	errTooDeep       = errors.New("request body is nested too deeply")
+	errNoReceiptPart = errors.New(`multipart upload has no "receipt" part`)
+)
+
+// A key appearing twice in one object, rejected under STRICT_JSON_KEYS rather than
+// letting the last value silently win
+type duplicateKeyError struct{ key string }
+
+func (e duplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate key %q", e.key)
+}
+
+const receiptBodyKey = "receiptBody"
+
+// Reads and checks the receipt before the handler runs, stopping as soon as the
+// items array passes MAX_ITEMS rather than after decoding all of it. Handlers find
+// the body under receiptBodyKey.
+func receiptBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := readReceiptBody(c)
+		switch {
+		case errors.Is(err, errBodyTooLarge):
+			respondError(c, http.StatusRequestEntityTooLarge, "The receipt is too large.")
+		case errors.Is(err, errTooManyItems):
+			respondError(c, http.StatusUnprocessableEntity, fmt.Sprintf("A receipt may have at most %d items.", config.MaxItems))
+		case errors.As(err, new(duplicateKeyError)):
+			respondError(c, http.StatusBadRequest, "The receipt is invalid.", err.Error())
+		case errors.Is(err, errNoReceiptPart):
+			respondError(c, http.StatusBadRequest, "Upload the receipt as a file part named receipt.")
+		case err != nil:
+			respondError(c, http.StatusBadRequest, "The receipt is invalid.")
+		default:
+			c.Set(receiptBodyKey, body)
+			c.Next()
+			return
+		}
+		c.Abort()
+	}
+}
+
+// Reading the body under a size limit and checking its shape before it is bound.
+// The receipt is either the whole body or, for multipart/form-data uploads, the
+// part named "receipt".
+func readReceiptBody(c *gin.Context) ([]byte, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, config.MaxBodyBytes)
+
+	var source io.Reader = c.Request.Body
+	if c.ContentType() == "multipart/form-data" {
+		part, err := receiptPart(c.Request)
+		if err != nil {
+			return nil, bodyError(err)
+		}
+		defer part.Close()
+		source = part
+	}
+
+	body, err := io.ReadAll(source)
+	if err != nil {
+		return nil, bodyError(err)
+	}
+
+	if err := checkReceiptShape(body); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// Finds the "receipt" part of a multipart upload without buffering the parts before it
+func receiptPart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, errNoReceiptPart
+		} else if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == "receipt" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+func bodyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errBodyTooLarge
+	}
+	return err
+}
+
+// Streams through the JSON tokens, bounding the nesting depth and the number of items
+// without materializing anything, and catching duplicate keys under STRICT_JSON_KEYS.
+// Items are counted in the top-level "items" array and in every department's
+// "items", since departments are flattened into one list.
+// Malformed JSON is left for binding to report.
+func checkReceiptShape(body []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+
+	type level struct {
+		object      bool
+		expectKey   bool
+		items       bool
+		departments bool
+		keys        map[string]struct{} // seen so far, case folded, when checking for duplicates
+	}
+
+	var (
+		stack []level
+		key   string
+		count int
+	)
+
+	// Called for every value, before descending into it if it is a container
+	value := func() error {
+		if len(stack) == 0 {
+			return nil
+		}
+		top := &stack[len(stack)-1]
+		if top.object {
+			top.expectKey = true
+		}
+		if top.items {
+			count++
+			if count > config.MaxItems {
+				return errTooManyItems
+			}
+		}
+		return nil
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+
+		delim, isDelim := token.(json.Delim)
+
+		if len(stack) > 0 && stack[len(stack)-1].expectKey && !isDelim {
+			top := &stack[len(stack)-1]
+			key, _ = token.(string)
+			top.expectKey = false
+			if top.keys != nil {
+				// Keys differing only in case bind to the same field
+				folded := strings.ToLower(strings.ToUpper(key))
+				if _, seen := top.keys[folded]; seen {
+					return duplicateKeyError{key}
+				}
+				top.keys[folded] = struct{}{}
+			}
+			continue
+		}
+
+		switch {
+		case isDelim && (delim == '{' || delim == '['):
+			if err := value(); err != nil {
+				return err
+			}
+			if len(stack) >= maxJSONDepth {
+				return errTooDeep
+			}
+			topLevel := len(stack) == 1 && stack[0].object
+			inDepartment := len(stack) == 3 && stack[1].departments && stack[2].object
+			// Binding matches keys ignoring case, so "ITEMS" fills Items just the same
+			items := delim == '[' && strings.EqualFold(key, "items") && (topLevel || inDepartment)
+			departments := delim == '[' && topLevel && strings.EqualFold(key, "departments")
+			next := level{object: delim == '{', expectKey: delim == '{', items: items, departments: departments}
+			if next.object && config.StrictJSONKeys {
+				next.keys = make(map[string]struct{})
+			}
+			stack = append(stack, next)
+		case isDelim:
+			stack = stack[:len(stack)-1]
+		default:
+			if err := value(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A receipt body with n items, leaving the rest of the fields out
+func itemsBody(n int) string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = `{"shortDescription": "Gum", "price": "1.00"}`
+	}
+	return `{"retailer": "Target", "items": [` + strings.Join(items, ",") + `]}`
+}
+
+func TestCheckReceiptShape(t *testing.T) {
+	t.Setenv("MAX_ITEMS", "3")
+	config = loadConfig()
+
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{name: "within the limit", body: itemsBody(3)},
+		{name: "too many items", body: itemsBody(4), want: errTooManyItems},
+		{name: "no items", body: `{"retailer": "Target"}`},
+		{name: "items key elsewhere", body: `{"meta": {"items": [1, 2, 3, 4]}, "items": []}`},
+		{name: "departments within the limit", body: `{"departments": [{"items": [1]}, {"items": [2, 3]}]}`},
+		{name: "too many items across departments", body: `{"departments": [{"items": [1, 2]}, {"items": [3, 4]}]}`, want: errTooManyItems},
+		{name: "items and departments together", body: `{"items": [1, 2], "departments": [{"items": [3, 4]}]}`, want: errTooManyItems},
+		{name: "items under another case", body: `{"items": [1], "ITEMS": [1, 2, 3]}`, want: errTooManyItems},
+		{name: "departments under another case", body: `{"Departments": [{"Items": [1, 2]}, {"iTeMs": [3, 4]}]}`, want: errTooManyItems},
+		{name: "departments key elsewhere", body: `{"meta": {"departments": [{"items": [1, 2, 3, 4]}]}}`},
+		{name: "items array of another array", body: `{"x": [{"items": [1, 2, 3, 4]}]}`},
+		{name: "deep nesting", body: `{"a": [[[[[[[[1]]]]]]]]}`, want: errTooDeep},
+		{name: "at the depth limit", body: `{"a": [[[[[[1]]]]]]}`},
+		{name: "malformed", body: `{"items": [1, 2`},
+		// Rejected at the fourth item, before the decoder reaches the rest
+		{name: "too many items, then truncated", body: `{"items": [{}, {}, {}, {}, {"shortDescription": `, want: errTooManyItems},
+		{name: "too many items, then malformed", body: `{"items": [1, 2, 3, 4, }}}`, want: errTooManyItems},
+		{name: "within the limit, then malformed", body: `{"items": [1, 2, 3]}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkReceiptShape([]byte(tt.body)); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceiptBodyLimits(t *testing.T) {
+	h := newTestServer(t, map[string]string{"MAX_ITEMS": "3", "MAX_BODY_BYTES": "2048"})
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "too many items", body: itemsBody(4), status: http.StatusUnprocessableEntity},
+		{name: "too many items, then truncated", body: strings.TrimSuffix(itemsBody(5), "]}"), status: http.StatusUnprocessableEntity},
+		// Binding fills Items from the last of the keys, so these four items would be stored
+		{name: "too many items under another case", body: strings.Replace(simpleReceipt("Target", "2022-01-01", "13:01", "4.00"), `], "total"`, `], "ITEMS": [`+strings.Repeat(`{"shortDescription": "Gum", "price": "1.00"}, `, 3)+`{"shortDescription": "Gum", "price": "1.00"}], "total"`, 1), status: http.StatusUnprocessableEntity},
+		{name: "truncated within the limit", body: strings.TrimSuffix(itemsBody(3), "]}"), status: http.StatusBadRequest},
+		{name: "too large", body: `{"retailer": "` + strings.Repeat("x", 2048) + `"}`, status: http.StatusRequestEntityTooLarge},
+		{name: "too deep", body: strings.Repeat("[", 20) + strings.Repeat("]", 20), status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := send(h, http.MethodPost, "/receipts/process", tt.body); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+// A multipart/form-data body with the given form file parts, and its content type
+func multipartBody(t *testing.T, parts map[string]string, order ...string) (string, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, name := range order {
+		part, err := w.CreateFormFile(name, name+".json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, parts[name])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.String(), w.FormDataContentType()
+}
+
+func TestMultipartReceipt(t *testing.T) {
+	h := newTestServer(t, nil)
+	raw := process(t, h, targetReceipt)
+
+	var want Receipt
+	decode(t, send(h, http.MethodGet, "/receipts/"+raw, ""), &want)
+	if want.Retailer != "Target" || len(want.Items) != 5 {
+		t.Fatalf("raw JSON receipt stored as %+v", want)
+	}
+
+	parts := map[string]string{"receipt": targetReceipt, "notes": `{"note": "from the file picker"}`}
+	tests := []struct {
+		name   string
+		order  []string
+		status int
+	}{
+		{name: "receipt only", order: []string{"receipt"}, status: http.StatusCreated},
+		{name: "after another part", order: []string{"notes", "receipt"}, status: http.StatusCreated},
+		{name: "no receipt part", order: []string{"notes"}, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := multipartBody(t, parts, tt.order...)
+			w := send(h, http.MethodPost, "/receipts/process", body, "Content-Type", contentType)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusCreated {
+				return
+			}
+
+			var created struct{ ID string }
+			decode(t, w, &created)
+			var got Receipt
+			decode(t, send(h, http.MethodGet, "/receipts/"+created.ID, ""), &got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("uploaded receipt %+v, want %+v", got, want)
+			}
+
+			var points struct{ Points int }
+			decode(t, send(h, http.MethodGet, "/receipts/"+created.ID+"/points", ""), &points)
+			if points.Points != 28 {
+				t.Errorf("uploaded receipt earned %d points, want 28", points.Points)
+			}
+		})
+	}
+}
+
+func TestItemBudget(t *testing.T) {
+	// Every other item earns rule 5's point, which a sample of every other item overstates
+	items := make([]string, 8)
+	for i := range items {
+		description := "Gum"
+		if i%2 == 1 {
+			description = "Bread"
+		}
+		items[i] = `{"shortDescription": "` + description + `", "price": "1.00"}`
+	}
+	body := `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "total": "8.00", "items": [` + strings.Join(items, ",") + `]}`
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		status int
+		points int // from the item rules
+	}{
+		{name: "no budget", status: http.StatusCreated, points: 24},
+		{name: "within the budget", env: map[string]string{"ITEM_BUDGET": "8"}, status: http.StatusCreated, points: 24},
+		{name: "rejected", env: map[string]string{"ITEM_BUDGET": "4"}, status: http.StatusRequestEntityTooLarge},
+		{name: "approximated", env: map[string]string{"ITEM_BUDGET": "4", "ITEM_BUDGET_MODE": "approximate"}, status: http.StatusCreated, points: 28},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, tt.env)
+			w := send(h, http.MethodPost, "/receipts/process", body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusCreated {
+				return
+			}
+
+			var created struct{ ID string }
+			decode(t, w, &created)
+			var got struct{ Points int }
+			decode(t, send(h, http.MethodGet, "/receipts/"+created.ID+"/points?rule=items", ""), &got)
+			if got.Points != tt.points {
+				t.Errorf("items earned %d points, want %d", got.Points, tt.points)
+			}
+		})
+	}
+}
+
+func TestDuplicateJSONKeys(t *testing.T) {
+	duplicateTotal := strings.Replace(targetReceipt, `"total": "35.35"`, `"total": "99.99", "total": "35.35"`, 1)
+	duplicatePrice := strings.Replace(targetReceipt, `"price": "6.49"`, `"price": "1.00", "price": "6.49"`, 1)
+
+	tests := []struct {
+		name   string
+		strict string
+		body   string
+		status int
+		errors []string
+	}{
+		{name: "lenient, last value wins", strict: "false", body: duplicateTotal, status: http.StatusCreated},
+		{name: "lenient, nested", strict: "false", body: duplicatePrice, status: http.StatusCreated},
+		{name: "strict", strict: "true", body: duplicateTotal, status: http.StatusBadRequest, errors: []string{`duplicate key "total"`}},
+		{name: "strict, nested", strict: "true", body: duplicatePrice, status: http.StatusBadRequest, errors: []string{`duplicate key "price"`}},
+		{name: "lenient, differing case", strict: "false", body: strings.Replace(duplicateTotal, `"total": "35.35"`, `"Total": "35.35"`, 1), status: http.StatusCreated},
+		{name: "strict, differing case", strict: "true", body: strings.Replace(duplicateTotal, `"total": "35.35"`, `"Total": "35.35"`, 1), status: http.StatusBadRequest, errors: []string{`duplicate key "Total"`}},
+		{name: "strict, differing case, nested", strict: "true", body: strings.Replace(duplicatePrice, `"price": "6.49"`, `"PRICE": "6.49"`, 1), status: http.StatusBadRequest, errors: []string{`duplicate key "PRICE"`}},
+		{name: "strict, same key in different objects", strict: "true", body: targetReceipt, status: http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, map[string]string{"STRICT_JSON_KEYS": tt.strict})
+
+			w := send(h, http.MethodPost, "/receipts/process", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.errors == nil {
+				return
+			}
+			var got struct{ Errors []string }
+			decode(t, w, &got)
+			if !reflect.DeepEqual(got.Errors, tt.errors) {
+				t.Errorf("errors %q, want %q", got.Errors, tt.errors)
+			}
+
+			// Batch validation rejects the same receipt
+			var batch struct{ Results []validationResult }
+			decode(t, send(h, http.MethodPost, "/receipts/validate/batch", "["+tt.body+"]"), &batch)
+			if len(batch.Results) != 1 || batch.Results[0].Valid || !reflect.DeepEqual(batch.Results[0].Errors, tt.errors) {
+				t.Errorf("batch validation %+v", batch.Results)
+			}
+		})
+	}
+}
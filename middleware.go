@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDKey  = "requestId"
+	apiVersionKey = "apiVersion"
+)
+
+// Versions the API can serve; requests without a version header get the current one
+const currentAPIVersion = "1"
+
+var supportedAPIVersions = map[string]bool{"1": true}
+
+// Wraps the response writer so a middleware can add headers once the handler is
+// done, right before they are sent to the client
+type headerWriter struct {
+	gin.ResponseWriter
+	before func()
+	done   bool
+}
+
+func (w *headerWriter) setHeaders() {
+	if !w.done {
+		w.done = true
+		w.before()
+	}
+}
+
+func (w *headerWriter) WriteHeaderNow() {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *headerWriter) Write(data []byte) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *headerWriter) WriteString(s string) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *headerWriter) Flush() {
+	w.setHeaders()
+	w.ResponseWriter.Flush()
+}
+
+// Runs fn right before the response headers are written, including for responses without a body
+func beforeHeaders(c *gin.Context, fn func()) {
+	w := &headerWriter{ResponseWriter: c.Writer, before: fn}
+	c.Writer = w
+	defer w.setHeaders()
+	c.Next()
+}
+
+// Reports the handler duration in the X-Response-Time header
+func responseTime() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		beforeHeaders(c, func() {
+			elapsed := float64(time.Since(start).Microseconds()) / 1000
+			c.Header("X-Response-Time", fmt.Sprintf("%.3fms", elapsed))
+		})
+	}
+}
+
+// Headers the app reads, logs or echoes back. The API version header is added from config.
+var checkedHeaders = []string{"X-Request-ID", "Authorization", "If-None-Match", "Accept"}
+
+// Rejects requests whose checked headers hold control characters or run longer than
+// MAX_HEADER_LENGTH, so they can't forge log lines or smuggle headers into responses
+func checkHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, name := range append(checkedHeaders, config.APIVersionHeader) {
+			for _, value := range c.Request.Header.Values(name) {
+				if problem := headerProblem(value); problem != "" {
+					log.Printf("rejected request from %s: %s header %s", c.ClientIP(), name, problem)
+					respondError(c, http.StatusBadRequest, fmt.Sprintf("The %s header %s.", name, problem))
+					c.Abort()
+					return
+				}
+			}
+		}
+		c.Next()
+	}
+}
+
+func headerProblem(value string) string {
+	if len(value) > config.MaxHeaderLength {
+		return fmt.Sprintf("is longer than %d bytes", config.MaxHeaderLength)
+	}
+	if strings.ContainsFunc(value, func(r rune) bool { return r < ' ' || r == 0x7f }) {
+		return "contains control characters"
+	}
+	return ""
+}
+
+// Tags each request with the caller's X-Request-ID, or a fresh one, and echoes it back
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" {
+			id = uuid.New().String()
+		}
+		c.Set(requestIDKey, id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// Rejects requests asking for an API version we can't serve. The header may be
+// omitted unless configured as required, so existing clients keep working.
+func apiVersion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		version := strings.TrimPrefix(strings.TrimSpace(c.GetHeader(config.APIVersionHeader)), "v")
+
+		if version == "" {
+			if config.APIVersionRequired {
+				respondError(c, http.StatusBadRequest, "The "+config.APIVersionHeader+" header is required.")
+				c.Abort()
+				return
+			}
+			version = currentAPIVersion
+		}
+
+		if !supportedAPIVersions[version] {
+			respondError(c, http.StatusBadRequest, "Unsupported API version.")
+			c.Abort()
+			return
+		}
+
+		c.Set(apiVersionKey, version)
+		c.Next()
+	}
+}
+
+// Flags configured routes with Deprecation (RFC 9745) and Sunset (RFC 8594) headers.
+// Routes are configured relative to BASE_PATH.
+func deprecationHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := strings.TrimPrefix(c.FullPath(), config.BasePath)
+		if d, deprecated := config.DeprecatedRoutes[c.Request.Method+" "+path]; deprecated {
+			c.Header("Deprecation", fmt.Sprintf("@%d", d.Since.Unix()))
+			if !d.Sunset.IsZero() {
+				c.Header("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// Rejects bodies declared larger than MAX_BODY_BYTES before reading anything. The
+// server only sends "100 Continue" once a handler reads the body, so clients using
+// "Expect: 100-continue" are turned away before uploading. Bodies without a
+// Content-Length are capped while being read instead.
+func limitBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > config.MaxBodyBytes {
+			respondError(c, http.StatusRequestEntityTooLarge, "The request body is too large.")
+			c.Abort()
+			return
+		}
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, config.MaxBodyBytes)
+		c.Next()
+	}
+}
+
+// Gives each request a deadline. Store calls give up once it passes, and the
+// handler answers 504 rather than hanging.
+func requestTimeout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.RequestTimeout <= 0 {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), config.RequestTimeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// Reports the number of stored receipts in the X-Receipt-Count header, as of when
+// the response is sent
+func receiptCount() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		beforeHeaders(c, func() {
+			c.Header("X-Receipt-Count", strconv.Itoa(receipts.Len()))
+		})
+	}
+}
+
+// Guards admin endpoints with the ADMIN_TOKEN bearer token
+func adminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdmin(c) {
+			respondError(c, http.StatusUnauthorized, "A valid admin token is required.")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func isAdmin(c *gin.Context) bool {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return found && config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
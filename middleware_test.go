@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseTime(t *testing.T) {
+	h := newTestServer(t, nil)
+	id := process(t, h, targetReceipt)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "success", method: http.MethodGet, path: "/receipts/" + id + "/points", status: http.StatusOK},
+		{name: "not found", method: http.MethodGet, path: "/receipts/missing/points", status: http.StatusNotFound},
+		{name: "invalid", method: http.MethodPost, path: "/receipts/process", body: `{"retailer": ""}`, status: http.StatusBadRequest},
+		{name: "no route", method: http.MethodGet, path: "/nowhere", status: http.StatusNotFound},
+	}
+
+	pattern := regexp.MustCompile(`^\d+\.\d{3}ms$`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, tt.method, tt.path, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("X-Response-Time"); !pattern.MatchString(got) {
+				t.Errorf("X-Response-Time is %q, want milliseconds like 0.123ms", got)
+			}
+		})
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		header []string
+		status int
+	}{
+		{name: "optional and absent", status: http.StatusOK},
+		{name: "version 1", header: []string{"Accept-Version", "1"}, status: http.StatusOK},
+		{name: "v1", header: []string{"Accept-Version", " v1 "}, status: http.StatusOK},
+		{name: "unsupported", header: []string{"Accept-Version", "2"}, status: http.StatusBadRequest},
+		{name: "required and absent", env: map[string]string{"API_VERSION_REQUIRED": "true"}, status: http.StatusBadRequest},
+		{name: "required and present", env: map[string]string{"API_VERSION_REQUIRED": "true"}, header: []string{"Accept-Version", "1"}, status: http.StatusOK},
+		{
+			name:   "custom header",
+			env:    map[string]string{"API_VERSION_HEADER": "X-API-Version", "API_VERSION_REQUIRED": "true"},
+			header: []string{"X-API-Version", "v1"},
+			status: http.StatusOK,
+		},
+		{
+			name:   "custom header ignores the default one",
+			env:    map[string]string{"API_VERSION_HEADER": "X-API-Version", "API_VERSION_REQUIRED": "true"},
+			header: []string{"Accept-Version", "1"},
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, tt.env)
+			if w := send(h, http.MethodGet, "/receipts/search?q=milk", "", tt.header...); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	// Operational endpoints aren't versioned
+	h := newTestServer(t, map[string]string{"API_VERSION_REQUIRED": "true"})
+	if w := send(h, http.MethodGet, "/readyz", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /readyz without a version: status %d", w.Code)
+	}
+}
+
+func TestDeprecationHeaders(t *testing.T) {
+	h := newTestServer(t, map[string]string{
+		"BASE_PATH":         "/api",
+		"DEPRECATED_ROUTES": "GET /receipts/:id/points 2026-10-01 2027-06-30; POST /receipts/points/batch 2026-01-01",
+	})
+	var created struct{ ID string }
+	decode(t, send(h, http.MethodPost, "/api/receipts/process", targetReceipt), &created)
+	id := created.ID
+
+	deprecatedOn := func(year int, month time.Month, day int) string {
+		return fmt.Sprintf("@%d", time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix())
+	}
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		deprecation string
+		sunset      string
+	}{
+		{
+			name: "with sunset", method: http.MethodGet, path: "/api/receipts/" + id + "/points",
+			deprecation: deprecatedOn(2026, time.October, 1), sunset: "Wed, 30 Jun 2027 00:00:00 GMT",
+		},
+		{
+			name: "without sunset", method: http.MethodPost, path: "/api/receipts/points/batch", body: `[]`,
+			deprecation: deprecatedOn(2026, time.January, 1),
+		},
+		{name: "other method", method: http.MethodHead, path: "/api/receipts/" + id + "/points"},
+		{name: "other route", method: http.MethodGet, path: "/api/receipts/" + id},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(h, tt.method, tt.path, tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Deprecation"); got != tt.deprecation {
+				t.Errorf("Deprecation %q, want %q", got, tt.deprecation)
+			}
+			if got := w.Header().Get("Sunset"); got != tt.sunset {
+				t.Errorf("Sunset %q, want %q", got, tt.sunset)
+			}
+		})
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	h := newTestServer(t, map[string]string{"MAX_BODY_BYTES": "1024"})
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		path          string
+		contentLength int
+		want          string // first status line from the server
+	}{
+		{name: "too large", path: "/receipts/process", contentLength: 4096, want: "HTTP/1.1 413 Request Entity Too Large"},
+		{name: "too large batch", path: "/receipts/points/batch", contentLength: 4096, want: "HTTP/1.1 413 Request Entity Too Large"},
+		{name: "within the limit", path: "/receipts/process", contentLength: 512, want: "HTTP/1.1 100 Continue"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// Headers only: the body is only worth sending once the server asks for it
+			fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", tt.path, tt.contentLength)
+
+			status, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(status); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// A store whose reads and writes take delay, giving up early if the context ends
+type slowStore struct {
+	Store
+	delay time.Duration
+}
+
+func (s slowStore) wait(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s slowStore) Get(ctx context.Context, id string) (storedReceipt, error) {
+	if err := s.wait(ctx); err != nil {
+		return storedReceipt{}, err
+	}
+	return s.Store.Get(ctx, id)
+}
+
+func (s slowStore) GetMany(ctx context.Context, ids []string) (map[string]storedReceipt, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.Store.GetMany(ctx, ids)
+}
+
+func (s slowStore) Put(ctx context.Context, id string, receipt storedReceipt) (string, error) {
+	if err := s.wait(ctx); err != nil {
+		return "", err
+	}
+	return s.Store.Put(ctx, id, receipt)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		status  int
+	}{
+		{name: "no deadline", timeout: "", status: http.StatusOK},
+		{name: "within the deadline", timeout: "1s", status: http.StatusOK},
+		{name: "past the deadline", timeout: "10ms", status: http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, map[string]string{"REQUEST_TIMEOUT": tt.timeout})
+			id := process(t, h, targetReceipt)
+			receipts = slowStore{Store: receipts, delay: 50 * time.Millisecond}
+
+			requests := []struct {
+				method, path, body string
+				status             int
+			}{
+				{http.MethodGet, "/receipts/" + id, "", http.StatusOK},
+				{http.MethodGet, "/receipts/" + id + "/points", "", http.StatusOK},
+				{http.MethodPost, "/receipts/points/batch", `["` + id + `"]`, http.StatusOK},
+				{http.MethodPost, "/receipts/process", targetReceipt, http.StatusCreated},
+			}
+			for _, r := range requests {
+				want := r.status
+				if tt.status != http.StatusOK {
+					want = tt.status
+				}
+
+				start := time.Now()
+				w := send(h, r.method, r.path, r.body)
+				if w.Code != want {
+					t.Errorf("%s %s: status %d, want %d: %s", r.method, r.path, w.Code, want, w.Body)
+				}
+				if tt.status == http.StatusGatewayTimeout && time.Since(start) >= 50*time.Millisecond {
+					t.Errorf("%s %s: waited %v for the store past the deadline", r.method, r.path, time.Since(start))
+				}
+			}
+		})
+	}
+}
+
+func TestReceiptCountHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string
+		want    []string // after each processed receipt
+	}{
+		{name: "enabled", enabled: "true", want: []string{"1", "2", "3"}},
+		{name: "disabled", enabled: "false", want: []string{"", "", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, map[string]string{"RECEIPT_COUNT_HEADER": tt.enabled})
+
+			for i, want := range tt.want {
+				w := send(h, http.MethodPost, "/receipts/process", simpleReceipt("Target", "2022-01-01", "13:01", fmt.Sprintf("%d.00", i+1)))
+				if got := w.Header().Get("X-Receipt-Count"); got != want {
+					t.Errorf("after receipt %d: X-Receipt-Count %q, want %q", i+1, got, want)
+				}
+				if got := send(h, http.MethodGet, "/readyz", "").Header().Get("X-Receipt-Count"); got != want {
+					t.Errorf("GET /readyz after receipt %d: X-Receipt-Count %q, want %q", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckHeaders(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	h := newTestServer(t, map[string]string{"MAX_HEADER_LENGTH": "32"})
+	id := process(t, h, targetReceipt)
+
+	tests := []struct {
+		name        string
+		header      string
+		value       string
+		description string // empty when the request is let through
+	}{
+		{name: "ordinary", header: "X-Request-ID", value: "req-1"},
+		{name: "at the limit", header: "X-Request-ID", value: strings.Repeat("a", 32)},
+		{name: "too long", header: "X-Request-ID", value: strings.Repeat("a", 33), description: "The X-Request-ID header is longer than 32 bytes."},
+		{name: "newline", header: "X-Request-ID", value: "req-1\nINFO forged entry", description: "The X-Request-ID header contains control characters."},
+		{name: "carriage return", header: "If-None-Match", value: "*\r\nSet-Cookie: a=b", description: "The If-None-Match header contains control characters."},
+		{name: "null byte", header: "Authorization", value: "Bearer a\x00b", description: "The Authorization header contains control characters."},
+		{name: "delete", header: "Accept", value: "application/json\x7f", description: "The Accept header contains control characters."},
+		{name: "API version header", header: "Accept-Version", value: "1\t2", description: "The Accept-Version header contains control characters."},
+		{name: "unchecked header", header: "X-Other", value: "a\tb"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logged.Reset()
+			w := send(h, http.MethodGet, "/receipts/"+id+"/points", "", tt.header, tt.value)
+			if tt.description == "" {
+				if w.Code != http.StatusOK {
+					t.Errorf("status %d: %s", w.Code, w.Body)
+				}
+				return
+			}
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			var got struct{ Description string }
+			decode(t, w, &got)
+			if got.Description != tt.description {
+				t.Errorf("description %q, want %q", got.Description, tt.description)
+			}
+
+			// Logged on one line, without the offending value
+			line := logged.String()
+			if !strings.Contains(line, "rejected request") || strings.Count(line, "\n") != 1 || strings.Contains(line, tt.value) {
+				t.Errorf("logged %q", line)
+			}
+		})
+	}
+}
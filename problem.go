@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const problemContentType = "application/problem+json"
+
+// RFC 7807 problem details, with the request ID and any validation errors as extensions
+type problemDetails struct {
+	Type      string   `json:"type"`
+	Title     string   `json:"title"`
+	Status    int      `json:"status"`
+	Detail    string   `json:"detail"`
+	Instance  string   `json:"instance"`
+	RequestID string   `json:"requestId,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// Answers with an error in the usual {"description", "errors"} envelope, or as
+// problem details when PROBLEM_DETAILS is set or the client accepts them
+func respondError(c *gin.Context, status int, description string, problems ...string) {
+	if config.ProblemDetails || strings.Contains(c.GetHeader("Accept"), problemContentType) {
+		c.Header("Content-Type", problemContentType)
+		c.JSON(status, problemDetails{
+			Type:      "about:blank",
+			Title:     http.StatusText(status),
+			Status:    status,
+			Detail:    description,
+			Instance:  c.Request.URL.Path,
+			RequestID: c.GetString(requestIDKey),
+			Errors:    problems,
+		})
+		return
+	}
+
+	response := gin.H{"description": description}
+	if len(problems) > 0 {
+		response["errors"] = problems
+	}
+	c.JSON(status, response)
+}
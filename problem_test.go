@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProblemDetails(t *testing.T) {
+	mismatched := strings.Replace(targetReceipt, `"35.35"`, `"40.00"`, 1)
+	problem := problemDetails{
+		Type:      "about:blank",
+		Title:     "Unprocessable Entity",
+		Status:    http.StatusUnprocessableEntity,
+		Detail:    "The receipt is invalid.",
+		Instance:  "/receipts/process",
+		RequestID: "req-1",
+		Errors:    []string{"total 40.00 does not match the sum of item prices 35.35, a difference of 4.65"},
+	}
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		accept      string
+		contentType string
+	}{
+		{name: "envelope by default", contentType: "application/json; charset=utf-8"},
+		{name: "accepted by the client", accept: "application/problem+json", contentType: problemContentType},
+		{name: "among other types", accept: "application/json, application/problem+json;q=0.9", contentType: problemContentType},
+		{name: "configured", env: map[string]string{"PROBLEM_DETAILS": "true"}, contentType: problemContentType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, tt.env)
+			header := []string{"X-Request-ID", "req-1"}
+			if tt.accept != "" {
+				header = append(header, "Accept", tt.accept)
+			}
+
+			w := send(h, http.MethodPost, "/receipts/process", mismatched, header...)
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Fatalf("Content-Type %q, want %q", got, tt.contentType)
+			}
+
+			if tt.contentType != problemContentType {
+				var got struct {
+					Description string
+					Errors      []string
+				}
+				decode(t, w, &got)
+				if got.Description != problem.Detail || !reflect.DeepEqual(got.Errors, problem.Errors) {
+					t.Errorf("got %s", w.Body)
+				}
+				return
+			}
+
+			var got problemDetails
+			decode(t, w, &got)
+			if !reflect.DeepEqual(got, problem) {
+				t.Errorf("got %+v, want %+v", got, problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Scoring rules that can be tuned without code changes, loaded from the JSON
+// file named by RULE_CONFIG. The zero value of every rule leaves it disabled.
+type RuleConfig struct {
+	// Canonical retailer names by alias, e.g. "Wal-Mart": "Walmart". Aliases match
+	// ignoring case and anything but letters and digits.
+	RetailerAliases map[string]string `json:"retailerAliases"`
+
+	// Extra validation for retailers with a known receipt format, keyed like aliases
+	RetailerProfiles map[string]RetailerProfile `json:"retailerProfiles"`
+
+	// When set, only receipts from these retailers are accepted. Names match like
+	// aliases, by the name as sent or its canonical name.
+	AllowedRetailers []string `json:"allowedRetailers"`
+	allowed          map[string]struct{}
+
+	// Rule 1 counts any Unicode letter or digit in the retailer name, not just ASCII
+	UnicodeRetailerNames bool `json:"unicodeRetailerNames"`
+
+	RetailerScoring RetailerScoringRule `json:"retailerScoring"`
+
+	TotalBonus TotalBonusRule `json:"totalBonus"`
+
+	// Points per unit of the digit sum of the total in cents, e.g. 35.35 sums to 16
+	TotalDigitSumMultiplier int `json:"totalDigitSumMultiplier"`
+
+	// Rule 4 counts a lone last item as a pair, rather than dropping it
+	RoundUpItemPairs bool `json:"roundUpItemPairs"`
+
+	// Rule 5 applies to items whose trimmed description length is a multiple of this
+	ItemDescriptionDivisor int `json:"itemDescriptionDivisor"`
+
+	// Rule 5 awards this fraction of an item's price, with the fraction of a point
+	// rounded like PointsRounding. Defaults to 0.2 rounded up.
+	ItemPriceMultiplier float64 `json:"itemPriceMultiplier"`
+	ItemPriceRounding   string  `json:"itemPriceRounding"`
+
+	// Scales rule 5's points for items by category, e.g. produce earning double
+	Catalog CatalogRule `json:"catalog"`
+
+	DistinctItemPoints int             `json:"distinctItemPoints"`
+	BigBasket          BigBasketRule   `json:"bigBasket"`
+	PriceSpread        PriceSpreadRule `json:"priceSpread"`
+	PriceEnding        PriceEndingRule `json:"priceEnding"`
+
+	Holidays   HolidayRule    `json:"holidays"`
+	TimeWindow TimeWindowRule `json:"timeWindow"`
+
+	// Bonus for the first receipt stored for a retailer on a purchase date. This
+	// makes scoring depend on previously processed receipts.
+	FirstOfDayPoints int `json:"firstOfDayPoints"`
+
+	// Bonus for the first receipt stored for a retailer on a purchase date when one for
+	// the day before is already stored, extending a streak. Also depends on earlier receipts.
+	StreakPoints int `json:"streakPoints"`
+
+	// Bonus per optional field the receipt fills in, to encourage complete submissions
+	Completeness CompletenessRule `json:"completeness"`
+
+	// Bonus for receipts processed soon after the purchase, to encourage timely uploads
+	PromptSubmission PromptSubmissionRule `json:"promptSubmission"`
+
+	// Rejects a receipt from a retailer within this many seconds of the last one stored
+	// for it, by server time, to curb farming. 0 disables the cooldown.
+	RetailerCooldownSeconds int `json:"retailerCooldownSeconds"`
+
+	// How validation compares the total to the sum of item prices: "tolerance" allows a
+	// difference of up to TotalToleranceCents, "exact" requires the decimal amounts as
+	// written to add up with no rounding at all
+	TotalMatch          string `json:"totalMatch"`
+	TotalToleranceCents int64  `json:"totalToleranceCents"`
+
+	// Rule 2 also counts totals this many cents away from a whole dollar as round.
+	// This is separate from the tolerance used when validating totals.
+	RoundDollarToleranceCents int64 `json:"roundDollarToleranceCents"`
+
+	// Reject receipts listing the same description and price more than once
+	RejectDuplicateItems bool `json:"rejectDuplicateItems"`
+
+	// Soft checks that flag a valid receipt in the response without rejecting it
+	Warnings WarningRules `json:"warnings"`
+
+	// Reject totals and item prices above these amounts. 0 means no maximum.
+	MaxTotalCents     int64 `json:"maxTotalCents"`
+	MaxItemPriceCents int64 `json:"maxItemPriceCents"`
+
+	// Rules named here are evaluated first, in this order, followed by the rest
+	RuleOrder []string `json:"ruleOrder"`
+
+	// Rules defined as expressions over receipt fields, such as `total > 10 ? 20 : 0`,
+	// evaluated after the built-in and custom rules unless ordered otherwise
+	ExpressionRules []ExpressionRule `json:"expressionRules"`
+
+	// Most points the rules can award together, before the divisor. 0 means no cap.
+	// With ShortCircuit, evaluation stops once the cap is reached, so only rules
+	// ordered earlier count; otherwise every rule runs and the total is trimmed.
+	MaxPoints    int  `json:"maxPoints"`
+	ShortCircuit bool `json:"shortCircuit"`
+
+	// Final points are divided by this to express them in the consumer's unit, and
+	// any fraction is then rounded "up", "down", to the "nearest" whole point, or
+	// dropped when "none"
+	PointsDivisor  int    `json:"pointsDivisor"`
+	PointsRounding string `json:"pointsRounding"`
+
+	// Points lose half their current value every this many days after the receipt was
+	// processed. Stored points are unchanged; the decayed value is reported alongside.
+	// 0 means no decay.
+	PointsHalfLifeDays int `json:"pointsHalfLifeDays"`
+
+	// Named tiers the final points fall into, in ascending order of MinPoints.
+	// Receipts below the lowest tier have no tier.
+	RewardTiers []RewardTier `json:"rewardTiers"`
+
+	// Least points any valid receipt earns, after the divisor. 0 means no floor.
+	MinPoints int `json:"minPoints"`
+
+	// Receipts with fewer items earn no points at all, whatever the other rules and
+	// MinPoints give. 1, the default, lets every receipt earn points.
+	MinItemsForPoints int `json:"minItemsForPoints"`
+
+	// Hash of the effective config, set when it is loaded, to tell which rules scored a
+	// receipt. Configs with the same settings share a version across reloads and restarts.
+	version string
+}
+
+// Checks layered on top of the base validation for one retailer's receipts. Zero
+// values leave a check out.
+type RetailerProfile struct {
+	TotalMultipleCents int64  `json:"totalMultipleCents"` // e.g. 5 where prices are rounded to 5 cents
+	DescriptionPattern string `json:"descriptionPattern"` // regular expression every trimmed description must match
+	MaxItems           int    `json:"maxItems"`
+
+	description *regexp.Regexp
+}
+
+func (p RetailerProfile) check(receipt Receipt) error {
+	if p.TotalMultipleCents > 0 {
+		if cents, err := parseCents(string(receipt.Total)); err != nil || cents%p.TotalMultipleCents != 0 {
+			return fmt.Errorf("total %s must be a multiple of %s", receipt.Total, formatCents(p.TotalMultipleCents))
+		}
+	}
+	if p.MaxItems > 0 && len(receipt.Items) > p.MaxItems {
+		return fmt.Errorf("at most %d items are expected, got %d", p.MaxItems, len(receipt.Items))
+	}
+	if p.description != nil {
+		for i, item := range receipt.Items {
+			if description := strings.TrimSpace(item.ShortDescription); !p.description.MatchString(description) {
+				return fmt.Errorf("items[%d].shortDescription %q must match %s", i, description, p.DescriptionPattern)
+			}
+		}
+	}
+	return nil
+}
+
+// The profile for a retailer, matched by its name as sent or its canonical name
+func (rc RuleConfig) retailerProfile(retailer string) (RetailerProfile, bool) {
+	if profile, found := rc.RetailerProfiles[aliasKey(retailer)]; found {
+		return profile, true
+	}
+	if canonical, aliased := rc.RetailerAliases[aliasKey(retailer)]; aliased {
+		profile, found := rc.RetailerProfiles[aliasKey(canonical)]
+		return profile, found
+	}
+	return RetailerProfile{}, false
+}
+
+// Reports whether receipts from the retailer are accepted
+func (rc RuleConfig) retailerAllowed(retailer string) bool {
+	if rc.allowed == nil {
+		return true
+	}
+	if _, found := rc.allowed[aliasKey(retailer)]; found {
+		return true
+	}
+	canonical, aliased := rc.RetailerAliases[aliasKey(retailer)]
+	if aliased {
+		_, found := rc.allowed[aliasKey(canonical)]
+		return found
+	}
+	return false
+}
+
+// Each check is off when left at its zero value
+type WarningRules struct {
+	TotalAboveCents    int64  `json:"totalAboveCents"`    // flags unusually large totals
+	DescriptionPattern string `json:"descriptionPattern"` // flags trimmed descriptions not matching it
+
+	description *regexp.Regexp
+}
+
+// Why the receipt looks unusual, if it does
+func (w WarningRules) check(receipt Receipt) []string {
+	var warnings []string
+	if w.TotalAboveCents > 0 && exceedsCents(receipt.Total, w.TotalAboveCents) {
+		warnings = append(warnings, fmt.Sprintf("total %s is above %s", receipt.Total, formatCents(w.TotalAboveCents)))
+	}
+	if w.description != nil {
+		for i, item := range receipt.Items {
+			if description := strings.TrimSpace(item.ShortDescription); !w.description.MatchString(description) {
+				warnings = append(warnings, fmt.Sprintf("items[%d].shortDescription %q does not match %s", i, description, w.DescriptionPattern))
+			}
+		}
+	}
+	return warnings
+}
+
+type ExpressionRule struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+
+	compiled *expression
+}
+
+type RewardTier struct {
+	Name      string `json:"name"`
+	MinPoints int    `json:"minPoints"`
+}
+
+// The current value of points earned at createdAt, rounded like PointsRounding
+func (rc RuleConfig) decayedPoints(points int, createdAt, now time.Time) int {
+	days := max(now.Sub(createdAt).Hours()/24, 0)
+	return roundPoints(float64(points)*math.Pow(0.5, days/float64(rc.PointsHalfLifeDays)), rc.PointsRounding)
+}
+
+// The highest tier the points reach, if any
+func (rc RuleConfig) tierFor(points int) (string, bool) {
+	for i := len(rc.RewardTiers) - 1; i >= 0; i-- {
+		if points >= rc.RewardTiers[i].MinPoints {
+			return rc.RewardTiers[i].Name, true
+		}
+	}
+	return "", false
+}
+
+// How rule 1 treats retailer names longer than Length characters: "linear" counts
+// every character, "capped" stops at Length and "log" adds one point each time the
+// excess doubles
+type RetailerScoringRule struct {
+	Mode   string `json:"mode"` // empty is the same as "linear"
+	Length int    `json:"length"`
+}
+
+// Bonus for purchase times from Start up to but excluding End, both "15:04". A window
+// ending before it starts wraps past midnight.
+type TimeWindowRule struct {
+	Start  string `json:"start"`
+	End    string `json:"end"`
+	Points int    `json:"points"` // 0 disables the bonus
+}
+
+// Bonus for purchases on holidays. Dates are either "MM-DD", recurring every year, or
+// "YYYY-MM-DD" for a one-off.
+type HolidayRule struct {
+	Dates  []string `json:"dates"`
+	Points int      `json:"points"`
+}
+
+// Reports whether the purchase date, already validated, is one of the holidays
+func (h HolidayRule) includes(purchaseDate string) bool {
+	for _, date := range h.Dates {
+		if date == purchaseDate || len(date) == len("01-02") && strings.HasSuffix(purchaseDate, "-"+date) {
+			return true
+		}
+	}
+	return false
+}
+
+// Categories are tried in order, and an item belongs to the first with a keyword its
+// description contains, ignoring case. Multipliers have at most two decimal places.
+type CatalogRule struct {
+	Categories        []ItemCategory `json:"categories"`
+	DefaultMultiplier float64        `json:"defaultMultiplier"` // for items in no category
+}
+
+type ItemCategory struct {
+	Name       string   `json:"name"`
+	Keywords   []string `json:"keywords"`
+	Multiplier float64  `json:"multiplier"`
+}
+
+// The multiplier for an item, in hundredths
+func (c CatalogRule) percent(description string) int64 {
+	description = strings.ToLower(description)
+	for _, category := range c.Categories {
+		for _, keyword := range category.Keywords {
+			if strings.Contains(description, strings.ToLower(keyword)) {
+				return int64(math.Round(category.Multiplier * 100))
+			}
+		}
+	}
+	return int64(math.Round(c.DefaultMultiplier * 100))
+}
+
+func validCategoryMultiplier(m float64) bool {
+	scaled := m * 100
+	return m >= 0 && math.Abs(scaled-math.Round(scaled)) <= 1e-6
+}
+
+// Points for each of Fields the receipt includes. Fields are optional receipt fields
+// by their JSON names.
+type CompletenessRule struct {
+	Fields []string `json:"fields"`
+	Points int      `json:"points"` // 0 disables the bonus
+}
+
+// Points for a receipt processed within WithinHours of its purchase date and time, read
+// in the server's time zone. Purchases that appear to be in the future don't qualify.
+type PromptSubmissionRule struct {
+	WithinHours int `json:"withinHours"` // 0 disables the bonus
+	Points      int `json:"points"`
+}
+
+// Bonus for receipts with at least MinItems items, on top of the pair rule
+type BigBasketRule struct {
+	MinItems int `json:"minItems"` // 0 disables the bonus
+	Points   int `json:"points"`
+}
+
+// Experimental bonus based on the spread between the cheapest and dearest item. "wide"
+// rewards a spread above ThresholdCents, "narrow" a spread of at most ThresholdCents.
+// Receipts with a single item have no spread and never qualify.
+type PriceSpreadRule struct {
+	Mode           string `json:"mode"` // "wide" or "narrow", empty to disable
+	ThresholdCents int64  `json:"thresholdCents"`
+	Points         int    `json:"points"`
+}
+
+// Bonus for each item whose price ends in the Ending digits, e.g. "99" for 4.99 or
+// "9" for any price ending in 9 cents
+type PriceEndingRule struct {
+	Ending string `json:"ending"` // one or two digits, empty to disable
+	Points int    `json:"points"`
+}
+
+// Reports whether a price in cents ends in the configured digits
+func (r PriceEndingRule) matches(cents int64) bool {
+	modulus := int64(10)
+	if len(r.Ending) == 2 {
+		modulus = 100
+	}
+	ending, _ := strconv.ParseInt(r.Ending, 10, 64)
+	return cents%modulus == ending
+}
+
+// Bonus for a total whose whole-dollar part is prime or even
+type TotalBonusRule struct {
+	Mode   string `json:"mode"` // "prime" or "even", empty to disable
+	Points int    `json:"points"`
+}
+
+// Copied at the start of scoring, so a reload never lands halfway through a receipt
+var (
+	ruleConfigMu sync.RWMutex
+	ruleConfig   = defaultRuleConfig()
+)
+
+// A copy of the active rule config, for reading it outside of scoring
+func currentRuleConfig() RuleConfig {
+	ruleConfigMu.RLock()
+	defer ruleConfigMu.RUnlock()
+	return ruleConfig
+}
+
+// Re-reads RULE_CONFIG and swaps it in, keeping the active config if the new one
+// can't be loaded or fails validation
+func reloadRuleConfig() error {
+	rc, err := loadRuleConfig(config.RuleConfigPath)
+	if err != nil {
+		return err
+	}
+
+	ruleConfigMu.Lock()
+	ruleConfig = rc
+	ruleConfigMu.Unlock()
+
+	return nil
+}
+
+func defaultRuleConfig() RuleConfig {
+	return RuleConfig{
+		ItemDescriptionDivisor: 3,
+		ItemPriceMultiplier:    0.2,
+		ItemPriceRounding:      "up",
+		Catalog:                CatalogRule{DefaultMultiplier: 1},
+		TotalMatch:             "tolerance",
+		PointsDivisor:          1,
+		PointsRounding:         "none",
+		MinItemsForPoints:      1,
+	}
+}
+
+// Without a path the defaults are prepared like an empty file, so both share a version
+func loadRuleConfig(path string) (RuleConfig, error) {
+	if path == "" {
+		return parseRuleConfig([]byte(`{}`), "defaults")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return defaultRuleConfig(), err
+	}
+	return parseRuleConfig(data, path)
+}
+
+// Decodes and validates a rule config over the defaults, preparing it for scoring.
+// source names where it came from in errors.
+func parseRuleConfig(data []byte, source string) (RuleConfig, error) {
+	rc := defaultRuleConfig()
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rc); err != nil {
+		return rc, fmt.Errorf("parsing %s: %w", source, err)
+	}
+
+	if err := rc.Validate(); err != nil {
+		return rc, fmt.Errorf("invalid rule config %s: %w", source, err)
+	}
+
+	// Keyed the way lookups are, with each canonical name also covering its own spellings
+	aliases := make(map[string]string, 2*len(rc.RetailerAliases))
+	for alias, canonical := range rc.RetailerAliases {
+		aliases[aliasKey(alias)] = canonical
+	}
+	for _, canonical := range rc.RetailerAliases {
+		if key := aliasKey(canonical); aliases[key] == "" {
+			aliases[key] = canonical
+		}
+	}
+	rc.RetailerAliases = aliases
+
+	profiles := make(map[string]RetailerProfile, len(rc.RetailerProfiles))
+	for retailer, profile := range rc.RetailerProfiles {
+		if profile.DescriptionPattern != "" {
+			profile.description = regexp.MustCompile(profile.DescriptionPattern)
+		}
+		profiles[aliasKey(retailer)] = profile
+	}
+	rc.RetailerProfiles = profiles
+
+	for i, er := range rc.ExpressionRules {
+		rc.ExpressionRules[i].compiled, _ = compileExpression(er.Expression)
+	}
+
+	if rc.Warnings.DescriptionPattern != "" {
+		rc.Warnings.description = regexp.MustCompile(rc.Warnings.DescriptionPattern)
+	}
+
+	if rc.AllowedRetailers != nil {
+		rc.allowed = make(map[string]struct{}, len(rc.AllowedRetailers))
+		for _, retailer := range rc.AllowedRetailers {
+			rc.allowed[aliasKey(retailer)] = struct{}{}
+		}
+	}
+
+	rc.version = configVersion(rc)
+	return rc, nil
+}
+
+// A short hash of the effective settings. Maps marshal with sorted keys, so the same
+// settings always give the same version.
+func configVersion(rc RuleConfig) string {
+	data, _ := json.Marshal(rc)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+func (rc RuleConfig) Validate() error {
+	for _, retailer := range rc.AllowedRetailers {
+		if aliasKey(retailer) == "" {
+			return fmt.Errorf("allowedRetailers entry %q has no letters or digits", retailer)
+		}
+	}
+
+	aliases := make(map[string]string, len(rc.RetailerAliases))
+	for alias, canonical := range rc.RetailerAliases {
+		if strings.TrimSpace(canonical) == "" {
+			return fmt.Errorf("retailerAliases: %q has no canonical name", alias)
+		}
+		key := aliasKey(alias)
+		if key == "" {
+			return fmt.Errorf("retailerAliases: %q has no letters or digits", alias)
+		}
+		if other, taken := aliases[key]; taken && other != canonical {
+			return fmt.Errorf("retailerAliases: %q is an alias of both %q and %q", alias, other, canonical)
+		}
+		aliases[key] = canonical
+	}
+
+	profiles := make(map[string]bool, len(rc.RetailerProfiles))
+	for retailer, profile := range rc.RetailerProfiles {
+		key := aliasKey(retailer)
+		if key == "" || profiles[key] {
+			return fmt.Errorf("retailerProfiles: %q has no letters or digits, or matches another profile", retailer)
+		}
+		profiles[key] = true
+
+		if profile.TotalMultipleCents < 0 || profile.MaxItems < 0 {
+			return fmt.Errorf("retailerProfiles: %q must not have negative limits", retailer)
+		}
+		if _, err := regexp.Compile(profile.DescriptionPattern); err != nil {
+			return fmt.Errorf("retailerProfiles: %q has an invalid descriptionPattern: %w", retailer, err)
+		}
+	}
+
+	switch rc.RetailerScoring.Mode {
+	case "", "linear":
+	case "capped", "log":
+		if rc.RetailerScoring.Length < 1 {
+			return fmt.Errorf("retailerScoring.length must be at least 1 for %q scoring", rc.RetailerScoring.Mode)
+		}
+	default:
+		return fmt.Errorf("retailerScoring.mode must be \"linear\", \"capped\" or \"log\", got %q", rc.RetailerScoring.Mode)
+	}
+	switch rc.TotalBonus.Mode {
+	case "", "prime", "even":
+	default:
+		return fmt.Errorf("totalBonus.mode must be \"prime\" or \"even\", got %q", rc.TotalBonus.Mode)
+	}
+	if rc.TotalBonus.Points < 0 {
+		return fmt.Errorf("totalBonus.points must not be negative")
+	}
+	if rc.TotalDigitSumMultiplier < 0 {
+		return fmt.Errorf("totalDigitSumMultiplier must not be negative")
+	}
+	if rc.ItemDescriptionDivisor < 1 {
+		return fmt.Errorf("itemDescriptionDivisor must be at least 1, got %d", rc.ItemDescriptionDivisor)
+	}
+	if rc.ItemPriceMultiplier < 0 {
+		return fmt.Errorf("itemPriceMultiplier must not be negative")
+	}
+	if scaled := rc.ItemPriceMultiplier * 10000; math.Abs(scaled-math.Round(scaled)) > 1e-6 {
+		return fmt.Errorf("itemPriceMultiplier must have at most four decimal places, got %v", rc.ItemPriceMultiplier)
+	}
+	if !validRounding(rc.ItemPriceRounding) {
+		return fmt.Errorf("itemPriceRounding must be \"none\", \"down\", \"up\" or \"nearest\", got %q", rc.ItemPriceRounding)
+	}
+	if !validCategoryMultiplier(rc.Catalog.DefaultMultiplier) {
+		return fmt.Errorf("catalog.defaultMultiplier must not be negative and have at most two decimal places, got %v", rc.Catalog.DefaultMultiplier)
+	}
+	for i, category := range rc.Catalog.Categories {
+		if category.Name == "" || len(category.Keywords) == 0 || slices.Contains(category.Keywords, "") {
+			return fmt.Errorf("catalog.categories[%d] needs a name and non-empty keywords", i)
+		}
+		if !validCategoryMultiplier(category.Multiplier) {
+			return fmt.Errorf("catalog: %q multiplier must not be negative and have at most two decimal places, got %v", category.Name, category.Multiplier)
+		}
+	}
+	if rc.DistinctItemPoints < 0 {
+		return fmt.Errorf("distinctItemPoints must not be negative")
+	}
+	if rc.BigBasket.MinItems < 0 || rc.BigBasket.Points < 0 {
+		return fmt.Errorf("bigBasket.minItems and bigBasket.points must not be negative")
+	}
+	switch rc.PriceSpread.Mode {
+	case "", "wide", "narrow":
+	default:
+		return fmt.Errorf("priceSpread.mode must be \"wide\" or \"narrow\", got %q", rc.PriceSpread.Mode)
+	}
+	if rc.PriceSpread.ThresholdCents < 0 || rc.PriceSpread.Points < 0 {
+		return fmt.Errorf("priceSpread.thresholdCents and priceSpread.points must not be negative")
+	}
+	if rc.PriceEnding.Ending != "" && (len(rc.PriceEnding.Ending) > 2 || strings.Trim(rc.PriceEnding.Ending, "0123456789") != "") {
+		return fmt.Errorf("priceEnding.ending must be one or two digits, got %q", rc.PriceEnding.Ending)
+	}
+	if rc.PriceEnding.Points < 0 {
+		return fmt.Errorf("priceEnding.points must not be negative")
+	}
+	if rc.TimeWindow.Points < 0 {
+		return fmt.Errorf("timeWindow.points must not be negative")
+	}
+	if rc.TimeWindow.Points > 0 {
+		for _, t := range []string{rc.TimeWindow.Start, rc.TimeWindow.End} {
+			if _, err := time.Parse("15:04", t); err != nil {
+				return fmt.Errorf("timeWindow.start and timeWindow.end must be times like \"22:00\", got %q", t)
+			}
+		}
+		if rc.TimeWindow.Start == rc.TimeWindow.End {
+			return fmt.Errorf("timeWindow.start and timeWindow.end must differ")
+		}
+	}
+	if rc.Holidays.Points < 0 {
+		return fmt.Errorf("holidays.points must not be negative")
+	}
+	for _, date := range rc.Holidays.Dates {
+		_, recurring := time.Parse("01-02", date)
+		_, oneOff := time.Parse("2006-01-02", date)
+		if recurring != nil && oneOff != nil {
+			return fmt.Errorf("holidays.dates entry %q must be MM-DD or YYYY-MM-DD", date)
+		}
+	}
+	if rc.Completeness.Points < 0 {
+		return fmt.Errorf("completeness.points must not be negative")
+	}
+	for i, field := range rc.Completeness.Fields {
+		if completenessFields[field] == nil {
+			return fmt.Errorf("completeness.fields: unknown field %q, expected tags or departments", field)
+		}
+		if slices.Contains(rc.Completeness.Fields[:i], field) {
+			return fmt.Errorf("completeness.fields: %q is listed more than once", field)
+		}
+	}
+	if rc.PromptSubmission.WithinHours < 0 || rc.PromptSubmission.Points < 0 {
+		return fmt.Errorf("promptSubmission.withinHours and promptSubmission.points must not be negative")
+	}
+	if rc.RetailerCooldownSeconds < 0 {
+		return fmt.Errorf("retailerCooldownSeconds must not be negative")
+	}
+	if rc.FirstOfDayPoints < 0 {
+		return fmt.Errorf("firstOfDayPoints must not be negative")
+	}
+	if rc.StreakPoints < 0 {
+		return fmt.Errorf("streakPoints must not be negative")
+	}
+	if rc.TotalMatch != "tolerance" && rc.TotalMatch != "exact" {
+		return fmt.Errorf("totalMatch must be \"tolerance\" or \"exact\", got %q", rc.TotalMatch)
+	}
+	if rc.TotalToleranceCents < 0 {
+		return fmt.Errorf("totalToleranceCents must not be negative")
+	}
+	if rc.TotalMatch == "exact" && rc.TotalToleranceCents > 0 {
+		return fmt.Errorf("totalToleranceCents does not apply when totalMatch is \"exact\"")
+	}
+	if rc.Warnings.TotalAboveCents < 0 {
+		return fmt.Errorf("warnings.totalAboveCents must not be negative")
+	}
+	if _, err := regexp.Compile(rc.Warnings.DescriptionPattern); err != nil {
+		return fmt.Errorf("warnings.descriptionPattern is invalid: %w", err)
+	}
+	if rc.MaxTotalCents < 0 || rc.MaxItemPriceCents < 0 {
+		return fmt.Errorf("maxTotalCents and maxItemPriceCents must not be negative")
+	}
+	if rc.RoundDollarToleranceCents < 0 || rc.RoundDollarToleranceCents >= 50 {
+		return fmt.Errorf("roundDollarToleranceCents must be between 0 and 49, got %d", rc.RoundDollarToleranceCents)
+	}
+	for i, er := range rc.ExpressionRules {
+		if er.Name == "" {
+			return fmt.Errorf("expressionRules[%d] needs a name", i)
+		}
+		if slices.ContainsFunc(rules, func(r rule) bool { return r.name == er.Name }) ||
+			slices.ContainsFunc(rc.ExpressionRules[:i], func(other ExpressionRule) bool { return other.Name == er.Name }) {
+			return fmt.Errorf("expressionRules: a rule named %q already exists", er.Name)
+		}
+		if _, err := compileExpression(er.Expression); err != nil {
+			return fmt.Errorf("expressionRules: %q has an invalid expression: %w", er.Name, err)
+		}
+	}
+	for i, name := range rc.RuleOrder {
+		if !slices.ContainsFunc(rc.allRules(), func(r rule) bool { return r.name == name }) {
+			return fmt.Errorf("ruleOrder: unknown rule %q", name)
+		}
+		if slices.Contains(rc.RuleOrder[:i], name) {
+			return fmt.Errorf("ruleOrder: %q is listed more than once", name)
+		}
+	}
+	if rc.MaxPoints < 0 {
+		return fmt.Errorf("maxPoints must not be negative")
+	}
+	if rc.PointsDivisor < 1 {
+		return fmt.Errorf("pointsDivisor must be at least 1, got %d", rc.PointsDivisor)
+	}
+	if rc.PointsHalfLifeDays < 0 {
+		return fmt.Errorf("pointsHalfLifeDays must not be negative")
+	}
+	for i, tier := range rc.RewardTiers {
+		if tier.Name == "" {
+			return fmt.Errorf("rewardTiers[%d] needs a name", i)
+		}
+		if i > 0 && tier.MinPoints <= rc.RewardTiers[i-1].MinPoints {
+			return fmt.Errorf("rewardTiers must be in ascending order of minPoints, but %q does not follow %q", tier.Name, rc.RewardTiers[i-1].Name)
+		}
+	}
+	if rc.MinPoints < 0 {
+		return fmt.Errorf("minPoints must not be negative")
+	}
+	if rc.MinItemsForPoints < 1 {
+		return fmt.Errorf("minItemsForPoints must be at least 1")
+	}
+	if !validRounding(rc.PointsRounding) {
+		return fmt.Errorf("pointsRounding must be \"none\", \"down\", \"up\" or \"nearest\", got %q", rc.PointsRounding)
+	}
+
+	return nil
+}
+
+func validRounding(mode string) bool {
+	switch mode {
+	case "none", "down", "up", "nearest":
+		return true
+	}
+	return false
+}
+
+// Whole points from a fractional value. "none" drops the fraction, the same as
+// integer division would.
+func roundPoints(value float64, mode string) int {
+	switch mode {
+	case "down":
+		return int(math.Floor(value))
+	case "up":
+		return int(math.Ceil(value))
+	case "nearest":
+		return int(math.Round(value))
+	default:
+		return int(value)
+	}
+}
+
+// Lowercase letters and digits only, so "Wal-Mart" and "WALMART" are the same alias
+func aliasKey(name string) string {
+	var key strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			key.WriteRune(c)
+		}
+	}
+	return key.String()
+}
+
+// The canonical name for a retailer, if it has an alias
+func retailerAlias(retailer string) (string, bool) {
+	ruleConfigMu.RLock()
+	defer ruleConfigMu.RUnlock()
+
+	canonical, aliased := ruleConfig.RetailerAliases[aliasKey(retailer)]
+	return canonical, aliased
+}
@@ -0,0 +1,1181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Parses a rule config the way RULE_CONFIG is read, failing the test if it is invalid
+func newRuleConfig(t *testing.T, data string) RuleConfig {
+	t.Helper()
+
+	rc, err := parseRuleConfig([]byte(data), "test config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+// Makes rc the active rule config for the rest of the test
+func activateRuleConfig(t *testing.T, rc RuleConfig) {
+	t.Helper()
+
+	ruleConfigMu.Lock()
+	active := ruleConfig
+	ruleConfig = rc
+	ruleConfigMu.Unlock()
+
+	t.Cleanup(func() {
+		ruleConfigMu.Lock()
+		ruleConfig = active
+		ruleConfigMu.Unlock()
+	})
+}
+
+func parseReceipt(t *testing.T, body string) Receipt {
+	t.Helper()
+
+	var receipt Receipt
+	if err := json.Unmarshal([]byte(body), &receipt); err != nil {
+		t.Fatal(err)
+	}
+	return receipt
+}
+
+// Scores the receipt under rc, checking that the breakdown adds up to the points
+func scoreUnder(t *testing.T, rc RuleConfig, receipt Receipt) (int, []ruleScore) {
+	t.Helper()
+
+	points, breakdown, _ := scoreWithConfig(rc, scoring{id: "test", receipt: receipt, createdAt: storeEpoch})
+	sum := 0
+	for _, score := range breakdown {
+		sum += score.Points
+	}
+	if sum != points {
+		t.Errorf("breakdown adds up to %d, not %d: %+v", sum, points, breakdown)
+	}
+	return points, breakdown
+}
+
+func TestTotalBonus(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		total string
+		want  int
+	}{
+		// 50 for a round dollar and 25 for a multiple of 0.25, then the bonus of 5
+		{name: "prime", mode: "prime", total: "7.00", want: 80},
+		{name: "not prime", mode: "prime", total: "8.00", want: 75},
+		{name: "one is not prime", mode: "prime", total: "1.00", want: 75},
+		{name: "two is prime", mode: "prime", total: "2.00", want: 80},
+		{name: "cents are ignored", mode: "prime", total: "7.10", want: 5},
+		{name: "large prime", mode: "prime", total: "2147483647.00", want: 80},
+		{name: "large composite", mode: "prime", total: "2147483649.00", want: 75},
+		{name: "even", mode: "even", total: "8.00", want: 80},
+		{name: "odd", mode: "even", total: "7.00", want: 75},
+		{name: "zero is even", mode: "even", total: "0.30", want: 5},
+		{name: "disabled", mode: "", total: "7.00", want: 75},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := newRuleConfig(t, `{"totalBonus": {"mode": "`+tt.mode+`", "points": 5}}`)
+			if got := rc.calcuatePointsForTotal(tt.total); got != tt.want {
+				t.Errorf("points for %s: got %d, want %d", tt.total, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPrime(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want bool
+	}{
+		{n: -7, want: false},
+		{n: 0, want: false},
+		{n: 1, want: false},
+		{n: 2, want: true},
+		{n: 9, want: false},
+		{n: 97, want: true},
+		{n: 1_000_000_007, want: true},
+		// Far beyond what trial division could check within a request
+		{n: 9_223_372_036_854_775_783, want: true},
+		{n: 9_223_372_036_854_775_807, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isPrime(tt.n); got != tt.want {
+			t.Errorf("isPrime(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestDistinctItemPoints(t *testing.T) {
+	item := func(description string) Item { return Item{ShortDescription: description, Price: "1.00"} }
+
+	tests := []struct {
+		name  string
+		items []Item
+		want  int // distinct descriptions
+	}{
+		{name: "all unique", items: []Item{item("Gum"), item("Milk"), item("Bread")}, want: 3},
+		{name: "duplicates", items: []Item{item("Gum"), item("Gum"), item("Milk")}, want: 2},
+		{name: "only duplicates", items: []Item{item("Gum"), item("Gum"), item("Gum")}, want: 1},
+		{name: "padding ignored", items: []Item{item("Gum"), item("  Gum "), item("Milk")}, want: 2},
+		{name: "case matters", items: []Item{item("Gum"), item("GUM")}, want: 2},
+	}
+
+	base := newRuleConfig(t, `{}`)
+	rc := newRuleConfig(t, `{"distinctItemPoints": 3}`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rc.calculatePointsForItems(tt.items) - base.calculatePointsForItems(tt.items); got != tt.want*3 {
+				t.Errorf("distinct items earned %d, want %d", got, tt.want*3)
+			}
+		})
+	}
+}
+
+func TestPointsDivisor(t *testing.T) {
+	tests := []struct {
+		divisor  int
+		rounding string
+		want     int
+	}{
+		{divisor: 1, rounding: "none", want: 28},
+		{divisor: 7, rounding: "none", want: 4},
+		{divisor: 10, rounding: "none", want: 2},
+		{divisor: 10, rounding: "down", want: 2},
+		{divisor: 10, rounding: "up", want: 3},
+		{divisor: 10, rounding: "nearest", want: 3},
+		{divisor: 8, rounding: "nearest", want: 4}, // 3.5 rounds away from zero
+		{divisor: 30, rounding: "none", want: 0},
+		{divisor: 30, rounding: "up", want: 1},
+	}
+
+	receipt := parseReceipt(t, targetReceipt)
+	for _, tt := range tests {
+		rc := newRuleConfig(t, fmt.Sprintf(`{"pointsDivisor": %d, "pointsRounding": %q}`, tt.divisor, tt.rounding))
+		if got, _ := scoreUnder(t, rc, receipt); got != tt.want {
+			t.Errorf("28 points divided by %d rounding %s: got %d, want %d", tt.divisor, tt.rounding, got, tt.want)
+		}
+	}
+}
+
+func TestBreakdownDescriptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		receipt string
+		want    []ruleScore
+	}{
+		{
+			name:    "target",
+			receipt: targetReceipt,
+			want: []ruleScore{
+				{"retailer", 6, `6 points because the retailer name "Target" has 6 alphanumeric characters`},
+				{"total", 0, "No points because the total 35.35 is neither a round dollar amount nor a multiple of 0.25"},
+				{"items", 16, "16 points for 5 items: 10 for every two items and 6 for item descriptions"},
+				{"purchaseDate", 6, "6 points because the purchase day 1 is odd"},
+				{"purchaseTime", 0, "No points because the purchase time 13:01 is not between 14:00 and 16:59"},
+			},
+		},
+		{
+			name: "corner market",
+			receipt: `{
+				"retailer": "M&M Corner Market",
+				"purchaseDate": "2022-03-20",
+				"purchaseTime": "14:33",
+				"items": [
+					{"shortDescription": "Gatorade", "price": "2.25"},
+					{"shortDescription": "Gatorade", "price": "2.25"},
+					{"shortDescription": "Gatorade", "price": "2.25"},
+					{"shortDescription": "Gatorade", "price": "2.25"}
+				],
+				"total": "9.00"
+			}`,
+			want: []ruleScore{
+				{"retailer", 14, `14 points because the retailer name "M&M Corner Market" has 14 alphanumeric characters`},
+				{"total", 75, "75 points because the total 9.00 is a round dollar amount and is a multiple of 0.25"},
+				{"items", 10, "10 points for 4 items: 10 for every two items"},
+				{"purchaseDate", 0, "No points because the purchase day 20 is even"},
+				{"purchaseTime", 10, "10 points because the purchase time 14:33 is between 14:00 and 16:59"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, breakdown := scoreUnder(t, newRuleConfig(t, `{}`), parseReceipt(t, tt.receipt))
+			if !slices.Equal(breakdown, tt.want) {
+				t.Errorf("got\n%+v\nwant\n%+v", breakdown, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundDollarTolerance(t *testing.T) {
+	tests := []struct {
+		tolerance int
+		total     string
+		want      bool
+	}{
+		{tolerance: 0, total: "20.00", want: true},
+		{tolerance: 0, total: "19.99", want: false},
+		{tolerance: 0, total: "20.01", want: false},
+		{tolerance: 1, total: "19.99", want: true},
+		{tolerance: 1, total: "20.01", want: true},
+		{tolerance: 1, total: "19.98", want: false},
+		{tolerance: 5, total: "19.95", want: true},
+		{tolerance: 5, total: "0.04", want: true},
+		{tolerance: 5, total: "19.50", want: false},
+	}
+
+	for _, tt := range tests {
+		rc := newRuleConfig(t, fmt.Sprintf(`{"roundDollarToleranceCents": %d}`, tt.tolerance))
+		if got := rc.isRoundDollar(tt.total); got != tt.want {
+			t.Errorf("%s with a tolerance of %d cents: got round %v, want %v", tt.total, tt.tolerance, got, tt.want)
+		}
+	}
+
+	// The validation tolerance is separate: a loose round-dollar check doesn't let a
+	// total stray from its items
+	activateRuleConfig(t, newRuleConfig(t, `{"roundDollarToleranceCents": 5}`))
+	receipt := parseReceipt(t, simpleReceipt("Target", "2022-01-01", "13:01", "19.99"))
+	receipt.Total = "20.00"
+	if err := validateReceipt(receipt); err == nil {
+		t.Error("a total one cent off its items was accepted")
+	}
+}
+
+func TestRoundPoints(t *testing.T) {
+	tests := []struct {
+		value float64
+		mode  string
+		want  int
+	}{
+		{value: 2.4, mode: "none", want: 2},
+		{value: 2.5, mode: "none", want: 2},
+		{value: 2.6, mode: "none", want: 2},
+		{value: -2.6, mode: "none", want: -2},
+		{value: 2.4, mode: "down", want: 2},
+		{value: 2.6, mode: "down", want: 2},
+		{value: -2.4, mode: "down", want: -3},
+		{value: 2.4, mode: "up", want: 3},
+		{value: 2.0, mode: "up", want: 2},
+		{value: -2.6, mode: "up", want: -2},
+		{value: 2.4, mode: "nearest", want: 2},
+		{value: 2.5, mode: "nearest", want: 3},
+		{value: -2.5, mode: "nearest", want: -3},
+	}
+
+	for _, tt := range tests {
+		if got := roundPoints(tt.value, tt.mode); got != tt.want {
+			t.Errorf("rounding %v %s: got %d, want %d", tt.value, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestBigBasketPoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		count  int
+		want   int
+	}{
+		{name: "disabled", config: `{}`, count: 50, want: 0},
+		{name: "just below", config: `{"bigBasket": {"minItems": 10, "points": 15}}`, count: 9, want: 0},
+		{name: "at the threshold", config: `{"bigBasket": {"minItems": 10, "points": 15}}`, count: 10, want: 15},
+		{name: "above", config: `{"bigBasket": {"minItems": 10, "points": 15}}`, count: 11, want: 15},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := newRuleConfig(t, tt.config)
+			items := make([]Item, tt.count)
+			for i := range items {
+				items[i] = Item{ShortDescription: "Gum", Price: "1.00"}
+			}
+
+			base := newRuleConfig(t, `{}`)
+			if got := rc.calculatePointsForItems(items) - base.calculatePointsForItems(items); got != tt.want {
+				t.Errorf("%d items earned a bonus of %d, want %d", tt.count, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTotalDigitSum(t *testing.T) {
+	tests := []struct {
+		total      string
+		multiplier int
+		want       int // on top of the round dollar and quarter points
+	}{
+		{total: "35.35", multiplier: 1, want: 16},
+		{total: "35.35", multiplier: 2, want: 32},
+		{total: "9.00", multiplier: 1, want: 9},
+		{total: "1,234.56", multiplier: 1, want: 21},
+		{total: "0.00", multiplier: 3, want: 0},
+		{total: "35.35", multiplier: 0, want: 0},
+	}
+
+	t.Setenv("THOUSANDS_SEPARATOR", ",")
+	config = loadConfig()
+	base := newRuleConfig(t, `{}`)
+	for _, tt := range tests {
+		rc := newRuleConfig(t, fmt.Sprintf(`{"totalDigitSumMultiplier": %d}`, tt.multiplier))
+		if got := rc.calcuatePointsForTotal(tt.total) - base.calcuatePointsForTotal(tt.total); got != tt.want {
+			t.Errorf("digit sum of %s times %d: got %d, want %d", tt.total, tt.multiplier, got, tt.want)
+		}
+	}
+}
+
+func TestRetailerNamePoints(t *testing.T) {
+	tests := []struct {
+		retailer string
+		ascii    int
+		unicode  int
+	}{
+		{retailer: "Target", ascii: 6, unicode: 6},
+		{retailer: "M&M Corner Market", ascii: 14, unicode: 14},
+		{retailer: "Café Zoë", ascii: 5, unicode: 7},
+		{retailer: "東京マート", ascii: 0, unicode: 5},
+		{retailer: "Ünïcødé 7", ascii: 4, unicode: 8},
+	}
+
+	ascii := newRuleConfig(t, `{}`)
+	unicode := newRuleConfig(t, `{"unicodeRetailerNames": true}`)
+	for _, tt := range tests {
+		if got := ascii.calculatePointsForRetailerName(tt.retailer); got != tt.ascii {
+			t.Errorf("%q ASCII-only: got %d, want %d", tt.retailer, got, tt.ascii)
+		}
+		if got := unicode.calculatePointsForRetailerName(tt.retailer); got != tt.unicode {
+			t.Errorf("%q with Unicode: got %d, want %d", tt.retailer, got, tt.unicode)
+		}
+	}
+}
+
+func TestMinPoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   int
+		raised int // points the floor added, if any
+	}{
+		{name: "no floor", config: `{}`, want: 9},
+		{name: "below the natural points", config: `{"minPoints": 5}`, want: 9},
+		{name: "at the natural points", config: `{"minPoints": 9}`, want: 9},
+		{name: "raises the total", config: `{"minPoints": 20}`, want: 20, raised: 11},
+		{name: "after the divisor", config: `{"minPoints": 5, "pointsDivisor": 2}`, want: 5, raised: 1},
+	}
+
+	receipt := parseReceipt(t, simpleReceipt("Walgreens", "2022-01-02", "08:13", "2.65"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, breakdown := scoreUnder(t, newRuleConfig(t, tt.config), receipt)
+			if points != tt.want {
+				t.Errorf("got %d points, want %d", points, tt.want)
+			}
+			raised := 0
+			if i := slices.IndexFunc(breakdown, func(s ruleScore) bool { return s.Rule == "minPoints" }); i >= 0 {
+				raised = breakdown[i].Points
+			}
+			if raised != tt.raised {
+				t.Errorf("floor added %d points, want %d", raised, tt.raised)
+			}
+		})
+	}
+}
+
+func TestRegisterRule(t *testing.T) {
+	builtIn := rules
+	t.Cleanup(func() { rules = builtIn })
+	rules = slices.Clone(builtIn)
+
+	RegisterRule("perItem", func(r Receipt) int { return 10 * len(r.Items) })
+
+	rc := newRuleConfig(t, `{}`)
+	receipt := parseReceipt(t, targetReceipt)
+	points, breakdown := scoreUnder(t, rc, receipt)
+	if points != 28+50 {
+		t.Errorf("got %d points, want %d", points, 28+50)
+	}
+	want := ruleScore{Rule: "perItem", Points: 50, Description: `50 points from the custom rule "perItem"`}
+	if !slices.Contains(breakdown, want) {
+		t.Errorf("breakdown %+v is missing %+v", breakdown, want)
+	}
+
+	tests := []struct {
+		name string
+		rule string
+		fn   func(Receipt) int
+	}{
+		{name: "no name", rule: "", fn: func(Receipt) int { return 1 }},
+		{name: "no calculator", rule: "other"},
+		{name: "custom name taken", rule: "perItem", fn: func(Receipt) int { return 1 }},
+		{name: "built-in name taken", rule: "retailer", fn: func(Receipt) int { return 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering %q did not panic", tt.rule)
+				}
+			}()
+			RegisterRule(tt.rule, tt.fn)
+		})
+	}
+}
+
+func TestItemPriceMultiplier(t *testing.T) {
+	tests := []struct {
+		config string
+		cents  int64
+		want   int
+	}{
+		{config: `{}`, cents: 1225, want: 3},
+		{config: `{"itemPriceMultiplier": 0.5}`, cents: 1225, want: 7},
+		{config: `{"itemPriceMultiplier": 0.5, "itemPriceRounding": "down"}`, cents: 1225, want: 6},
+		{config: `{"itemPriceMultiplier": 0.5, "itemPriceRounding": "nearest"}`, cents: 1225, want: 6},
+		{config: `{"itemPriceMultiplier": 0.5, "itemPriceRounding": "nearest"}`, cents: 1300, want: 7},
+		{config: `{"itemPriceMultiplier": 0.5}`, cents: 1200, want: 6},
+		{config: `{"itemPriceMultiplier": 0.1234, "itemPriceRounding": "down"}`, cents: 10000, want: 12},
+		{config: `{"itemPriceMultiplier": 0}`, cents: 1225, want: 0},
+	}
+
+	for _, tt := range tests {
+		rc := newRuleConfig(t, tt.config)
+		if got := rc.itemPricePoints(tt.cents, 100); got != tt.want {
+			t.Errorf("%d cents under %s: got %d, want %d", tt.cents, tt.config, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{`{"itemPriceMultiplier": -0.2}`, `{"itemPriceMultiplier": 0.12345}`, `{"itemPriceRounding": "sideways"}`} {
+		if _, err := parseRuleConfig([]byte(invalid), "test config"); err == nil {
+			t.Errorf("%s was accepted", invalid)
+		}
+	}
+}
+
+func TestItemDescriptionDivisor(t *testing.T) {
+	tests := []struct {
+		description string
+		divisor     int
+		want        int // for a price of 12.25
+	}{
+		{description: "Emils Cheese Pizza", divisor: 3, want: 3},
+		{description: "Emils Cheese Pizza", divisor: 5, want: 0},
+		{description: "   Klarbrunn 12-PK 12 FL OZ  ", divisor: 3, want: 3},
+		{description: "   Klarbrunn 12-PK 12 FL OZ  ", divisor: 5, want: 0},
+		{description: "Doritos Nacho Cheese", divisor: 3, want: 0},
+		{description: "Doritos Nacho Cheese", divisor: 5, want: 3},
+		{description: "Bread", divisor: 5, want: 3},
+		{description: "Gatorade", divisor: 1, want: 3},
+	}
+
+	for _, tt := range tests {
+		rc := newRuleConfig(t, fmt.Sprintf(`{"itemDescriptionDivisor": %d}`, tt.divisor))
+		items := []Item{{ShortDescription: tt.description, Price: "12.25"}}
+		if got := rc.calculatePointsForItems(items); got != tt.want {
+			t.Errorf("%q with a divisor of %d: got %d, want %d", tt.description, tt.divisor, got, tt.want)
+		}
+	}
+
+	if _, err := parseRuleConfig([]byte(`{"itemDescriptionDivisor": 0}`), "test config"); err == nil {
+		t.Error("a divisor of 0 was accepted")
+	}
+}
+
+func TestRetailerScoringModes(t *testing.T) {
+	short := "Aldi5"
+	long := strings.Repeat("Walmart", 14) + "Co" // 100 alphanumerics
+
+	tests := []struct {
+		config string
+		short  int
+		long   int
+	}{
+		{config: `{}`, short: 5, long: 100},
+		{config: `{"retailerScoring": {"mode": "linear", "length": 20}}`, short: 5, long: 100},
+		{config: `{"retailerScoring": {"mode": "capped", "length": 20}}`, short: 5, long: 20},
+		{config: `{"retailerScoring": {"mode": "log", "length": 20}}`, short: 5, long: 26},
+		{config: `{"retailerScoring": {"mode": "capped", "length": 5}}`, short: 5, long: 5},
+		{config: `{"retailerScoring": {"mode": "log", "length": 4}}`, short: 5, long: 10},
+	}
+
+	for _, tt := range tests {
+		rc := newRuleConfig(t, tt.config)
+		if got := rc.calculatePointsForRetailerName(short); got != tt.short {
+			t.Errorf("5 characters under %s: got %d, want %d", tt.config, got, tt.short)
+		}
+		if got := rc.calculatePointsForRetailerName(long); got != tt.long {
+			t.Errorf("100 characters under %s: got %d, want %d", tt.config, got, tt.long)
+		}
+	}
+
+	for _, invalid := range []string{`{"retailerScoring": {"mode": "capped"}}`, `{"retailerScoring": {"mode": "sqrt", "length": 20}}`} {
+		if _, err := parseRuleConfig([]byte(invalid), "test config"); err == nil {
+			t.Errorf("%s was accepted", invalid)
+		}
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	lateNight := newRuleConfig(t, `{"timeWindow": {"start": "22:00", "end": "02:00", "points": 7}}`)
+	morning := newRuleConfig(t, `{"timeWindow": {"start": "06:00", "end": "09:30", "points": 7}}`)
+	disabled := newRuleConfig(t, `{"timeWindow": {"start": "22:00", "end": "02:00"}}`)
+
+	tests := []struct {
+		name string
+		rc   RuleConfig
+		time string
+		want int // on top of rule 8
+	}{
+		{name: "before a wrapping window", rc: lateNight, time: "21:59", want: 0},
+		{name: "start of a wrapping window", rc: lateNight, time: "22:00", want: 7},
+		{name: "before midnight", rc: lateNight, time: "23:59", want: 7},
+		{name: "midnight", rc: lateNight, time: "00:00", want: 7},
+		{name: "after midnight", rc: lateNight, time: "01:59", want: 7},
+		{name: "end of a wrapping window", rc: lateNight, time: "02:00", want: 0},
+		{name: "afternoon", rc: lateNight, time: "15:00", want: 0},
+		{name: "inside a plain window", rc: morning, time: "06:00", want: 7},
+		{name: "end of a plain window", rc: morning, time: "09:30", want: 0},
+		{name: "outside a plain window", rc: morning, time: "23:00", want: 0},
+		{name: "no points", rc: disabled, time: "23:00", want: 0},
+	}
+
+	base := newRuleConfig(t, `{}`)
+	for _, tt := range tests {
+		if got := tt.rc.calculatePointsForPurchaseTime(tt.time) - base.calculatePointsForPurchaseTime(tt.time); got != tt.want {
+			t.Errorf("%s (%s): got %d, want %d", tt.name, tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestRuleOrderShortCircuit(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []ruleScore // rule and points only
+	}{
+		{
+			name: "defaults", config: `{}`,
+			want: []ruleScore{{Rule: "retailer", Points: 6}, {Rule: "total"}, {Rule: "items", Points: 16}, {Rule: "purchaseDate", Points: 6}, {Rule: "purchaseTime"}},
+		},
+		{
+			name: "reordered", config: `{"ruleOrder": ["purchaseTime", "items"]}`,
+			want: []ruleScore{{Rule: "purchaseTime"}, {Rule: "items", Points: 16}, {Rule: "retailer", Points: 6}, {Rule: "total"}, {Rule: "purchaseDate", Points: 6}},
+		},
+		{
+			name: "cap without short-circuit", config: `{"maxPoints": 20, "ruleOrder": ["purchaseDate", "items"]}`,
+			want: []ruleScore{{Rule: "purchaseDate", Points: 6}, {Rule: "items", Points: 16}, {Rule: "retailer", Points: 6}, {Rule: "total"}, {Rule: "purchaseTime"}, {Rule: "maxPoints", Points: -8}},
+		},
+		{
+			name: "short-circuit in the default order", config: `{"maxPoints": 20, "shortCircuit": true}`,
+			want: []ruleScore{{Rule: "retailer", Points: 6}, {Rule: "total"}, {Rule: "items", Points: 14}},
+		},
+		{
+			name: "short-circuit with the date first", config: `{"maxPoints": 20, "shortCircuit": true, "ruleOrder": ["purchaseDate", "items"]}`,
+			want: []ruleScore{{Rule: "purchaseDate", Points: 6}, {Rule: "items", Points: 14}},
+		},
+		{
+			name: "short-circuit with items first", config: `{"maxPoints": 20, "shortCircuit": true, "ruleOrder": ["items", "purchaseDate"]}`,
+			want: []ruleScore{{Rule: "items", Points: 16}, {Rule: "purchaseDate", Points: 4}},
+		},
+		{
+			name: "short-circuit above the total", config: `{"maxPoints": 50, "shortCircuit": true}`,
+			want: []ruleScore{{Rule: "retailer", Points: 6}, {Rule: "total"}, {Rule: "items", Points: 16}, {Rule: "purchaseDate", Points: 6}, {Rule: "purchaseTime"}},
+		},
+	}
+
+	receipt := parseReceipt(t, targetReceipt)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, breakdown := scoreUnder(t, newRuleConfig(t, tt.config), receipt)
+			for i := range breakdown {
+				breakdown[i].Description = ""
+			}
+			if !slices.Equal(breakdown, tt.want) {
+				t.Errorf("got %+v, want %+v", breakdown, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetailerProfiles(t *testing.T) {
+	activateRuleConfig(t, newRuleConfig(t, `{
+		"retailerAliases": {"Tgt": "Target"},
+		"retailerProfiles": {"Target": {"totalMultipleCents": 5, "maxItems": 5, "descriptionPattern": "^[A-Za-z0-9 -]+$"}}
+	}`))
+
+	withItem := func(r Receipt, description string) Receipt {
+		r.Items = append(slices.Clone(r.Items), Item{ShortDescription: description, Price: "0.00"})
+		return r
+	}
+	target := parseReceipt(t, targetReceipt)
+	tests := []struct {
+		name    string
+		receipt Receipt
+		want    string // empty when the receipt is valid
+	}{
+		{name: "conforming", receipt: target},
+		{name: "total not a multiple", receipt: parseReceipt(t, simpleReceipt("Target", "2022-01-01", "13:01", "6.49")), want: "total 6.49 must be a multiple of 0.05 (Target receipt format)"},
+		{name: "matched by alias", receipt: parseReceipt(t, simpleReceipt("Tgt", "2022-01-01", "13:01", "6.49")), want: "total 6.49 must be a multiple of 0.05 (Tgt receipt format)"},
+		{name: "matched ignoring case", receipt: parseReceipt(t, simpleReceipt("TARGET", "2022-01-01", "13:01", "6.49")), want: "total 6.49 must be a multiple of 0.05 (TARGET receipt format)"},
+		{name: "too many items", receipt: withItem(target, "Gum"), want: "at most 5 items are expected, got 6 (Target receipt format)"},
+		{name: "description not matching", receipt: withItem(parseReceipt(t, simpleReceipt("Target", "2022-01-01", "13:01", "1.00")), "Gum!"), want: `items[1].shortDescription "Gum!" must match ^[A-Za-z0-9 -]+$ (Target receipt format)`},
+		{name: "other retailer", receipt: parseReceipt(t, simpleReceipt("Walgreens", "2022-01-01", "13:01", "6.49"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateReceipt(tt.receipt)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+			if !errors.As(err, new(semanticError)) {
+				t.Errorf("%v is not a semantic error", err)
+			}
+		})
+	}
+}
+
+func TestRewardTiers(t *testing.T) {
+	rc := newRuleConfig(t, `{"rewardTiers": [{"name": "Bronze", "minPoints": 10}, {"name": "Silver", "minPoints": 50}, {"name": "Gold", "minPoints": 100}]}`)
+
+	tests := []struct {
+		points int
+		want   string // empty for no tier
+	}{
+		{points: 0},
+		{points: 9},
+		{points: 10, want: "Bronze"},
+		{points: 49, want: "Bronze"},
+		{points: 50, want: "Silver"},
+		{points: 99, want: "Silver"},
+		{points: 100, want: "Gold"},
+		{points: 1000, want: "Gold"},
+	}
+
+	for _, tt := range tests {
+		tier, ok := rc.tierFor(tt.points)
+		if tier != tt.want || ok != (tt.want != "") {
+			t.Errorf("%d points: got %q, %v; want %q", tt.points, tier, ok, tt.want)
+		}
+	}
+
+	if tier, ok := newRuleConfig(t, `{}`).tierFor(1000); ok {
+		t.Errorf("no tiers configured, but got %q", tier)
+	}
+	for _, invalid := range []string{
+		`{"rewardTiers": [{"name": "Silver", "minPoints": 50}, {"name": "Bronze", "minPoints": 10}]}`,
+		`{"rewardTiers": [{"name": "Bronze", "minPoints": 10}, {"name": "Silver", "minPoints": 10}]}`,
+	} {
+		if _, err := parseRuleConfig([]byte(invalid), "test config"); err == nil {
+			t.Errorf("%s was accepted", invalid)
+		}
+	}
+
+	// The points response names the tier only when tiers are configured
+	h := newTestServer(t, nil)
+	id := process(t, h, targetReceipt)
+	for _, tiered := range []RuleConfig{defaultRuleConfig(), rc} {
+		activateRuleConfig(t, tiered)
+
+		var got map[string]any
+		decode(t, send(h, http.MethodGet, "/receipts/"+id+"/points", ""), &got)
+		if tier, ok := got["tier"]; ok != (len(tiered.RewardTiers) > 0) || ok && tier != "Bronze" {
+			t.Errorf("got %v", got)
+		}
+	}
+}
+
+func TestPriceSpreadPoints(t *testing.T) {
+	prices := func(amounts ...string) []Item {
+		items := make([]Item, len(amounts))
+		for i, amount := range amounts {
+			items[i] = Item{ShortDescription: "Gum", Price: Amount(amount)}
+		}
+		return items
+	}
+	wide := newRuleConfig(t, `{"priceSpread": {"mode": "wide", "thresholdCents": 500, "points": 8}}`)
+	narrow := newRuleConfig(t, `{"priceSpread": {"mode": "narrow", "thresholdCents": 50, "points": 4}}`)
+
+	tests := []struct {
+		name  string
+		rc    RuleConfig
+		items []Item
+		want  int
+	}{
+		{name: "disabled", rc: newRuleConfig(t, `{}`), items: prices("1.00", "20.00")},
+		{name: "wide spread", rc: wide, items: prices("1.00", "6.01", "3.00"), want: 8},
+		{name: "at the wide threshold", rc: wide, items: prices("1.00", "6.00")},
+		{name: "narrow for the wide rule", rc: wide, items: prices("1.00", "1.10")},
+		{name: "tight band", rc: narrow, items: prices("2.00", "2.25", "2.50"), want: 4},
+		{name: "just outside the band", rc: narrow, items: prices("2.00", "2.51")},
+		{name: "single item", rc: narrow, items: prices("2.00")},
+		{name: "cents, not floats", rc: narrow, items: prices("0.10", "0.60"), want: 4},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rc.priceSpreadPoints(tt.items); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedRetailers(t *testing.T) {
+	allowlist := newRuleConfig(t, `{"allowedRetailers": ["Target", "Walmart"], "retailerAliases": {"Wal-Mart": "Walmart", "Tgt": "Target"}}`)
+
+	tests := []struct {
+		name     string
+		rc       RuleConfig
+		retailer string
+		allowed  bool
+	}{
+		{name: "no allowlist", rc: newRuleConfig(t, `{}`), retailer: "Anywhere", allowed: true},
+		{name: "listed", rc: allowlist, retailer: "Target", allowed: true},
+		{name: "listed, spelled differently", rc: allowlist, retailer: "TARGET", allowed: true},
+		{name: "alias of a listed retailer", rc: allowlist, retailer: "Wal-Mart", allowed: true},
+		{name: "alias spelled differently", rc: allowlist, retailer: "wal mart", allowed: true},
+		{name: "not listed", rc: allowlist, retailer: "Walgreens"},
+		{name: "empty allowlist", rc: newRuleConfig(t, `{"allowedRetailers": []}`), retailer: "Target"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			activateRuleConfig(t, tt.rc)
+			err := validateReceipt(parseReceipt(t, simpleReceipt(tt.retailer, "2022-01-01", "13:01", "1.00")))
+			if tt.allowed {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if want := fmt.Sprintf("retailer %q is not accepted", tt.retailer); err == nil || err.Error() != want {
+				t.Errorf("got error %v, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestItemPairs(t *testing.T) {
+	tests := []struct {
+		count   int
+		floor   int
+		roundUp int
+	}{
+		{count: 0, floor: 0, roundUp: 0},
+		{count: 1, floor: 0, roundUp: 1},
+		{count: 2, floor: 1, roundUp: 1},
+		{count: 3, floor: 1, roundUp: 2},
+		{count: 4, floor: 2, roundUp: 2},
+		{count: 5, floor: 2, roundUp: 3},
+	}
+
+	floor := newRuleConfig(t, `{}`)
+	roundUp := newRuleConfig(t, `{"roundUpItemPairs": true}`)
+	for _, tt := range tests {
+		if got := floor.itemPairs(tt.count); got != tt.floor {
+			t.Errorf("%d items rounded down: got %d pairs, want %d", tt.count, got, tt.floor)
+		}
+		if got := roundUp.itemPairs(tt.count); got != tt.roundUp {
+			t.Errorf("%d items rounded up: got %d pairs, want %d", tt.count, got, tt.roundUp)
+		}
+	}
+
+	// The README receipt's five items make three pairs when rounding up
+	receipt := parseReceipt(t, targetReceipt)
+	if points, _ := scoreUnder(t, roundUp, receipt); points != 33 {
+		t.Errorf("README receipt rounding pairs up: got %d points, want 33", points)
+	}
+}
+
+func TestTotalMatch(t *testing.T) {
+	withTotal := func(body, total string) Receipt {
+		receipt := parseReceipt(t, body)
+		receipt.Total = Amount(total)
+		return receipt
+	}
+	cents := parseReceipt(t, `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "total": "0.30",
+		"items": [{"shortDescription": "Gum", "price": "0.10"}, {"shortDescription": "Mints", "price": "0.20"}]}`)
+
+	tests := []struct {
+		name    string
+		config  string
+		receipt Receipt
+		want    string // empty when the receipt is valid
+	}{
+		{name: "tolerance, matching", config: `{}`, receipt: withTotal(targetReceipt, "35.35")},
+		{name: "tolerance, a cent off", config: `{}`, receipt: withTotal(targetReceipt, "35.36"), want: "total 35.36 does not match the sum of item prices 35.35, a difference of 0.01"},
+		{name: "tolerance, within a cent", config: `{"totalToleranceCents": 1}`, receipt: withTotal(targetReceipt, "35.36")},
+		{name: "tolerance, past a cent", config: `{"totalToleranceCents": 1}`, receipt: withTotal(targetReceipt, "35.37"), want: "total 35.37 does not match the sum of item prices 35.35, a difference of 0.02"},
+		{name: "tolerance, float sum", config: `{}`, receipt: cents},
+		{name: "exact, matching", config: `{"totalMatch": "exact"}`, receipt: withTotal(targetReceipt, "35.35")},
+		{name: "exact, a cent off", config: `{"totalMatch": "exact"}`, receipt: withTotal(targetReceipt, "35.36"), want: "total 35.36 does not exactly match the sum of item prices 35.35"},
+		{name: "exact, float sum", config: `{"totalMatch": "exact"}`, receipt: cents},
+		{name: "tolerance, NaN total", config: `{"totalToleranceCents": 1}`, receipt: withTotal(targetReceipt, "NaN"), want: `total "NaN" is not a valid amount`},
+		{name: "tolerance, infinite total", config: `{}`, receipt: withTotal(targetReceipt, "+Inf"), want: `total "+Inf" is not a valid amount`},
+		{name: "exact, NaN total", config: `{"totalMatch": "exact"}`, receipt: withTotal(targetReceipt, "nan"), want: `total "nan" is not a valid amount`},
+		{name: "NaN price", config: `{}`, receipt: parseReceipt(t, simpleReceipt("Target", "2022-01-01", "13:01", "NaN")), want: `total "NaN" is not a valid amount`},
+		{name: "infinite price", config: `{}`, receipt: withTotal(simpleReceipt("Target", "2022-01-01", "13:01", "Infinity"), "1.00"), want: `items[0].price "Infinity" is not a valid amount`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			activateRuleConfig(t, newRuleConfig(t, tt.config))
+			err := validateReceipt(tt.receipt)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	for _, invalid := range []string{`{"totalMatch": "close"}`, `{"totalMatch": "exact", "totalToleranceCents": 1}`, `{"totalToleranceCents": -1}`} {
+		if _, err := parseRuleConfig([]byte(invalid), "test config"); err == nil {
+			t.Errorf("%s was accepted", invalid)
+		}
+	}
+}
+
+func TestHolidays(t *testing.T) {
+	calendar := `{"holidays": {"points": 20, "dates": ["12-25", "2023-07-04"]}}`
+	tests := []struct {
+		name   string
+		config string
+		date   string
+		want   int
+	}{
+		{name: "no calendar", config: `{}`, date: "2022-12-25", want: 6},
+		{name: "ordinary date", config: calendar, date: "2022-12-24", want: 0},
+		{name: "recurring holiday", config: calendar, date: "2022-12-25", want: 26},
+		{name: "recurring holiday, another year", config: calendar, date: "2031-12-25", want: 26},
+		{name: "one-off holiday", config: calendar, date: "2023-07-04", want: 20},
+		{name: "one-off holiday, another year", config: calendar, date: "2024-07-04", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := newRuleConfig(t, tt.config)
+			if got := rc.calculatePointsForPurchaseDate(tt.date); got != tt.want {
+				t.Errorf("got %d points, want %d", got, tt.want)
+			}
+		})
+	}
+
+	for _, invalid := range []string{`{"holidays": {"points": -1}}`, `{"holidays": {"dates": ["25-12"]}}`, `{"holidays": {"dates": ["2023-7-4"]}}`} {
+		if _, err := parseRuleConfig([]byte(invalid), "test config"); err == nil {
+			t.Errorf("%s was accepted", invalid)
+		}
+	}
+}
+
+func TestMaxAmounts(t *testing.T) {
+	twoItems := func(a, b, total string) string {
+		return `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "total": "` + total + `",
+			"items": [{"shortDescription": "Gum", "price": "` + a + `"}, {"shortDescription": "Mints", "price": "` + b + `"}]}`
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		body   string
+		want   string // empty when the receipt is valid
+	}{
+		{name: "no maximum", config: `{}`, body: simpleReceipt("Target", "2022-01-01", "13:01", "99999999.99")},
+		{name: "total under", config: `{"maxTotalCents": 5000}`, body: simpleReceipt("Target", "2022-01-01", "13:01", "49.99")},
+		{name: "total at", config: `{"maxTotalCents": 5000}`, body: simpleReceipt("Target", "2022-01-01", "13:01", "50.00")},
+		{name: "total over", config: `{"maxTotalCents": 5000}`, body: simpleReceipt("Target", "2022-01-01", "13:01", "50.01"), want: "total 50.01 is above the maximum of 50.00"},
+		{name: "total far over", config: `{"maxTotalCents": 5000}`, body: simpleReceipt("Target", "2022-01-01", "13:01", "92233720368547758.07"), want: "total 92233720368547758.07 is above the maximum of 50.00"},
+		{name: "prices under", config: `{"maxItemPriceCents": 1000}`, body: twoItems("9.99", "10.00", "19.99")},
+		{name: "price over", config: `{"maxItemPriceCents": 1000}`, body: twoItems("9.99", "10.01", "20.00"), want: "items[1].price 10.01 is above the maximum of 10.00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			activateRuleConfig(t, newRuleConfig(t, tt.config))
+			err := validateReceipt(parseReceipt(t, tt.body))
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseRuleConfig([]byte(`{"maxTotalCents": -1}`), "test config"); err == nil {
+		t.Error("a negative maximum was accepted")
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	produce := `{"name": "produce", "keywords": ["apple", "pear"], "multiplier": 2}`
+	snacks := `{"name": "snacks", "keywords": ["chip"], "multiplier": 3}`
+
+	tests := []struct {
+		name        string
+		config      string
+		description string
+		want        int
+	}{
+		{name: "no catalog", config: `{}`, description: "Apples", want: 2},
+		{name: "categorized", config: `{"catalog": {"categories": [` + produce + `]}}`, description: "Apples", want: 4},
+		{name: "keywords ignore case", config: `{"catalog": {"categories": [` + produce + `]}}`, description: "PEARS!", want: 4},
+		{name: "unmatched", config: `{"catalog": {"categories": [` + produce + `]}}`, description: "Bread!", want: 2},
+		{name: "default multiplier", config: `{"catalog": {"categories": [` + produce + `], "defaultMultiplier": 0.5}}`, description: "Bread!", want: 1},
+		{name: "first category wins", config: `{"catalog": {"categories": [` + produce + `, ` + snacks + `]}}`, description: "Apple Chips!", want: 4},
+		{name: "in catalog order", config: `{"catalog": {"categories": [` + snacks + `, ` + produce + `]}}`, description: "Apple Chips!", want: 6},
+		{name: "fractional multiplier", config: `{"catalog": {"categories": [{"name": "dairy", "keywords": ["milk"], "multiplier": 1.5}]}}`, description: "Milk 1", want: 3},
+		{name: "excluded category", config: `{"catalog": {"categories": [{"name": "tobacco", "keywords": ["cigar"], "multiplier": 0}]}}`, description: "Cigars", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := newRuleConfig(t, tt.config)
+			items := []Item{{ShortDescription: tt.description, Price: "10.00"}}
+			if got := rc.calculatePointsForItems(items); got != tt.want {
+				t.Errorf("got %d points, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// Past int64 in the intermediate product, but not in the points
+	large := []struct {
+		name   string
+		config string
+		price  string
+		want   int
+	}{
+		{name: "a hundred trillion", config: `{}`, price: "100000000000000.00", want: 20000000000000},
+		{name: "largest price", config: `{}`, price: "92233720368547758.07", want: 18446744073709552},
+		{name: "largest price, categorized", config: `{"catalog": {"categories": [` + produce + `]}}`, price: "92233720368547758.07", want: 36893488147419104},
+		{name: "largest price, rounded down", config: `{"itemPriceRounding": "down"}`, price: "92233720368547758.07", want: 18446744073709551},
+	}
+	if got := newRuleConfig(t, `{"itemPriceMultiplier": 1000}`).itemPricePoints(math.MaxInt64, 100); got != math.MaxInt64 {
+		t.Errorf("got %d points past int64, want them clamped to %d", got, math.MaxInt64)
+	}
+	for _, tt := range large {
+		t.Run(tt.name, func(t *testing.T) {
+			items := []Item{{ShortDescription: "Apples", Price: Amount(tt.price)}}
+			if got := newRuleConfig(t, tt.config).calculatePointsForItems(items); got != tt.want {
+				t.Errorf("got %d points, want %d", got, tt.want)
+			}
+		})
+	}
+
+	for _, invalid := range []string{
+		`{"catalog": {"defaultMultiplier": -1}}`,
+		`{"catalog": {"categories": [{"name": "produce", "keywords": ["apple"], "multiplier": 1.005}]}}`,
+		`{"catalog": {"categories": [{"name": "produce", "keywords": [], "multiplier": 2}]}}`,
+		`{"catalog": {"categories": [{"keywords": ["apple"], "multiplier": 2}]}}`,
+	} {
+		if _, err := parseRuleConfig([]byte(invalid), "test config"); err == nil {
+			t.Errorf("%s was accepted", invalid)
+		}
+	}
+}
+
+func TestCompleteness(t *testing.T) {
+	plain := parseReceipt(t, targetReceipt)
+	tagged := plain
+	tagged.Tags = []string{"groceries"}
+	complete := tagged
+	complete.Departments = []Department{{Name: "Snacks", Items: plain.Items}}
+
+	both := `{"completeness": {"fields": ["tags", "departments"], "points": 5}}`
+	tests := []struct {
+		name        string
+		config      string
+		receipt     Receipt
+		points      int
+		description string // of the completeness rule, empty when it doesn't run
+	}{
+		{name: "disabled", config: `{}`, receipt: complete},
+		{name: "no fields", config: both, receipt: plain, description: "No points because none of tags, departments are included"},
+		{name: "one field", config: both, receipt: tagged, points: 5, description: "5 points for including tags"},
+		{name: "every field", config: both, receipt: complete, points: 10, description: "10 points for including tags, departments"},
+		{name: "only counted fields", config: `{"completeness": {"fields": ["departments"], "points": 5}}`, receipt: complete, points: 5, description: "5 points for including departments"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, breakdown := scoreUnder(t, newRuleConfig(t, tt.config), tt.receipt)
+			if points != 28+tt.points {
+				t.Errorf("got %d points, want %d", points, 28+tt.points)
+			}
+			i := slices.IndexFunc(breakdown, func(score ruleScore) bool { return score.Rule == "completeness" })
+			if tt.description == "" {
+				if i >= 0 {
+					t.Errorf("completeness scored %+v", breakdown[i])
+				}
+				return
+			}
+			if want := (ruleScore{Rule: "completeness", Points: tt.points, Description: tt.description}); i < 0 || breakdown[i] != want {
+				t.Errorf("breakdown %+v, want %+v", breakdown, want)
+			}
+		})
+	}
+
+	for _, invalid := range []string{
+		`{"completeness": {"fields": ["currency"], "points": 5}}`,
+		`{"completeness": {"fields": ["tags", "tags"], "points": 5}}`,
+		`{"completeness": {"fields": ["tags"], "points": -5}}`,
+	} {
+		if _, err := parseRuleConfig([]byte(invalid), "test config"); err == nil {
+			t.Errorf("%s was accepted", invalid)
+		}
+	}
+}
+
+func TestRuleConfigVersion(t *testing.T) {
+	defaults, err := loadRuleConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := defaults.version
+
+	tests := []struct {
+		name   string
+		config string
+		same   bool // whether it has the defaults' version
+	}{
+		{name: "empty", config: `{}`, same: true},
+		{name: "defaults spelled out", config: `{"itemDescriptionDivisor": 3, "pointsDivisor": 1}`, same: true},
+		{name: "whitespace", config: " {\n} ", same: true},
+		{name: "changed setting", config: `{"itemPriceMultiplier": 0.5}`},
+		{name: "added alias", config: `{"retailerAliases": {"Tgt": "Target"}}`},
+		{name: "added holiday", config: `{"holidays": {"dates": ["12-25"], "points": 5}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := newRuleConfig(t, tt.config)
+			if got := rc.version == base; got != tt.same {
+				t.Errorf("version %q, defaults %q", rc.version, base)
+			}
+			if again := newRuleConfig(t, tt.config); again.version != rc.version {
+				t.Errorf("version %q on reload, was %q", again.version, rc.version)
+			}
+		})
+	}
+
+	// Key order doesn't matter, only the settings
+	a := newRuleConfig(t, `{"retailerAliases": {"Tgt": "Target", "Wal-Mart": "Walmart"}, "minPoints": 5}`)
+	b := newRuleConfig(t, `{"minPoints": 5, "retailerAliases": {"Wal-Mart": "Walmart", "Tgt": "Target"}}`)
+	if a.version != b.version {
+		t.Errorf("versions %q and %q for the same settings", a.version, b.version)
+	}
+
+	// Stamped on points under the active config
+	h := newTestServer(t, nil)
+	id := process(t, h, targetReceipt)
+	for _, rc := range []RuleConfig{defaults, a} {
+		activateRuleConfig(t, rc)
+		w := send(h, http.MethodGet, "/receipts/"+id+"/points?recompute=true", "")
+		if got := w.Header().Get("X-Rule-Config-Version"); got != rc.version {
+			t.Errorf("X-Rule-Config-Version %q, want %q", got, rc.version)
+		}
+	}
+}
+
+func TestMinItemsForPoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   int
+		gate   string // the gate's description, empty when it takes nothing away
+	}{
+		{name: "default", config: `{}`, want: 28},
+		{name: "at the threshold", config: `{"minItemsForPoints": 5}`, want: 28},
+		{name: "below the threshold", config: `{"minItemsForPoints": 6}`, want: 0, gate: "-28 points because receipts need at least 6 items to earn points"},
+		{name: "overrides the floor", config: `{"minItemsForPoints": 6, "minPoints": 50}`, want: 0, gate: "-50 points because receipts need at least 6 items to earn points"},
+		{name: "after the divisor", config: `{"minItemsForPoints": 6, "pointsDivisor": 4}`, want: 0, gate: "-7 points because receipts need at least 6 items to earn points"},
+	}
+
+	receipt := parseReceipt(t, targetReceipt)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, breakdown := scoreUnder(t, newRuleConfig(t, tt.config), receipt)
+			if points != tt.want {
+				t.Errorf("got %d points, want %d", points, tt.want)
+			}
+			var gate string
+			if i := slices.IndexFunc(breakdown, func(s ruleScore) bool { return s.Rule == "minItemsForPoints" }); i >= 0 {
+				gate = breakdown[i].Description
+			}
+			if gate != tt.gate {
+				t.Errorf("gate %q, want %q", gate, tt.gate)
+			}
+		})
+	}
+
+	if _, err := parseRuleConfig([]byte(`{"minItemsForPoints": 0}`), "test config"); err == nil {
+		t.Error("a threshold of 0 was accepted")
+	}
+}
+
+func TestPriceEndingPoints(t *testing.T) {
+	items := func(prices ...string) []Item {
+		var items []Item
+		for _, price := range prices {
+			items = append(items, Item{ShortDescription: "Gum", Price: Amount(price)})
+		}
+		return items
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		items  []Item
+		want   int
+	}{
+		{name: "disabled", config: `{}`, items: items("4.99", "9.99"), want: 0},
+		{name: "each matching item", config: `{"priceEnding": {"ending": "99", "points": 3}}`, items: items("4.99", "1.00", "9.99"), want: 6},
+		{name: "no matching items", config: `{"priceEnding": {"ending": "99", "points": 3}}`, items: items("4.98", "0.09", "99.00"), want: 0},
+		{name: "cents under a dollar", config: `{"priceEnding": {"ending": "99", "points": 3}}`, items: items("0.99"), want: 3},
+		{name: "one digit", config: `{"priceEnding": {"ending": "9", "points": 2}}`, items: items("4.99", "0.09", "1.90"), want: 4},
+		{name: "round prices", config: `{"priceEnding": {"ending": "00", "points": 1}}`, items: items("5.00", "5", "5.10"), want: 2},
+		{name: "leading zero", config: `{"priceEnding": {"ending": "05", "points": 1}}`, items: items("1.05", "1.50"), want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newRuleConfig(t, tt.config).priceEndingPoints(tt.items); got != tt.want {
+				t.Errorf("got %d points, want %d", got, tt.want)
+			}
+		})
+	}
+
+	for _, invalid := range []string{
+		`{"priceEnding": {"ending": "999", "points": 1}}`,
+		`{"priceEnding": {"ending": ".99", "points": 1}}`,
+		`{"priceEnding": {"ending": "99", "points": -1}}`,
+	} {
+		if _, err := parseRuleConfig([]byte(invalid), "test config"); err == nil {
+			t.Errorf("%s was accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Subset of JSON Schema needed to describe a receipt
+type jsonSchema struct {
+	Schema     string                 `json:"$schema,omitempty"`
+	Title      string                 `json:"title,omitempty"`
+	Type       schemaType             `json:"type,omitempty"`
+	Properties map[string]*jsonSchema `json:"properties,omitempty"`
+	Required   []string               `json:"required,omitempty"`
+	AnyOf      []*jsonSchema          `json:"anyOf,omitempty"` // alternatives for an object already known to be one
+	Items      *jsonSchema            `json:"items,omitempty"`
+	MinItems   int                    `json:"minItems,omitempty"`
+	Pattern    string                 `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+	order   []string // property names in struct field order, for stable error output
+}
+
+// One type, or a list of accepted types
+type schemaType []string
+
+func (t schemaType) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+func (t *schemaType) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*t = schemaType{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// Derived from the Receipt struct tags, so the schema and binding share one source of
+// truth. Built at startup as it depends on configuration.
+var receiptSchema *jsonSchema
+
+func newReceiptSchema() *jsonSchema {
+	schema := schemaFor(reflect.TypeOf(Receipt{}))
+	schema.Schema = "https://json-schema.org/draft/2020-12/schema"
+	schema.Title = "Receipt"
+	return schema
+}
+
+// The receipt as sent rather than as validated, after departments are flattened into
+// items and any missing total is derived, so either of items or departments may be
+// given, and the total may be left out under DERIVE_TOTAL
+func servedReceiptSchema() *jsonSchema {
+	served := *receiptSchema
+	served.Required = slices.DeleteFunc(slices.Clone(served.Required), func(name string) bool {
+		return name == "items" || (name == "total" && config.DeriveTotal)
+	})
+	served.AnyOf = []*jsonSchema{{Required: []string{"items"}}, {Required: []string{"departments"}}}
+	return &served
+}
+
+// Maps json, binding and pattern struct tags onto schema keywords
+func schemaFor(t reflect.Type) *jsonSchema {
+	if t == reflect.TypeOf(Amount("")) {
+		if config.NumericAmounts {
+			return &jsonSchema{Type: schemaType{"string", "number"}}
+		}
+		return &jsonSchema{Type: schemaType{"string"}}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		schema := &jsonSchema{Type: schemaType{"object"}, Properties: make(map[string]*jsonSchema)}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			property := schemaFor(field.Type)
+			for _, rule := range strings.Split(field.Tag.Get("binding"), ",") {
+				switch {
+				case rule == "required":
+					schema.Required = append(schema.Required, name)
+				case strings.HasPrefix(rule, "min=") && property.Type[0] == "array":
+					property.MinItems, _ = strconv.Atoi(strings.TrimPrefix(rule, "min="))
+				}
+			}
+			if pattern := field.Tag.Get("pattern"); pattern != "" {
+				property.Pattern = pattern
+				property.pattern = regexp.MustCompile(pattern)
+			}
+
+			schema.Properties[name] = property
+			schema.order = append(schema.order, name)
+		}
+		return schema
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: schemaType{"array"}, Items: schemaFor(t.Elem())}
+	case reflect.Bool:
+		return &jsonSchema{Type: schemaType{"boolean"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &jsonSchema{Type: schemaType{"integer"}}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: schemaType{"number"}}
+	default:
+		return &jsonSchema{Type: schemaType{"string"}}
+	}
+}
+
+// Returns every violation found in the document, each prefixed with the path to the offending value
+func (s *jsonSchema) validate(body []byte) []string {
+	var document any
+	if err := json.Unmarshal(body, &document); err != nil {
+		return []string{"receipt: " + err.Error()}
+	}
+
+	var problems []string
+	s.check("receipt", document, &problems)
+	return problems
+}
+
+func (s *jsonSchema) check(path string, value any, problems *[]string) {
+	for _, t := range s.Type {
+		if hasSchemaType(value, t) {
+			s.checkAs(t, path, value, problems)
+			return
+		}
+	}
+
+	article := "a"
+	if strings.ContainsAny(s.Type[0][:1], "aeiou") {
+		article = "an"
+	}
+	*problems = append(*problems, fmt.Sprintf("%s: must be %s %s", path, article, strings.Join(s.Type, " or ")))
+}
+
+func hasSchemaType(value any, t string) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "integer", "number":
+		_, ok := value.(float64)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	}
+	return false
+}
+
+// Checks the keywords that apply to a value already known to be of type t
+func (s *jsonSchema) checkAs(t, path string, value any, problems *[]string) {
+	switch t {
+	case "object":
+		object := value.(map[string]any)
+		for _, name := range s.Required {
+			if _, present := object[name]; !present {
+				*problems = append(*problems, joinPath(path, name)+": is required")
+			}
+		}
+		if len(s.AnyOf) > 0 {
+			var unmatched []string
+			for _, alternative := range s.AnyOf {
+				var mismatches []string
+				alternative.checkAs(t, path, value, &mismatches)
+				if len(mismatches) == 0 {
+					unmatched = nil
+					break
+				}
+				unmatched = append(unmatched, strings.Join(mismatches, ", "))
+			}
+			if unmatched != nil {
+				*problems = append(*problems, strings.Join(unmatched, " or "))
+			}
+		}
+		for _, name := range s.order {
+			if v, present := object[name]; present {
+				s.Properties[name].check(joinPath(path, name), v, problems)
+			}
+		}
+	case "array":
+		array := value.([]any)
+		if len(array) < s.MinItems {
+			*problems = append(*problems, fmt.Sprintf("%s: must have at least %d element(s)", path, s.MinItems))
+		}
+		for i, element := range array {
+			s.Items.check(fmt.Sprintf("%s[%d]", path, i), element, problems)
+		}
+	case "string":
+		if s.pattern != nil && !s.pattern.MatchString(value.(string)) {
+			*problems = append(*problems, fmt.Sprintf("%s: must match pattern %s", path, s.Pattern))
+		}
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "receipt" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReceiptSchemaValidate(t *testing.T) {
+	config = loadConfig()
+	schema := newReceiptSchema()
+
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{name: "valid", body: targetReceipt},
+		{
+			name: "missing fields",
+			body: `{"retailer": "Target", "items": [{"shortDescription": "Gum", "price": "1.00"}]}`,
+			want: []string{"purchaseDate: is required", "purchaseTime: is required", "total: is required"},
+		},
+		{
+			name: "wrong types",
+			body: `{"retailer": 7, "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "items": {}, "total": 1}`,
+			want: []string{"retailer: must be a string", "items: must be an array", "total: must be a string"},
+		},
+		{
+			name: "patterns",
+			body: `{"retailer": "Target", "purchaseDate": "01/01/2022", "purchaseTime": "1pm", "items": [{"shortDescription": "Gum", "price": "1.00"}], "total": "1.00"}`,
+			want: []string{`purchaseDate: must match pattern ^\d{4}-\d{2}-\d{2}$`, `purchaseTime: must match pattern ^\d{2}:\d{2}$`},
+		},
+		{
+			name: "items",
+			body: `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "items": [{"price": true}], "total": "1.00"}`,
+			want: []string{"items[0].shortDescription: is required", "items[0].price: must be a string"},
+		},
+		{
+			name: "no items",
+			body: `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "items": [], "total": "1.00"}`,
+			want: []string{"items: must have at least 1 element(s)"},
+		},
+		{name: "not an object", body: `[]`, want: []string{"receipt: must be an object"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := schema.validate([]byte(tt.body)); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Fills in what decoding a served schema leaves out, so it can validate
+func prepareSchema(s *jsonSchema) {
+	if s.Pattern != "" {
+		s.pattern = regexp.MustCompile(s.Pattern)
+	}
+	s.order = slices.Sorted(maps.Keys(s.Properties))
+	for _, property := range s.Properties {
+		prepareSchema(property)
+	}
+	if s.Items != nil {
+		prepareSchema(s.Items)
+	}
+}
+
+func TestReceiptSchemaEndpoint(t *testing.T) {
+	h := newTestServer(t, nil)
+
+	w := send(h, http.MethodGet, "/schema/receipt.json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	var schema jsonSchema
+	decode(t, w, &schema)
+	prepareSchema(&schema)
+
+	if want := []string{"retailer", "purchaseDate", "purchaseTime", "total"}; !slices.Equal(schema.Type, schemaType{"object"}) || !slices.Equal(schema.Required, want) {
+		t.Errorf("got type %q requiring %q, want an object requiring %q", schema.Type, schema.Required, want)
+	}
+	if _, ok := schema.Properties["tags"]; !ok {
+		t.Errorf("optional tags are not described: %s", w.Body)
+	}
+
+	// Receipts are sent with either items or departments
+	for _, body := range []string{targetReceipt, departmentsReceipt} {
+		if problems := schema.validate([]byte(body)); problems != nil {
+			t.Errorf("served schema rejects %s: %q", body, problems)
+		}
+	}
+	neither := `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "total": "1.00"}`
+	if got, want := schema.validate([]byte(neither)), []string{"items: is required or departments: is required"}; !slices.Equal(got, want) {
+		t.Errorf("receipt without items or departments: got %q, want %q", got, want)
+	}
+
+	// Processing rejects what the schema does, listing every problem
+	var response struct{ Errors []string }
+	w = send(h, http.MethodPost, "/receipts/process", `{"retailer": 7}`)
+	decode(t, w, &response)
+	if w.Code != http.StatusBadRequest || len(response.Errors) != 5 {
+		t.Errorf("status %d with errors %q, want 400 with 5 errors", w.Code, response.Errors)
+	}
+}
+
+func TestReceiptSchemaEndpointDerivedTotal(t *testing.T) {
+	h := newTestServer(t, map[string]string{"DERIVE_TOTAL": "true"})
+
+	var schema jsonSchema
+	decode(t, send(h, http.MethodGet, "/schema/receipt.json", ""), &schema)
+	prepareSchema(&schema)
+
+	if want := []string{"retailer", "purchaseDate", "purchaseTime"}; !slices.Equal(schema.Required, want) {
+		t.Errorf("requiring %q, want %q", schema.Required, want)
+	}
+	omitted := strings.Replace(targetReceipt, `,
+	"total": "35.35"`, "", 1)
+	if problems := schema.validate([]byte(omitted)); problems != nil {
+		t.Errorf("served schema rejects a receipt without a total: %q", problems)
+	}
+	if w := send(h, http.MethodPost, "/receipts/process", omitted); w.Code != http.StatusCreated {
+		t.Errorf("processing a receipt without a total: status %d, want 201", w.Code)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errStoreFull       = errors.New("receipt store is full")
+	errReceiptNotFound = errors.New("receipt not found")
+	errReceiptExists   = errors.New("receipt already exists")
+)
+
+// A receipt as stored, with the points it earned under the rules in effect when it
+// was processed, so later rule changes don't rewrite history
+type storedReceipt struct {
+	Receipt          Receipt
+	OriginalRetailer string // the retailer name as sent, when an alias replaced it
+	Points           int
+	Breakdown        []ruleScore
+	CreatedAt        time.Time
+	ConfigVersion    string // of the rule config that scored Points
+
+	// Identifies receipts with the same content, for conditional creation
+	ContentHash string
+
+	// The request body exactly as received, when STORE_RAW_BYTES allows keeping it
+	Raw []byte
+
+	// Points earned under each rule config version it was scored with, oldest first.
+	// Only kept when POINTS_HISTORY is set.
+	History []pointsRecord
+}
+
+// The points a receipt earned under one version of the rule config
+type pointsRecord struct {
+	At            time.Time `json:"at"`
+	ConfigVersion string    `json:"configVersion"`
+	Points        int       `json:"points"`
+}
+
+// Where receipts are kept. Calls taking a context give up once it is done.
+type Store interface {
+	Put(ctx context.Context, id string, receipt storedReceipt) (evicted string, err error)
+	Create(ctx context.Context, id string, receipt storedReceipt) (evicted string, err error)
+	PutIfNew(ctx context.Context, id string, receipt storedReceipt) (existing, evicted string, err error)
+	Get(ctx context.Context, id string) (storedReceipt, error)
+	GetMany(ctx context.Context, ids []string) (map[string]storedReceipt, error)
+	Search(ctx context.Context, query string) ([]string, error)
+	List(ctx context.Context, tag string) ([]string, error)
+	Top(ctx context.Context, n int) ([]rankedReceipt, error)
+	Snapshot(ctx context.Context) ([]snapshotEntry, error)
+	RecordPoints(ctx context.Context, id string, record pointsRecord, limit int) error
+	HasEarlier(retailer, purchaseDate string, before time.Time, excludeID string) bool
+	LastCreated(retailer string, excludeID string) (time.Time, bool)
+	Len() int
+}
+
+// In-memory receipt storage, optionally bounded to a maximum number of receipts
+type receiptStore struct {
+	mu       sync.RWMutex
+	receipts map[string]storedReceipt
+	order    []string // creation order, oldest first, then by ID
+	limit    int
+	evict    bool
+	count    atomic.Int64 // mirrors len(receipts) so Len doesn't need the lock
+
+	// Lowercased item description -> IDs of the receipts containing it, so a
+	// search scans distinct descriptions rather than every receipt
+	descriptions map[string]map[string]struct{}
+
+	// Content hash -> IDs of the receipts with that content, in creation order, so the
+	// hash stays known while any of them is stored
+	hashes map[string][]string
+
+	// Tag -> IDs of the receipts carrying it
+	tags map[string]map[string]struct{}
+
+	// Retailer, and retailer and purchase date, -> IDs in creation order, for the rules
+	// that look at a retailer's earlier receipts without scanning every receipt
+	retailers     map[string][]string
+	retailerDates map[string][]string
+}
+
+func newReceiptStore(limit int, evict bool) *receiptStore {
+	return &receiptStore{
+		receipts:      make(map[string]storedReceipt),
+		limit:         limit,
+		evict:         evict,
+		descriptions:  make(map[string]map[string]struct{}),
+		hashes:        make(map[string][]string),
+		tags:          make(map[string]map[string]struct{}),
+		retailers:     make(map[string][]string),
+		retailerDates: make(map[string][]string),
+	}
+}
+
+// Once the limit is reached, either reject the receipt or drop the oldest one to make
+// room, returning the ID of the dropped receipt
+func (s *receiptStore) Put(ctx context.Context, id string, receipt storedReceipt) (evicted string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(id, receipt)
+}
+
+// Like Put, but fails with errReceiptExists rather than replacing a receipt
+func (s *receiptStore) Create(ctx context.Context, id string, receipt storedReceipt) (evicted string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.receipts[id]; exists {
+		return "", errReceiptExists
+	}
+	return s.put(id, receipt)
+}
+
+// Stores the receipt unless one with the same content hash is already stored, in
+// which case that receipt's ID is returned instead. The check and the write happen
+// under one lock, so concurrent duplicates can't both be stored.
+func (s *receiptStore) PutIfNew(ctx context.Context, id string, receipt storedReceipt) (existing, evicted string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing := s.hashes[receipt.ContentHash]; len(existing) > 0 {
+		return existing[0], "", nil
+	}
+
+	evicted, err = s.put(id, receipt)
+	return "", evicted, err
+}
+
+// Callers hold s.mu for writing. A receipt replacing one with the same ID takes the
+// new receipt's place in the order, and so in the eviction order.
+func (s *receiptStore) put(id string, receipt storedReceipt) (evicted string, err error) {
+	if old, exists := s.receipts[id]; exists {
+		s.unindex(id, old)
+		i := slices.Index(s.order, id)
+		s.order = slices.Delete(s.order, i, i+1)
+		s.receipts[id] = receipt
+		s.order = s.insertByCreation(s.order, id)
+		s.index(id, receipt)
+		return "", nil
+	}
+
+	if s.limit > 0 && len(s.receipts) >= s.limit {
+		if !s.evict {
+			return "", errStoreFull
+		}
+		evicted = s.order[0]
+		s.order = s.order[1:]
+		s.unindex(evicted, s.receipts[evicted])
+		delete(s.receipts, evicted)
+	}
+
+	s.receipts[id] = receipt
+	s.order = s.insertByCreation(s.order, id)
+	s.index(id, receipt)
+	s.count.Store(int64(len(s.receipts)))
+
+	return evicted, nil
+}
+
+func (s *receiptStore) Get(ctx context.Context, id string) (storedReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return storedReceipt{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	receipt, exists := s.receipts[id]
+	if !exists {
+		return storedReceipt{}, errReceiptNotFound
+	}
+	return receipt, nil
+}
+
+// Looks up several receipts under a single read lock, leaving out the ones that don't exist
+func (s *receiptStore) GetMany(ctx context.Context, ids []string) (map[string]storedReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make(map[string]storedReceipt, len(ids))
+	for _, id := range ids {
+		if receipt, exists := s.receipts[id]; exists {
+			found[id] = receipt
+		}
+	}
+	return found, nil
+}
+
+// When the most recent receipt for the retailer was stored, if there is one
+func (s *receiptStore) LastCreated(retailer string, excludeID string) (time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := s.retailers[retailerKey(retailer)]
+	for i := len(ids) - 1; i >= 0; i-- {
+		if ids[i] != excludeID {
+			return s.receipts[ids[i]].CreatedAt, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Retailer names match ignoring case and surrounding space
+func retailerKey(retailer string) string {
+	return strings.ToLower(strings.TrimSpace(retailer))
+}
+
+func retailerDateKey(retailer, purchaseDate string) string {
+	return retailerKey(retailer) + "\x00" + purchaseDate
+}
+
+// Appends to the receipt's points history, unless the latest entry already has the same
+// config version and points, keeping at most limit entries
+func (s *receiptStore) RecordPoints(ctx context.Context, id string, record pointsRecord, limit int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, found := s.receipts[id]
+	if !found {
+		return errReceiptNotFound
+	}
+	if n := len(stored.History); n > 0 && stored.History[n-1].ConfigVersion == record.ConfigVersion && stored.History[n-1].Points == record.Points {
+		return nil
+	}
+
+	// Copied, as receipts handed out by Get share the old slice
+	history := append(slices.Clip(stored.History), record)
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	stored.History = history
+	s.receipts[id] = stored
+	return nil
+}
+
+// Reports whether another receipt for the retailer and purchase date was stored before
+// the given time. The IDs are oldest first, so only the first other one needs checking.
+func (s *receiptStore) HasEarlier(retailer, purchaseDate string, before time.Time, excludeID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range s.retailerDates[retailerDateKey(retailer, purchaseDate)] {
+		if id != excludeID {
+			return s.receipts[id].CreatedAt.Before(before)
+		}
+	}
+	return false
+}
+
+// Stored IDs, oldest first, only those with the tag unless it is empty
+func (s *receiptStore) List(ctx context.Context, tag string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if tag == "" {
+		return slices.Clone(s.order), nil
+	}
+
+	tagged := s.tags[tag]
+	ids := make([]string, 0, len(tagged))
+	for _, id := range s.order {
+		if _, ok := tagged[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Orders stored receipts by when they were stored, then by ID, so repeated queries
+// page the same way. Callers hold s.mu.
+func (s *receiptStore) compareCreation(a, b string) int {
+	if order := s.receipts[a].CreatedAt.Compare(s.receipts[b].CreatedAt); order != 0 {
+		return order
+	}
+	return strings.Compare(a, b)
+}
+
+// Inserts a stored receipt's ID into IDs kept in creation order. Receipts are almost
+// always the newest, so the search starts from the end. Callers hold s.mu for writing.
+func (s *receiptStore) insertByCreation(ids []string, id string) []string {
+	i := len(ids)
+	for i > 0 && s.compareCreation(ids[i-1], id) > 0 {
+		i--
+	}
+	return slices.Insert(ids, i, id)
+}
+
+// One receipt of a snapshot
+type snapshotEntry struct {
+	ID      string
+	Receipt storedReceipt
+}
+
+// A consistent copy of every receipt, oldest first, for scans that would
+// otherwise hold the lock throughout. Only the copy happens under the read lock, so
+// writers wait for that rather than for the whole scan. Stored receipts are never
+// modified in place, so sharing their slices with the copy is safe.
+func (s *receiptStore) Snapshot(ctx context.Context) ([]snapshotEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]snapshotEntry, len(s.order))
+	for i, id := range s.order {
+		entries[i] = snapshotEntry{ID: id, Receipt: s.receipts[id]}
+	}
+	return entries, nil
+}
+
+// A receipt's place on the leaderboard
+type rankedReceipt struct {
+	ID       string
+	Retailer string
+	Points   int
+	position int // oldest first, so ties go to the earlier receipt
+}
+
+// The n receipts with the most stored points, highest first. A min-heap of the best n
+// seen so far keeps this to O(len log n) rather than sorting every receipt, and
+// ranking a snapshot keeps it from blocking writes.
+func (s *receiptStore) Top(ctx context.Context, n int) ([]rankedReceipt, error) {
+	entries, err := s.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	best := make(leaderboard, 0, min(n, len(entries)))
+	for position, entry := range entries {
+		candidate := rankedReceipt{ID: entry.ID, Retailer: entry.Receipt.Receipt.Retailer, Points: entry.Receipt.Points, position: position}
+		if len(best) < n {
+			heap.Push(&best, candidate)
+		} else if n > 0 && outranks(candidate, best[0]) {
+			best[0] = candidate
+			heap.Fix(&best, 0)
+		}
+	}
+
+	ranked := make([]rankedReceipt, len(best))
+	for i := len(ranked) - 1; i >= 0; i-- {
+		ranked[i] = heap.Pop(&best).(rankedReceipt)
+	}
+	return ranked, nil
+}
+
+func outranks(a, b rankedReceipt) bool {
+	if a.Points != b.Points {
+		return a.Points > b.Points
+	}
+	return a.position < b.position
+}
+
+// Min-heap with the lowest ranked receipt on top
+type leaderboard []rankedReceipt
+
+func (l leaderboard) Len() int           { return len(l) }
+func (l leaderboard) Less(i, j int) bool { return outranks(l[j], l[i]) }
+func (l leaderboard) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l *leaderboard) Push(x any)        { *l = append(*l, x.(rankedReceipt)) }
+func (l *leaderboard) Pop() any {
+	old := *l
+	last := old[len(old)-1]
+	*l = old[:len(old)-1]
+	return last
+}
+
+func (s *receiptStore) Len() int {
+	return int(s.count.Load())
+}
+
+// Returns the IDs of receipts with an item description containing query, ignoring case,
+// oldest first
+func (s *receiptStore) Search(ctx context.Context, query string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	query = strings.ToLower(query)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matches := make(map[string]struct{})
+	for description, ids := range s.descriptions {
+		if strings.Contains(description, query) {
+			for id := range ids {
+				matches[id] = struct{}{}
+			}
+		}
+	}
+
+	result := make([]string, 0, len(matches))
+	for id := range matches {
+		result = append(result, id)
+	}
+	slices.SortFunc(result, s.compareCreation)
+
+	return result, nil
+}
+
+func (s *receiptStore) index(id string, stored storedReceipt) {
+	if stored.ContentHash != "" {
+		s.hashes[stored.ContentHash] = s.insertByCreation(s.hashes[stored.ContentHash], id)
+	}
+
+	retailer := retailerKey(stored.Receipt.Retailer)
+	s.retailers[retailer] = s.insertByCreation(s.retailers[retailer], id)
+	date := retailerDateKey(stored.Receipt.Retailer, stored.Receipt.PurchaseDate)
+	s.retailerDates[date] = s.insertByCreation(s.retailerDates[date], id)
+
+	for _, tag := range stored.Receipt.Tags {
+		if s.tags[tag] == nil {
+			s.tags[tag] = make(map[string]struct{})
+		}
+		s.tags[tag][id] = struct{}{}
+	}
+
+	for _, item := range stored.Receipt.Items {
+		key := strings.ToLower(strings.TrimSpace(item.ShortDescription))
+		if s.descriptions[key] == nil {
+			s.descriptions[key] = make(map[string]struct{})
+		}
+		s.descriptions[key][id] = struct{}{}
+	}
+}
+
+func (s *receiptStore) unindex(id string, stored storedReceipt) {
+	removeID(s.hashes, stored.ContentHash, id)
+	removeID(s.retailers, retailerKey(stored.Receipt.Retailer), id)
+	removeID(s.retailerDates, retailerDateKey(stored.Receipt.Retailer, stored.Receipt.PurchaseDate), id)
+
+	for _, tag := range stored.Receipt.Tags {
+		delete(s.tags[tag], id)
+		if len(s.tags[tag]) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+
+	for _, item := range stored.Receipt.Items {
+		key := strings.ToLower(strings.TrimSpace(item.ShortDescription))
+		delete(s.descriptions[key], id)
+		if len(s.descriptions[key]) == 0 {
+			delete(s.descriptions, key)
+		}
+	}
+}
+
+// Drops id from the IDs kept under key, and the key once none are left
+func removeID(index map[string][]string, key, id string) {
+	ids := index[key]
+	if i := slices.Index(ids, id); i >= 0 {
+		ids = slices.Delete(ids, i, i+1)
+	}
+	if len(ids) == 0 {
+		delete(index, key)
+	} else {
+		index[key] = ids
+	}
+}
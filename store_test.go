@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Base time for receipts stored in tests, one minute apart in the order they are added
+var storeEpoch = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// A stored receipt with an item for each description, created minute minutes after storeEpoch
+func storedWith(minute int, descriptions ...string) storedReceipt {
+	receipt := Receipt{Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "1.00"}
+	for _, description := range descriptions {
+		receipt.Items = append(receipt.Items, Item{ShortDescription: description, Price: "1.00"})
+	}
+	return storedReceipt{Receipt: receipt, CreatedAt: storeEpoch.Add(time.Duration(minute) * time.Minute)}
+}
+
+func TestStoreSearch(t *testing.T) {
+	ctx := context.Background()
+	s := newReceiptStore(3, true)
+	s.Put(ctx, "a", storedWith(0, "Whole Milk", "Bread"))
+	s.Put(ctx, "b", storedWith(1, "Oat milk"))
+	s.Put(ctx, "c", storedWith(2, "Bread", "Butter"))
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{name: "substring ignoring case", query: "MILK", want: []string{"a", "b"}},
+		{name: "whole description", query: "butter", want: []string{"c"}},
+		{name: "several items of one receipt", query: "b", want: []string{"a", "c"}},
+		{name: "across words", query: "le mi", want: []string{"a"}},
+		{name: "no match", query: "cheese", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Search(ctx, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Search(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+
+	// Evicting and replacing receipts keeps the index in step
+	s.Put(ctx, "d", storedWith(3, "Cheese"))
+	s.Put(ctx, "c", storedWith(4, "Cheddar"))
+	for query, want := range map[string][]string{"milk": {"b"}, "bread": {}, "butter": {}, "che": {"d", "c"}} {
+		if got, _ := s.Search(ctx, query); !slices.Equal(got, want) {
+			t.Errorf("after evicting and replacing, Search(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestStoreHasEarlier(t *testing.T) {
+	ctx := context.Background()
+	s := newReceiptStore(0, false)
+	at := func(minute int) time.Time { return storeEpoch.Add(time.Duration(minute) * time.Minute) }
+	seed := func(id, retailer, date string, minute int) {
+		receipt := storedWith(minute, "Gum")
+		receipt.Receipt.Retailer, receipt.Receipt.PurchaseDate = retailer, date
+		s.Put(ctx, id, receipt)
+	}
+	seed("a", "Target", "2022-01-01", 10)
+	seed("b", " TARGET ", "2022-01-01", 20)
+	seed("c", "Walgreens", "2022-01-02", 30)
+
+	tests := []struct {
+		name      string
+		retailer  string
+		date      string
+		before    time.Time
+		excludeID string
+		want      bool
+	}{
+		{name: "later receipt", retailer: "Target", date: "2022-01-01", before: at(15), want: true},
+		{name: "retailer ignores case and space", retailer: "target  ", date: "2022-01-01", before: at(15), want: true},
+		{name: "only later ones stored", retailer: "Target", date: "2022-01-01", before: at(5), want: false},
+		{name: "same instant", retailer: "Target", date: "2022-01-01", before: at(10), want: false},
+		{name: "the receipt itself", retailer: "Target", date: "2022-01-01", before: at(15), excludeID: "a", want: false},
+		{name: "excluding the first", retailer: "Target", date: "2022-01-01", before: at(25), excludeID: "a", want: true},
+		{name: "other date", retailer: "Target", date: "2022-01-02", before: at(60), want: false},
+		{name: "other retailer", retailer: "Walgreens", date: "2022-01-02", before: at(60), want: true},
+		{name: "unknown retailer", retailer: "Costco", date: "2022-01-01", before: at(60), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.HasEarlier(tt.retailer, tt.date, tt.before, tt.excludeID); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Evicted receipts no longer count
+	s.evict, s.limit = true, 3
+	seed("d", "Costco", "2022-01-03", 40)
+	if s.HasEarlier("Target", "2022-01-01", at(15), "") {
+		t.Error("an evicted receipt still counts as earlier")
+	}
+}
+
+func TestStoreTop(t *testing.T) {
+	ctx := context.Background()
+	s := newReceiptStore(0, false)
+	for i, points := range []int{10, 50, 30, 50, 5, 30} {
+		receipt := storedWith(i)
+		receipt.Points = points
+		s.Put(ctx, string(rune('a'+i)), receipt)
+	}
+
+	tests := []struct {
+		n    int
+		want []string // IDs, best first, ties in creation order
+	}{
+		{n: 1, want: []string{"b"}},
+		{n: 2, want: []string{"b", "d"}},
+		{n: 4, want: []string{"b", "d", "c", "f"}},
+		{n: 6, want: []string{"b", "d", "c", "f", "a", "e"}},
+		{n: 10, want: []string{"b", "d", "c", "f", "a", "e"}},
+	}
+
+	for _, tt := range tests {
+		ranked, err := s.Top(ctx, tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(ranked))
+		for i, r := range ranked {
+			ids[i] = r.ID
+			if i > 0 && r.Points > ranked[i-1].Points {
+				t.Errorf("top %d out of order: %+v", tt.n, ranked)
+			}
+		}
+		if !slices.Equal(ids, tt.want) {
+			t.Errorf("top %d: got %v, want %v", tt.n, ids, tt.want)
+		}
+	}
+}
+
+// What a snapshot held, copied out so later changes to shared slices would show
+func snapshotSummary(entries []snapshotEntry) []string {
+	summary := make([]string, len(entries))
+	for i, entry := range entries {
+		var descriptions []string
+		for _, item := range entry.Receipt.Receipt.Items {
+			descriptions = append(descriptions, item.ShortDescription)
+		}
+		summary[i] = fmt.Sprintf("%s %s %d history", entry.ID, strings.Join(descriptions, ","), len(entry.Receipt.History))
+	}
+	return summary
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := newReceiptStore(4, true)
+	s.Put(ctx, "a", storedWith(0, "Milk"))
+	s.Put(ctx, "b", storedWith(1, "Bread"))
+	s.Put(ctx, "c", storedWith(2, "Eggs"))
+	s.RecordPoints(ctx, "c", pointsRecord{Points: 1, ConfigVersion: "v1"}, 10)
+
+	snapshot, err := s.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a Milk 0 history", "b Bread 0 history", "c Eggs 1 history"}
+	if got := snapshotSummary(snapshot); !slices.Equal(got, want) {
+		t.Fatalf("snapshot %q, want %q", got, want)
+	}
+
+	// Writers replace, add, evict and record history for receipts while the snapshot is read
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				switch i % 4 {
+				case 0:
+					s.Put(ctx, "b", storedWith(10+i, "Rye"))
+				case 1:
+					s.Put(ctx, fmt.Sprintf("new-%d-%d", w, i), storedWith(10+i, "Jam"))
+				case 2:
+					s.RecordPoints(ctx, "c", pointsRecord{Points: 2 + i, ConfigVersion: "v2"}, 10)
+				case 3:
+					s.Put(ctx, "a", storedWith(10+i, "Cream"))
+				}
+			}
+		}()
+	}
+	for range 50 {
+		if got := snapshotSummary(snapshot); !slices.Equal(got, want) {
+			t.Fatalf("snapshot changed to %q during writes", got)
+		}
+	}
+	wg.Wait()
+
+	if got := snapshotSummary(snapshot); !slices.Equal(got, want) {
+		t.Errorf("snapshot changed to %q after writes", got)
+	}
+	after, _ := s.Snapshot(ctx)
+	if got := snapshotSummary(after); slices.Equal(got, want) || len(got) != 4 {
+		t.Errorf("a later snapshot %q doesn't show the writes", got)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.Snapshot(cancelled); err == nil {
+		t.Error("snapshot of a cancelled request succeeded")
+	}
+}